@@ -3,87 +3,387 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
 
+	"github.com/anrid/search-bench/pkg/bench"
 	"github.com/anrid/search-bench/pkg/compare"
 	"github.com/anrid/search-bench/pkg/elastic"
+	"github.com/anrid/search-bench/pkg/engine"
+	"github.com/anrid/search-bench/pkg/eval"
 	"github.com/anrid/search-bench/pkg/item"
 	"github.com/anrid/search-bench/pkg/query"
+	"github.com/anrid/search-bench/pkg/report"
 	"github.com/spf13/pflag"
+
+	// Register search engines (elastic is registered by the import above)
+	_ "github.com/anrid/search-bench/pkg/manticore"
 )
 
 const (
-	ESHost                = "http://127.0.0.1:9200"
-	ESSanityTestIndexName = "test"
-	ESBenchIndexName      = "items"
-	DebugPrint            = false
+	DebugPrint = false
 )
 
 type Map = map[string]interface{}
 
 func main() {
-	engine := pflag.StringP("engine", "e", "elastic", "search engine to use [elastic | manticore] (default: elastic) [REQUIRED]")
+	engines := pflag.StringSliceP("engine", "e", []string{"elastic"}, "search engines to use, runs the same workload against each engine in order [elastic | manticore] [REQUIRED]")
 	dataDir := pflag.StringP("data-dir", "d", "", "data dir containing Item files in CSV format (gzipped) [REQUIRED]")
 	filenameFilter := pflag.StringP("filename-filter", "f", ".csv.gz", "filename pattern to filter on in data dir")
 	batchSize := pflag.Int("batch-size", 5000, "batch size, i.e. number of items to insert into ES at a time")
 	max := pflag.Int("max", 1_000_000, "process max X items before exiting")
 	startFrom := pflag.Int("start-from", 0, "start processing items from the Xth item found in data dir")
 	benchmarkRuns := pflag.Int("runs", 3, "number of query benchmark runs to execute and average")
+	concurrency := pflag.IntP("concurrency", "c", 1, "number of workers executing queries in parallel during the query benchmark")
+	qps := pflag.Float64("qps", 0, "dispatch queries at this fixed rate (open loop) instead of as fast as workers complete them")
+	replay := pflag.String("replay", query.ReplayFlat, "how to replay the queries file: every query once (flat), every query as many times as it was searched (expand), or a random sample weighted by how often queries were searched (sample) ["+strings.Join(query.ReplayModes, " | ")+"]")
+	replayLength := pflag.Int("replay-length", 0, "number of queries to replay with --replay expand (scaling counts to add up to this) or sample (default: the sum of all counts, or the number of queries)")
+	replaySeed := pflag.Int64("replay-seed", 1, "random seed for --replay sample, the same seed replays the same queries")
+	paging := pflag.String("paging", engine.PagingFromSize, "how to fetch the pages following the first page of results [from_size | search_after | pit]")
+	pageSize := pflag.Int("page-size", 120, "number of results per page during the query benchmark")
+	fetchMax := pflag.Int("fetch-max", 240, "fetch up to this many results per query during the query benchmark")
 	runIndexer := pflag.Bool("run-indexer", false, "recreates bench index, reads items and indexes them in bulk")
-	queriesFile := pflag.StringP("queries-file", "q", "", "top queries file (exported from Search logs in BigQuery) [REQUIRED]")
-	fetchSource := pflag.Bool("fetch-source", false, "fetch item source when querying items (not just item IDs)")
+	queriesFile := pflag.StringP("queries-file", "q", "", "top queries file (exported from Search logs in BigQuery) as a JSON array, JSON lines or CSV, optionally gzip compressed [REQUIRED]")
+	fetchSource := pflag.Bool("fetch-source", false, "fetch item source when querying items (not just item IDs), and store full items in the results file (gzip compressed)")
 	createChangeLog := pflag.Bool("create-change-log", false, "create a change log used when running indexing operations during the query benchmark")
-	changeLogFile := pflag.String("change-log-file", "", "write change log data to this file")
-	resultsFile := pflag.String("results-file", "", "write compact query results (the order of primary keys only) to this file")
-	compareResults := pflag.StringSlice("compare-results", []string{}, "Compare the given results files")
-	useItemsWithNoDesc := pflag.Bool("items-no-desc", false, "Import items that do not have a description field")
+	changeLogFile := pflag.String("change-log-file", "", "write change log data to this file, or replay it during the query benchmark (runs the benchmark again with write load)")
+	changeLogRate := pflag.Int("change-log-rate", 1000, "max number of change log entries to apply per second when replaying a change log")
+	changeLogBatchSize := pflag.Int("change-log-batch-size", 100, "number of change log entries to apply per bulk request when replaying a change log")
+	resultsFile := pflag.String("results-file", "", "write query results (the query, IDs and scores on every page, total hits and timing) to this file as JSON lines, suffixed with the engine name when using multiple engines")
+	reportFile := pflag.String("report-file", "", "write a machine readable report of the indexing or query benchmark run to this file (.json or .csv), suffixed with the engine name when using multiple engines")
+	compareResults := pflag.StringSlice("compare-results", []string{}, "Compare the given results files, pairwise in a matrix when given 3 or more files")
+	compareReport := pflag.String("compare-report", "", "write a drill-down report of the queries for which two --compare-results files differ to this file (.md or .html), with query details for legacy results files when given the --queries-file used to produce them")
+	evaluate := pflag.Bool("evaluate", false, "score query results against --judgments-file, either the given --results-file or live results when running the query benchmark")
+	judgmentsFile := pflag.String("judgments-file", "", "relevance judgments file with one '<query number> <item ID> <grade>' line per judgment")
+	evalK := pflag.IntSlice("eval-k", []int{10, 40, 120}, "cutoffs used for nDCG@k and P@k when evaluating results")
+	useItemsWithNoDesc := pflag.Bool("items-no-desc", false, "index and query items that do not have a description field (the items_no_desc index), with price, item condition and updated date")
+	priceMin := pflag.Int("price-min", 0, "add a minimum price filter to every query (requires --items-no-desc)")
+	priceMax := pflag.Int("price-max", 0, "add a maximum price filter to every query (requires --items-no-desc)")
+	conditions := pflag.IntSlice("conditions", []int{}, "add an item condition filter to every query, e.g. --conditions 1,2 (1 = like new, 2 = good, 3 = poor, 4 = other, requires --items-no-desc)")
+	sortOrder := pflag.String("sort", "", "sort every query by created_desc (newest first), or by updated_desc, price_asc or price_desc (requires --items-no-desc), rather than by score or created date")
+	esURL := pflag.String("es-url", "http://127.0.0.1:9200", "Elasticsearch URL")
+	esUsername := pflag.String("es-username", "", "Elasticsearch username (basic auth)")
+	esPassword := pflag.String("es-password", "", "Elasticsearch password (basic auth), defaults to the ES_PASSWORD env var")
+	esAPIKey := pflag.String("es-api-key", "", "Elasticsearch API key (base64 encoded), defaults to the ES_API_KEY env var")
+	esCACert := pflag.String("es-ca-cert", "", "PEM encoded CA certificate used to verify Elasticsearch, e.g. http_ca.crt from an ES 8 container")
+	esInsecure := pflag.Bool("es-insecure", false, "skip TLS certificate verification when connecting to Elasticsearch")
+	manticoreURL := pflag.String("manticore-url", "http://127.0.0.1:9308", "Manticore Search HTTP API URL")
+	requestTimeout := pflag.Duration("request-timeout", 2*time.Minute, "timeout for each request to a search engine (0 = no timeout)")
+	maxBadRows := pflag.Int("max-bad-rows", 1000, "skip up to this many malformed rows in the data files before giving up (negative = no limit)")
+	maxFailedBatches := pflag.Int("max-failed-batches", 10, "skip up to this many failed bulk requests when indexing before giving up (negative = no limit)")
+	maxFailedQueries := pflag.Int("max-failed-queries", 100, "skip up to this many failed queries per benchmark run before giving up (negative = no limit)")
+	bulkMaxBytes := pflag.Int("bulk-max-bytes", 10_000_000, "flush a batch once its estimated bulk request size reaches this many bytes, even if it has fewer than --batch-size items (0 = no limit)")
+	bulkMaxWait := pflag.Duration("bulk-max-wait", 5*time.Second, "flush a batch once its first item was read this long ago (0 = no limit)")
+	tokenizeWorkers := pflag.Int("tokenize-workers", runtime.NumCPU(), "number of workers tokenizing items in parallel when indexing")
+	bulkWorkers := pflag.Int("bulk-workers", 2, "number of concurrent bulk requests when indexing")
+	bulkRetries := pflag.Int("bulk-retries", 5, "retry documents rejected by Elasticsearch (429 / es_rejected_execution_exception) this many times when bulk indexing")
+	bulkBackoff := pflag.Duration("bulk-backoff", 100*time.Millisecond, "initial backoff before retrying rejected documents, doubled (with jitter) for each retry")
+	deadLetterFile := pflag.String("dead-letter-file", "", "write documents that failed to index to this file (JSON lines), suffixed with the engine name when using multiple engines")
+	indexTemplateDir := pflag.String("index-template-dir", "", "load index mappings and settings templates (<index>.json, .yaml or .yml) from this dir instead of the built-in ones (elastic only)")
+	indexVars := pflag.StringToString("index-var", map[string]string{}, "set variables substituted into index templates, e.g. --index-var shards=2,codec=best_compression (built-in: shards, replicas, refresh_interval, codec, query_cache, bm25_b, bm25_k1), and the analysis mode, e.g. --index-var analysis=kuromoji [kagome | kuromoji | ngram | cjk_bigram]")
+	sweeps := pflag.StringArray("sweep", []string{}, "with --run-indexer, index (and benchmark, given a --queries-file) every combination of the swept index variables, e.g. --sweep bm25_b=0.3,0.75 --sweep bm25_k1=1.2,2.0")
+	queryTemplates := pflag.StringSlice("query-template", []string{}, "query shapes to benchmark instead of the built-in one, each run over the same queries with results and report files suffixed with the template name when given several (elastic only) [built-in: "+strings.Join(elastic.QueryTemplateNames(), " | ")+" | path to a .json, .yaml or .yml template]")
+	queryRetries := pflag.Int("query-retries", 2, "retry a failed search request this many times (with exponential backoff) before counting the query as failed")
 
 	pflag.Parse()
 
-	switch *engine {
-	case "elastic":
-		elastic.SanityTest()
+	// Modes that don't talk to a search engine
+	if len(*compareResults) > 0 {
+		switch len(*compareResults) {
+		case 1:
+			fmt.Printf("Need at least 2 results files to compare (pass two or more --compare-results flags)\n")
+			pflag.PrintDefaults()
+			os.Exit(-1)
+		case 2:
+			exitOnError(compare.CompareResults((*compareResults)[0], (*compareResults)[1]))
+
+			if *compareReport != "" {
+				var queries []*query.SearchQuery
+				if *queriesFile != "" {
+					var err error
+					queries, _, err = query.Load(*queriesFile)
+					exitOnError(err)
+				}
+				err := compare.WriteDrillDown(compare.DrillDownArgs{
+					FileA:      (*compareResults)[0],
+					FileB:      (*compareResults)[1],
+					Queries:    queries,
+					ReportFile: *compareReport,
+				})
+				exitOnError(err)
+			}
+		default:
+			if *compareReport != "" {
+				fmt.Println("WARNING: --compare-report is only supported when comparing 2 results files")
+			}
+			m, err := compare.CompareMany(*compareResults)
+			exitOnError(err)
+			m.Print()
+		}
+		return
+	}
+	var judgments eval.Judgments
+	if *evaluate {
+		if *judgmentsFile == "" {
+			fmt.Println("--evaluate requires a --judgments-file")
+			pflag.PrintDefaults()
+			os.Exit(-1)
+		}
+		var err error
+		judgments, err = eval.LoadJudgments(*judgmentsFile)
+		exitOnError(err)
 
-		if len(*compareResults) > 0 {
-			if len(*compareResults) != 2 {
-				fmt.Printf("Can only compare results between 2 files (pass two --compare-results flags)\n")
+		if *queriesFile == "" {
+			// Score an existing results file
+			if *resultsFile == "" {
+				fmt.Println("--evaluate requires a --results-file or a --queries-file to run the query benchmark")
 				pflag.PrintDefaults()
 				os.Exit(-1)
 			}
-			compare.CompareResults((*compareResults)[0], (*compareResults)[1])
-		} else if *createChangeLog && *dataDir != "" && *changeLogFile != "" {
-			item.CreateChangeLog(item.CreateChangeLogArgs{
-				ChangeLogFile:  *changeLogFile,
-				DataDir:        *dataDir,
-				FilenameFilter: *filenameFilter,
-				BatchSize:      *batchSize,
-				StartFrom:      *startFrom,
-				MaxItems:       *max,
-			})
-		} else if *runIndexer && *dataDir != "" {
-			elastic.RunIndexer(elastic.RunIndexerArgs{
-				DataDir:        *dataDir,
-				FilenameFilter: *filenameFilter,
-				UseItemsNoDesc: *useItemsWithNoDesc,
-				Max:            *max,
-				BatchSize:      *batchSize,
-			})
-		} else if *queriesFile != "" {
-			queries := query.Load(*queriesFile)
-
-			elastic.RunBenchmark(elastic.RunBenchmarkArgs{
-				NumberOfRuns: *benchmarkRuns,
-				Queries:      queries,
-				FetchSource:  *fetchSource,
-				ResultsFile:  *resultsFile,
-			})
-		} else {
-			fmt.Println("Not enough flags given")
-			pflag.PrintDefaults()
+			results, err := eval.ReadResults(*resultsFile)
+			exitOnError(err)
+			eval.Evaluate(judgments, results, *evalK).Print()
+			return
 		}
-	case "manticore":
-		fmt.Printf("TODO!")
-	default:
-		fmt.Printf("Unsupported search engine '%s'\n", *engine)
+	}
+	if *createChangeLog && *dataDir != "" && *changeLogFile != "" {
+		_, err := item.CreateChangeLog(item.CreateChangeLogArgs{
+			ChangeLogFile:  *changeLogFile,
+			DataDir:        *dataDir,
+			FilenameFilter: *filenameFilter,
+			BatchSize:      *batchSize,
+			StartFrom:      *startFrom,
+			MaxItems:       *max,
+		})
+		exitOnError(err)
+		return
+	}
+
+	if !(*runIndexer && *dataDir != "") && *queriesFile == "" {
+		fmt.Println("Not enough flags given")
+		pflag.PrintDefaults()
+		os.Exit(-1)
+	}
+	if len(*sweeps) > 0 && !*runIndexer {
+		fmt.Println("--sweep requires --run-indexer, since every variant is indexed from scratch")
 		pflag.PrintDefaults()
+		os.Exit(-1)
+	}
+	if *reportFile != "" {
+		exitOnError(report.ValidFilename(*reportFile))
+	}
+	variants, err := bench.Variants(*indexVars, *sweeps)
+	exitOnError(err)
+	if !slices.Contains(engine.PagingStrategies, *paging) {
+		fmt.Printf("Unsupported paging strategy '%s' (supported: %s)\n", *paging, strings.Join(engine.PagingStrategies, ", "))
+		pflag.PrintDefaults()
+		os.Exit(-1)
+	}
+
+	if *esPassword == "" {
+		*esPassword = os.Getenv("ES_PASSWORD")
+	}
+	if *esAPIKey == "" {
+		*esAPIKey = os.Getenv("ES_API_KEY")
+	}
+
+	configs := map[string]*engine.Config{
+		"elastic": {
+			URL:                *esURL,
+			Username:           *esUsername,
+			Password:           *esPassword,
+			APIKey:             *esAPIKey,
+			CACertFile:         *esCACert,
+			InsecureSkipVerify: *esInsecure,
+			Timeout:            *requestTimeout,
+			BulkRetries:        *bulkRetries,
+			BulkBackoff:        *bulkBackoff,
+			IndexTemplateDir:   *indexTemplateDir,
+		},
+		"manticore": {
+			URL:     *manticoreURL,
+			Timeout: *requestTimeout,
+		},
+	}
+
+	var es []engine.Engine
+	for _, name := range *engines {
+		e, err := engine.New(name, configs[name])
+		if err != nil {
+			fmt.Println(err)
+			pflag.PrintDefaults()
+			os.Exit(-1)
+		}
+		es = append(es, e)
+	}
+
+	if *runIndexer {
+		// Fail before indexing the first variant rather than midway through a sweep
+		index := engine.ItemsIndexName
+		if *useItemsWithNoDesc {
+			index = engine.ItemsNoDescIndexName
+		}
+		for _, e := range es {
+			for _, v := range variants {
+				err := engine.CheckIndexTemplate(e, index, v.Vars)
+				if err != nil && v.Name != "" {
+					err = fmt.Errorf("variant %s: %w", v.Name, err)
+				}
+				exitOnError(err)
+			}
+		}
+	}
+
+	// When sweeping index settings, every variant is indexed and then
+	// benchmarked, if given queries
+	benchmark := !*runIndexer || (len(*sweeps) > 0 && *queriesFile != "")
+
+	templates := *queryTemplates
+	if len(templates) == 0 {
+		// The engine's built-in query shape
+		templates = []string{""}
+	}
+
+	filters := &query.Filters{PriceMin: *priceMin, PriceMax: *priceMax, Sort: *sortOrder}
+	for _, c := range *conditions {
+		filters.Conditions = append(filters.Conditions, item.ItemCondition(c))
+	}
+	replayArgs := query.ReplayArgs{Mode: *replay, Length: *replayLength, Seed: *replaySeed}
+	if benchmark {
+		exitOnError(query.ValidSort(*sortOrder))
+		exitOnError(replayArgs.Validate())
+
+		// Queries are read as they're executed, fail early on unreadable files
+		r, err := query.Open(*queriesFile)
+		exitOnError(err)
+		r.Close()
+	}
+
+	for _, e := range es {
+		fmt.Printf("Using search engine: %s\n", e.Name())
+
+		exitOnError(e.SanityTest())
+
+		var runs []*bench.SweepRun
+		for _, v := range variants {
+			if v.Name != "" {
+				fmt.Printf("Running index settings variant: %s\n", v.Name)
+			}
+
+			var indexReport *report.Report
+			if *runIndexer {
+				reportFile := v.Filename(engineFilename(*reportFile, e, len(es)))
+				if benchmark && reportFile != "" {
+					// Keep the indexing report apart from the benchmark report
+					reportFile = bench.SuffixFilename(reportFile, "index")
+				}
+
+				indexReport, err = bench.RunIndexer(e, bench.RunIndexerArgs{
+					DataDir:        *dataDir,
+					FilenameFilter: *filenameFilter,
+					UseItemsNoDesc: *useItemsWithNoDesc,
+					Max:            *max,
+					BatchSize:      *batchSize,
+					ReportFile:     reportFile,
+
+					IndexVars: v.Vars,
+					Variant:   v.Name,
+
+					BulkMaxBytes: *bulkMaxBytes,
+					BulkMaxWait:  *bulkMaxWait,
+
+					MaxBadRecords:    *maxBadRows,
+					MaxFailedBatches: *maxFailedBatches,
+					DeadLetterFile:   v.Filename(engineFilename(*deadLetterFile, e, len(es))),
+
+					TokenizeWorkers: *tokenizeWorkers,
+					BulkWorkers:     *bulkWorkers,
+				})
+				exitOnError(err)
+			}
+
+			if !benchmark {
+				runs = append(runs, &bench.SweepRun{Variant: v, Index: indexReport})
+				continue
+			}
+
+			for i, qt := range templates {
+				run := &bench.SweepRun{Variant: v, QueryTemplate: qt}
+				if i == 0 {
+					run.Index = indexReport
+				}
+
+				run.Benchmark, err = bench.RunBenchmark(e, bench.RunBenchmarkArgs{
+					NumberOfRuns:   *benchmarkRuns,
+					QueriesFile:    *queriesFile,
+					Filters:        filters,
+					FetchSource:    *fetchSource,
+					UseItemsNoDesc: *useItemsWithNoDesc,
+					ResultsFile:    templateFilename(v.Filename(engineFilename(*resultsFile, e, len(es))), qt, len(templates)),
+
+					ChangeLogFile:      *changeLogFile,
+					ChangeLogRate:      *changeLogRate,
+					ChangeLogBatchSize: *changeLogBatchSize,
+
+					Concurrency: *concurrency,
+					QPS:         *qps,
+
+					Replay: replayArgs,
+
+					Paging:   *paging,
+					PageSize: *pageSize,
+					FetchMax: *fetchMax,
+					Analysis: v.Vars.Analysis(),
+
+					QueryTemplate: qt,
+
+					Judgments: judgments,
+					EvalK:     *evalK,
+
+					Retries:          *queryRetries,
+					MaxFailedQueries: *maxFailedQueries,
+
+					Variant:    v.Name,
+					ReportFile: templateFilename(v.Filename(engineFilename(*reportFile, e, len(es))), qt, len(templates)),
+				})
+				exitOnError(err)
+
+				runs = append(runs, run)
+			}
+		}
+
+		if len(*sweeps) > 0 || len(templates) > 1 {
+			bench.PrintSweep(e.Name(), runs)
+		}
+	}
+}
+
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// engineFilename suffixes the given filename with the engine name when
+// running against several engines, e.g. results.jsonl -> results.elastic.jsonl
+func engineFilename(filename string, e engine.Engine, numberOfEngines int) string {
+	if numberOfEngines < 2 {
+		return filename
+	}
+	return bench.SuffixFilename(filename, e.Name())
+}
+
+// templateFilename suffixes the given filename with the name of the query
+// template when running several query templates, e.g. results.jsonl ->
+// results.cross_fields.jsonl
+func templateFilename(filename, queryTemplate string, numberOfTemplates int) string {
+	if numberOfTemplates < 2 || queryTemplate == "" {
+		return filename
 	}
+	name := strings.TrimSuffix(filepath.Base(queryTemplate), filepath.Ext(queryTemplate))
+	return bench.SuffixFilename(filename, name)
 }
@@ -0,0 +1,831 @@
+package bench
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anrid/search-bench/pkg/data"
+	"github.com/anrid/search-bench/pkg/engine"
+	"github.com/anrid/search-bench/pkg/eval"
+	"github.com/anrid/search-bench/pkg/histogram"
+	"github.com/anrid/search-bench/pkg/item"
+	"github.com/anrid/search-bench/pkg/query"
+	"github.com/anrid/search-bench/pkg/report"
+	"github.com/anrid/search-bench/pkg/results"
+	"github.com/ikawaha/kagome/v2/tokenizer"
+)
+
+const (
+	DebugPrint = false
+)
+
+type RunIndexerArgs struct {
+	DataDir        string
+	FilenameFilter string
+	UseItemsNoDesc bool
+	BatchSize      int
+	Max            int
+	ReportFile     string // Write a JSON or CSV report to this file, if set
+
+	IndexVars engine.IndexVars // Variables substituted into the engine's index template, including the analysis mode
+	Variant   string           // Name of the index settings variant when sweeping, for the report
+
+	BulkMaxBytes int           // Flush batches once they reach this (estimated) size in bytes, before reaching `BatchSize` items
+	BulkMaxWait  time.Duration // Flush batches once the first item was added this long ago
+
+	MaxBadRecords    int // Skip up to this many malformed rows in the data files (negative = no limit)
+	MaxFailedBatches int // Skip up to this many failed bulk requests (negative = no limit)
+
+	DeadLetterFile string // Write documents that failed to index to this file (JSON lines), if set
+
+	TokenizeWorkers int // Number of workers tokenizing batches in parallel (default: 1)
+	BulkWorkers     int // Number of concurrent bulk requests (default: 1)
+}
+
+// RunIndexer imports all items into a freshly created index, reading,
+// tokenizing and bulk indexing batches in parallel. Malformed rows
+// and failed bulk requests are skipped and counted in the report, until their
+// error budgets are exceeded. The report is returned (and written) even if
+// indexing fails part way.
+func RunIndexer(e engine.Engine, a RunIndexerArgs) (*report.Report, error) {
+	fmt.Printf("Running indexer: max %d items ..\n", a.Max)
+
+	index := engine.ItemsIndexName
+	if a.UseItemsNoDesc {
+		index = engine.ItemsNoDescIndexName
+	}
+
+	analysis := a.IndexVars.Analysis()
+	if !engine.SupportsAnalysis(e, analysis) {
+		return nil, fmt.Errorf("%s doesn't support analysis mode %s", e.Name(), analysis)
+	}
+	tokenize := engine.TokenizedByClient(analysis)
+
+	errs := new(report.Errors)
+	var retries, rejections int
+	var mu sync.Mutex // Protects the above, as batches are indexed concurrently
+
+	var deadLetters *deadLetterFile
+	if a.DeadLetterFile != "" {
+		var err error
+		deadLetters, err = openDeadLetterFile(a.DeadLetterFile)
+		if err != nil {
+			return nil, err
+		}
+		defer deadLetters.Close()
+	}
+
+	bulkIndex := func(b *engine.Batch) error {
+		res, err := e.BulkIndex(b)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if err == nil {
+			retries += res.Retries
+			rejections += res.Rejections
+			if len(res.Failures) == 0 {
+				return nil
+			}
+
+			errs.FailedDocs += len(res.Failures)
+			fmt.Printf("WARNING: failed to index %d of %d items, e.g. %s: %s\n",
+				len(res.Failures), b.Len(), res.Failures[0].ID, res.Failures[0].Reason)
+
+			if deadLetters != nil {
+				return deadLetters.write(res.Failures)
+			}
+			return nil
+		}
+
+		errs.FailedBatches++
+		errs.FailedItems += b.Len()
+		fmt.Printf("WARNING: failed to bulk index %d items: %s\n", b.Len(), err)
+
+		if a.MaxFailedBatches >= 0 && errs.FailedBatches > a.MaxFailedBatches {
+			return fmt.Errorf("more than %d bulk requests failed: %w", a.MaxFailedBatches, err)
+		}
+		return nil
+	}
+
+	version, err := e.Version()
+	if err != nil {
+		return nil, err
+	}
+	if err := e.CreateIndex(index, a.IndexVars); err != nil {
+		return nil, err
+	}
+
+	var tok *tokenizer.Tokenizer
+	if tokenize {
+		// Load the dictionary up front, so that it doesn't count as time spent tokenizing
+		tok, err = data.KagomeV2Tokenizer()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		fmt.Printf("Sending raw text, analyzed by %s (analysis mode: %s)\n", e.Name(), analysis)
+	}
+
+	pipeline := StartIndexPipeline(IndexPipelineArgs{
+		TokenizeWorkers: a.TokenizeWorkers,
+		BulkWorkers:     a.BulkWorkers,
+		Tokenize: func(b *engine.Batch) {
+			if tokenize {
+				TokenizeItems(tok, b.Items)
+				TokenizeItemsNoDesc(tok, b.ItemsNoDesc)
+			}
+		},
+		BulkIndex: bulkIndex,
+	})
+
+	var batcher item.Batcher
+	if a.UseItemsNoDesc {
+		batcher = &item.ItemsNoDescBatch{
+			Size:     a.BatchSize,
+			MaxBytes: a.BulkMaxBytes,
+			MaxWait:  a.BulkMaxWait,
+			ForEachBatch: func(itemsTotal int, items []*item.ItemNoDesc) error {
+				return pipeline.Add(&engine.Batch{Index: index, ItemsNoDesc: items})
+			},
+		}
+	} else {
+		batcher = &item.ItemsBatch{
+			Size:     a.BatchSize,
+			MaxBytes: a.BulkMaxBytes,
+			MaxWait:  a.BulkMaxWait,
+			ForEachBatch: func(itemsTotal int, items []*item.Item) error {
+				return pipeline.Add(&engine.Batch{Index: index, Items: items})
+			},
+		}
+	}
+
+	rep := &report.Report{
+		Mode:          report.ModeIndex,
+		Engine:        e.Name(),
+		EngineVersion: version,
+		Index:         index,
+		StartedAt:     time.Now(),
+		Params: map[string]interface{}{
+			"data_dir":         a.DataDir,
+			"filename_filter":  a.FilenameFilter,
+			"items_no_desc":    a.UseItemsNoDesc,
+			"batch_size":       a.BatchSize,
+			"bulk_max_bytes":   a.BulkMaxBytes,
+			"bulk_max_wait":    a.BulkMaxWait.String(),
+			"max":              a.Max,
+			"tokenize_workers": max(a.TokenizeWorkers, 1),
+			"bulk_workers":     max(a.BulkWorkers, 1),
+			"index_vars":       a.IndexVars,
+			"analysis":         analysis,
+		},
+		Errors: errs,
+	}
+	if a.Variant != "" {
+		rep.Params["variant"] = a.Variant
+	}
+
+	start := time.Now()
+
+	importStats, err := item.Import(item.ImportArgs{
+		DataDir:          a.DataDir,
+		FilenameFilter:   a.FilenameFilter,
+		Batcher:          batcher,
+		MaxItemsToImport: a.Max,
+		MaxBadRecords:    a.MaxBadRecords,
+	})
+	errs.SkippedRows = importStats.Skipped
+	errs.SkipReasons = importStats.SkipReasons
+
+	// Wait for all queued batches to be indexed, a failed bulk request may
+	// only surface after the import has finished
+	if pipelineErr := pipeline.Close(); err == nil {
+		err = pipelineErr
+	}
+
+	// Failing to refresh or to get stats and settings leaves gaps in the
+	// report, but shouldn't lose it
+	if refreshErr := e.Refresh(index); refreshErr != nil {
+		engineError(errs, refreshErr)
+	}
+	took := time.Since(start)
+
+	var docs int64
+	stats, statsErr := e.Stats(index)
+	if statsErr != nil {
+		engineError(errs, statsErr)
+	} else {
+		docs = stats.DocsCount
+		fmt.Printf("Index stats (after):\n%s\n", data.ToPrettyJSON(stats))
+	}
+	fmt.Printf("Finished indexing %d items in %s\n", docs, took)
+	pipeline.Print()
+	fmt.Printf("Batches flushed by reason: %v\n", batcher.Flushes())
+	fmt.Printf("Bulk requests retried %d times (%d rejected documents)\n", retries, rejections)
+	if deadLetters != nil && deadLetters.Count > 0 {
+		fmt.Printf("Wrote %d failed documents to dead letter file: %s\n", deadLetters.Count, a.DeadLetterFile)
+	}
+	printErrors(errs)
+
+	settings, settingsErr := e.Settings(index)
+	if settingsErr != nil {
+		engineError(errs, settingsErr)
+	}
+	rep.IndexSettings = settings
+	rep.ItemCount = docs
+	rep.StatsAfter = stats
+	phase := &report.Phase{
+		Name:       "indexing",
+		RunsMs:     []float64{report.Ms(took)},
+		AverageMs:  report.Ms(took),
+		Count:      docs,
+		Throughput: float64(docs) / took.Seconds(),
+		Errors:     int64(errs.FailedBatches),
+		Extra: map[string]interface{}{
+			"bulk.retries":     retries,
+			"bulk.rejections":  rejections,
+			"bulk.failed_docs": errs.FailedDocs,
+		},
+	}
+	for reason, n := range batcher.Flushes() {
+		phase.Extra["batches.flushed_by_"+reason] = n
+	}
+	for _, st := range pipeline.Stages() {
+		phase.Extra["pipeline."+st.Name+".workers"] = st.Workers
+		phase.Extra["pipeline."+st.Name+".busy_ms"] = report.Ms(st.Busy)
+		phase.Extra["pipeline."+st.Name+".docs_per_sec"] = st.Throughput()
+	}
+	rep.Phases = append(rep.Phases, phase)
+
+	return rep, writeReport(rep, a.ReportFile, err)
+}
+
+// writeReport writes the report to the given file (if any) and returns the
+// error that ended the run (if any), so that partial results aren't lost when
+// a run fails.
+func writeReport(rep *report.Report, filename string, runErr error) error {
+	if filename == "" {
+		return runErr
+	}
+	err := rep.Write(filename)
+	if err != nil {
+		if runErr != nil {
+			fmt.Printf("WARNING: could not write report: %s\n", err)
+			return runErr
+		}
+		return err
+	}
+	return runErr
+}
+
+// engineError records a failed engine call made after a run, e.g. getting
+// index stats, which leaves a gap in the report rather than failing the run.
+func engineError(errs *report.Errors, err error) {
+	fmt.Printf("WARNING: %s\n", err)
+	errs.EngineErrors = append(errs.EngineErrors, err.Error())
+}
+
+func printErrors(errs *report.Errors) {
+	fmt.Printf(
+		"Errors: %d skipped rows, %d failed batches (%d items), %d failed documents, %d skipped queries, %d failed queries, %d failed requests (%d retries)\n",
+		errs.SkippedRows, errs.FailedBatches, errs.FailedItems, errs.FailedDocs, errs.SkippedQueries,
+		errs.FailedQueries, errs.FailedRequests, errs.Retries,
+	)
+}
+
+// TokenizeItems tokenizes Japanese text in item names and descriptions with
+// Kagome, replacing them with whitespace separated tokens.
+func TokenizeItems(tok *tokenizer.Tokenizer, items []*item.Item) {
+	for _, i := range items {
+		name := tok.Wakati(i.Name)
+		i.Name = strings.Join(name, " ")
+
+		desc := tok.Wakati(i.Desc)
+		i.Desc = strings.Join(desc, " ")
+	}
+}
+
+func TokenizeItemsNoDesc(tok *tokenizer.Tokenizer, items []*item.ItemNoDesc) {
+	for _, i := range items {
+		name := tok.Wakati(i.Name)
+		i.Name = strings.Join(name, " ")
+	}
+}
+
+type RunBenchmarkArgs struct {
+	NumberOfRuns   int            // Number of times to execute the given queries, then calculate the average run time
+	QueriesFile    string         // Read one query at a time in every run (see `query.Open`), unless replaying by count
+	Filters        *query.Filters // Set on every query, if set
+	FetchSource    bool           // Fetch full item source and print a preview
+	UseItemsNoDesc bool           // Query the items_no_desc index (name only) rather than the items index
+
+	ResultsFile string // Write all query results to a file, maintaining the sort order (e.g. Bestmatch)
+	// If `FetchSource` = true  : Store complete items in results file (gzip compressed)
+	//                  = false : Store only item IDs and scores in results file
+
+	ChangeLogFile      string // Replay this change log while running the benchmark a second time
+	ChangeLogRate      int    // Max number of change log entries to apply per second
+	ChangeLogBatchSize int    // Number of change log entries to apply per bulk request
+
+	Concurrency int     // Number of workers executing queries in parallel
+	QPS         float64 // Target queries per second (open loop), if set
+
+	// Replay queries in proportion to how often they were searched, rather
+	// than each once. This loads all queries in memory.
+	Replay query.ReplayArgs
+
+	Paging   string // How to fetch the pages following the first page, one of the `engine.Paging*` strategies
+	Analysis string // Analysis mode of the index, one of the `engine.Analysis*` modes (default: `engine.AnalysisKagome`)
+
+	QueryTemplate string // Query shape to use instead of the engine's built-in one (a built-in template or a template file), if set
+	PageSize      int    // Number of results per page (default: 120)
+	FetchMax      int    // Fetch up to this many results per query (default: 240)
+
+	Judgments eval.Judgments // Score the results of the first run against these judgments, if set
+	EvalK     []int          // Cutoffs for nDCG@k and P@k
+
+	Retries          int // Retry a failed request this many times before failing the query
+	MaxFailedQueries int // Give up after this many failed queries per run (negative = no limit)
+
+	Variant    string // Name of the index settings variant when sweeping, for the report
+	ReportFile string // Write a JSON or CSV report to this file, if set
+}
+
+// RunBenchmark executes all queries `NumberOfRuns` times, then once more
+// while replaying a change log if one is given. The report is returned (and
+// written) even if the benchmark fails part way.
+func RunBenchmark(e engine.Engine, a RunBenchmarkArgs) (*report.Report, error) {
+	if a.Paging == "" {
+		a.Paging = engine.PagingFromSize
+	}
+	if a.PageSize == 0 {
+		a.PageSize = 120
+	}
+	if a.Analysis == "" {
+		a.Analysis = engine.AnalysisKagome
+	}
+	if a.FetchMax == 0 {
+		a.FetchMax = 240
+	}
+
+	index := engine.ItemsIndexName
+	if a.UseItemsNoDesc {
+		index = engine.ItemsNoDescIndexName
+	} else if a.Filters != nil && a.Filters.NeedsItemsNoDesc() {
+		return nil, query.ErrNeedsItemsNoDesc
+	}
+	if a.UseItemsNoDesc && a.ChangeLogFile != "" {
+		return nil, fmt.Errorf("replaying a change log is only supported for the %s index", engine.ItemsIndexName)
+	}
+
+	// Replaying by count needs all queries in memory, otherwise queries are
+	// read from the queries file as they're executed
+	var stream []*query.SearchQuery
+	var loadStats *query.LoadStats
+	var uniqueQueries int
+	if a.Replay.ByCount() {
+		qs, stats, err := loadQueries(a)
+		if err != nil {
+			return nil, err
+		}
+		stream, err = query.Replay(qs, a.Replay)
+		if err != nil {
+			return nil, err
+		}
+		loadStats, uniqueQueries = stats, len(qs)
+		fmt.Printf("Replaying %d queries (%s) drawn from %d unique queries\n", len(stream), a.Replay.Mode, uniqueQueries)
+		if a.Judgments != nil {
+			a.Judgments = replayJudgments(stream, a.Judgments)
+		}
+		fmt.Printf("Running benchmark: %d queries x %d runs against index %s ..\n", len(stream), a.NumberOfRuns, index)
+	} else {
+		fmt.Printf("Running benchmark: queries from %s x %d runs against index %s ..\n", a.QueriesFile, a.NumberOfRuns, index)
+	}
+	fmt.Printf("Fetching up to %d results per query, %d per page (paging: %s)\n", a.FetchMax, a.PageSize, a.Paging)
+	if a.QueryTemplate != "" {
+		fmt.Printf("Using query template: %s\n", a.QueryTemplate)
+	}
+	if a.Concurrency > 1 || a.QPS > 0 {
+		fmt.Printf("Using %d workers (target QPS: %.1f)\n", max(a.Concurrency, 1), a.QPS)
+	}
+
+	version, err := e.Version()
+	if err != nil {
+		return nil, err
+	}
+	settings, err := e.Settings(index)
+	if err != nil {
+		return nil, err
+	}
+	statsBefore, err := e.Stats(index)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Index stats (before):\n%s\n", data.ToPrettyJSON(statsBefore))
+
+	rep := &report.Report{
+		Mode:          report.ModeBenchmark,
+		Engine:        e.Name(),
+		EngineVersion: version,
+		Index:         index,
+		IndexSettings: settings,
+		StartedAt:     time.Now(),
+		Params: map[string]interface{}{
+			"runs":          a.NumberOfRuns,
+			"fetch_source":  a.FetchSource,
+			"items_no_desc": a.UseItemsNoDesc,
+			"concurrency":   max(a.Concurrency, 1),
+			"qps":           a.QPS,
+			"paging":        a.Paging,
+			"page_size":     a.PageSize,
+			"fetch_max":     a.FetchMax,
+			"analysis":      a.Analysis,
+		},
+		ItemCount:   statsBefore.DocsCount,
+		StatsBefore: statsBefore,
+		Errors:      &report.Errors{},
+	}
+	if a.Variant != "" {
+		rep.Params["variant"] = a.Variant
+	}
+	if a.QueryTemplate != "" {
+		rep.Params["query_template"] = a.QueryTemplate
+	}
+	if a.Replay.ByCount() {
+		rep.Params["replay"] = a.Replay.Mode
+		rep.Params["unique_queries"] = uniqueQueries
+		if a.Replay.Mode == query.ReplaySample {
+			rep.Params["replay_seed"] = a.Replay.Seed
+		}
+	}
+
+	var resultsFile *results.Writer
+	if a.ResultsFile != "" {
+		if a.FetchSource && !strings.HasSuffix(a.ResultsFile, ".gz") {
+			a.ResultsFile += ".gz"
+			fmt.Printf("Writing results with item sources to %s (gzip compressed)\n", a.ResultsFile)
+		}
+		resultsFile, err = results.Create(a.ResultsFile)
+		if err != nil {
+			return rep, err
+		}
+	}
+
+	var collected *eval.Results
+	if a.Judgments != nil {
+		collected = eval.NewResults()
+	}
+
+	res, err := runQueries(e, a, index, stream, resultsFile, collected)
+	res.Print("")
+	rep.Params["queries"] = res.Queries
+	if loadStats == nil {
+		loadStats = res.LoadStats
+	}
+	if loadStats != nil {
+		rep.Errors.SkippedQueries = loadStats.Skipped
+		rep.Errors.SkippedQueryReasons = loadStats.SkipReasons
+	}
+	phase := res.Phase("queries")
+	rep.Phases = append(rep.Phases, phase)
+
+	if a.Judgments != nil {
+		ev := eval.Evaluate(a.Judgments, collected.List(), a.EvalK)
+		ev.Print()
+		phase.Extra = evalExtra(ev)
+	}
+	addQueryErrors(rep.Errors, res.Stats)
+	if err != nil {
+		return rep, writeReport(rep, a.ReportFile, err)
+	}
+
+	if a.ChangeLogFile != "" {
+		fmt.Printf("Running benchmark with write load: %d queries x %d runs ..\n", res.Queries, a.NumberOfRuns)
+
+		replay := StartChangeLogReplay(e, ReplayChangeLogArgs{
+			ChangeLogFile: a.ChangeLogFile,
+			Index:         engine.ItemsIndexName,
+			Rate:          a.ChangeLogRate,
+			BatchSize:     a.ChangeLogBatchSize,
+			Analysis:      a.Analysis,
+		})
+
+		resWithLoad, err := runQueries(e, a, index, stream, nil, nil)
+
+		replayStats, replayErr := replay.Stop()
+		if err == nil {
+			err = replayErr
+		}
+
+		fmt.Printf("Change log replay stats:\n%s\n", data.ToPrettyJSON(replayStats))
+		fmt.Printf("Applied %.1f change log entries per second\n", replayStats.Rate())
+		resWithLoad.Print(" with write load")
+		fmt.Printf(
+			"Average time without write load %s vs with write load %s (%+.2f%%)\n",
+			res.Average, resWithLoad.Average, (float64(resWithLoad.Average)/float64(res.Average)-1)*100,
+		)
+
+		phase := resWithLoad.Phase("queries_with_write_load")
+		phase.Extra = map[string]interface{}{
+			"change_log.updates":    replayStats.Updates,
+			"change_log.inserts":    replayStats.Inserts,
+			"change_log.skipped":    replayStats.Skipped,
+			"change_log.failed":     replayStats.Failed,
+			"change_log.batches":    replayStats.Batches,
+			"change_log.retries":    replayStats.Retries,
+			"change_log.rejected":   replayStats.Rejected,
+			"change_log.per_second": replayStats.Rate(),
+		}
+		rep.Phases = append(rep.Phases, phase)
+		rep.Params["change_log_file"] = a.ChangeLogFile
+		rep.Params["change_log_rate"] = a.ChangeLogRate
+		rep.Params["change_log_batch_size"] = a.ChangeLogBatchSize
+		addQueryErrors(rep.Errors, resWithLoad.Stats)
+		if err != nil {
+			return rep, writeReport(rep, a.ReportFile, err)
+		}
+	}
+
+	statsAfter, err := e.Stats(index)
+	if err != nil {
+		engineError(rep.Errors, err)
+	} else {
+		fmt.Printf("Index stats (after):\n%s\n", data.ToPrettyJSON(statsAfter))
+	}
+	printErrors(rep.Errors)
+
+	rep.StatsAfter = statsAfter
+
+	return rep, writeReport(rep, a.ReportFile, nil)
+}
+
+// evalExtra flattens an evaluation into report metrics, e.g.
+// `eval.bestmatch.ndcg@10`.
+func evalExtra(ev *eval.Evaluation) map[string]interface{} {
+	extra := map[string]interface{}{
+		"eval.judged":      ev.Judged,
+		"eval.unjudged":    ev.Unjudged,
+		"eval.no_relevant": ev.NoRelevant,
+		"eval.no_results":  ev.NoResults,
+		"eval.missing":     ev.Missing,
+	}
+	for g, s := range ev.Groups {
+		extra["eval."+g+".queries"] = s.Queries
+		for _, name := range ev.MetricNames() {
+			extra["eval."+g+"."+name] = s.Metrics[name]
+		}
+	}
+	return extra
+}
+
+func addQueryErrors(errs *report.Errors, s *QueryStats) {
+	errs.FailedQueries += s.Errors
+	errs.FailedRequests += s.FailedRequests
+	errs.Retries += s.Retries
+}
+
+// RunResult holds the results of executing all queries `NumberOfRuns` times.
+type RunResult struct {
+	Queries   int              // Executed per run
+	LoadStats *query.LoadStats // Queries read from the queries file in the first run, nil when replaying by count
+	Runs      []time.Duration
+	Average   time.Duration
+	Latencies *Latencies
+	Stats     *QueryStats // Totals across all runs
+}
+
+func (r *RunResult) Print(suffix string) {
+	r.Latencies.Print("Latency per request" + suffix)
+
+	sum := r.Stats.QueryLatency.Summary()
+	fmt.Printf(
+		"Latency per query%s: p50 %s  p90 %s  p99 %s  p99.9 %s  max %s\n",
+		suffix, sum.P50, sum.P90, sum.P99, sum.P999, sum.Max,
+	)
+	fmt.Printf(
+		"Throughput%s: %.1f queries/sec (%.1f requests/sec), %d failed queries, %d retries\n",
+		suffix, r.Stats.Throughput(), r.Stats.RequestThroughput(), r.Stats.Errors, r.Stats.Retries,
+	)
+	fmt.Printf(
+		"Executed %d queries x %d runs%s. Average time %s (%s per query)\n",
+		r.Queries, len(r.Runs), suffix, r.Average, perQuery(r.Average, r.Queries),
+	)
+}
+
+// Phase converts the results into a report phase.
+func (r *RunResult) Phase(name string) *report.Phase {
+	p := &report.Phase{
+		Name:       name,
+		AverageMs:  report.Ms(r.Average),
+		Count:      int64(r.Queries),
+		Requests:   r.Stats.Requests,
+		Errors:     r.Stats.Errors,
+		Throughput: r.Stats.Throughput(),
+	}
+	for _, d := range r.Runs {
+		p.RunsMs = append(p.RunsMs, report.Ms(d))
+	}
+	for _, s := range r.Latencies.Series() {
+		p.Latencies = append(p.Latencies,
+			latencyRow(s.Shape, s.Page, "client", s.Client),
+			latencyRow(s.Shape, s.Page, "took", s.Took),
+		)
+	}
+	p.Latencies = append(p.Latencies, latencyRow(ShapeAll, PageAll, "query", r.Stats.QueryLatency))
+
+	return p
+}
+
+func latencyRow(shape, page, measure string, h *histogram.Histogram) *report.Latency {
+	sum := h.Summary()
+	return &report.Latency{
+		Shape:   shape,
+		Page:    page,
+		Measure: measure,
+		Count:   sum.Count,
+		MeanMs:  report.Ms(sum.Mean),
+		P50Ms:   report.Ms(sum.P50),
+		P90Ms:   report.Ms(sum.P90),
+		P99Ms:   report.Ms(sum.P99),
+		P999Ms:  report.Ms(sum.P999),
+		MaxMs:   report.Ms(sum.Max),
+	}
+}
+
+// runQueries executes all queries `NumberOfRuns` times, reading the queries
+// file again in every run unless `stream` (replayed by count) is set. Results
+// are written to the given results file (if any) and collected (if set)
+// during the first run only, after which the file is closed. On error, the
+// results of the runs so far are returned.
+func runQueries(e engine.Engine, a RunBenchmarkArgs, index string, stream []*query.SearchQuery, resultsFile *results.Writer, collect *eval.Results) (*RunResult, error) {
+	res := &RunResult{
+		Latencies: NewLatencies(),
+		Stats:     NewQueryStats(),
+	}
+
+	var totalDuration time.Duration
+
+	for run := 0; run < a.NumberOfRuns; run++ {
+		qs, err := openQueries(a, stream)
+		if err != nil {
+			return res, fmt.Errorf("run %d failed: %w", run+1, err)
+		}
+
+		// A nil *results.Writer would be a non-nil io.Writer
+		var writeResultsTo io.Writer
+		if resultsFile != nil {
+			writeResultsTo = resultsFile
+		}
+
+		runStart := time.Now()
+
+		stats, err := ExecuteQueries(e, ExecuteQueriesArgs{
+			Index:            index,
+			Queries:          qs,
+			FetchSource:      a.FetchSource,
+			FetchMax:         a.FetchMax,
+			PageSize:         a.PageSize,
+			Paging:           a.Paging,
+			Analysis:         a.Analysis,
+			QueryTemplate:    a.QueryTemplate,
+			NumberByPosition: a.Replay.ByCount(),
+			WriteResultsTo:   writeResultsTo,
+			CollectResults:   collect,
+			Latencies:        res.Latencies,
+			Concurrency:      a.Concurrency,
+			QPS:              a.QPS,
+			Retries:          a.Retries,
+			MaxFailedQueries: a.MaxFailedQueries,
+		})
+
+		runDuration := time.Since(runStart)
+		totalDuration += runDuration
+		res.Runs = append(res.Runs, runDuration)
+		res.Stats.Merge(stats)
+		qs.Close()
+
+		if run == 0 {
+			res.Queries = int(stats.Queries)
+			if qs.reader != nil {
+				qs.reader.PrintStats()
+				res.LoadStats = qs.reader.Stats
+			}
+		}
+
+		// Store results from first run only!
+		if run == 0 && resultsFile != nil {
+			if closeErr := resultsFile.Close(); closeErr != nil && err == nil {
+				err = fmt.Errorf("could not write results: %w", closeErr)
+			}
+			resultsFile = nil
+		}
+		collect = nil
+
+		if err != nil {
+			res.Average = totalDuration / time.Duration(len(res.Runs))
+			return res, fmt.Errorf("run %d failed: %w", run+1, err)
+		}
+	}
+
+	res.Average = totalDuration / time.Duration(a.NumberOfRuns)
+
+	return res, nil
+}
+
+// runQuerySource yields the queries of a single run, with the filters of the
+// benchmark set.
+type runQuerySource struct {
+	query.Source
+	reader  *query.Reader // Reading the queries file, nil when replaying by count
+	filters *query.Filters
+}
+
+// openQueries returns the queries of a single run: the replayed stream if
+// set, otherwise the queries file, read one query at a time.
+func openQueries(a RunBenchmarkArgs, stream []*query.SearchQuery) (*runQuerySource, error) {
+	qs := &runQuerySource{filters: a.Filters}
+	if a.Replay.ByCount() {
+		qs.Source = query.SliceSource(stream)
+		return qs, nil
+	}
+
+	r, err := openQueriesFile(a)
+	if err != nil {
+		return nil, err
+	}
+	qs.Source, qs.reader = r, r
+	return qs, nil
+}
+
+// openQueriesFile opens the queries file, skipping queries that can't be
+// run against the benchmarked index.
+func openQueriesFile(a RunBenchmarkArgs) (*query.Reader, error) {
+	r, err := query.Open(a.QueriesFile)
+	if err != nil {
+		return nil, err
+	}
+	r.SkipNeedsItemsNoDesc = !a.UseItemsNoDesc
+	return r, nil
+}
+
+// loadQueries loads all queries in the queries file, see `openQueriesFile`.
+func loadQueries(a RunBenchmarkArgs) ([]*query.SearchQuery, *query.LoadStats, error) {
+	fmt.Printf("Loading queries from %s ..\n", a.QueriesFile)
+
+	r, err := openQueriesFile(a)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+
+	qs, err := r.ReadAll()
+	if err != nil {
+		return nil, r.Stats, err
+	}
+	r.PrintStats()
+
+	return qs, r.Stats, nil
+}
+
+func (qs *runQuerySource) Next() (*query.SearchQuery, error) {
+	q, err := qs.Source.Next()
+	if err != nil {
+		return nil, err
+	}
+	if qs.filters != nil {
+		// Replayed streams repeat the same queries, which may be in flight
+		c := *q
+		qs.filters.Apply(&c)
+		q = &c
+	}
+	return q, nil
+}
+
+func (qs *runQuerySource) Close() {
+	if qs.reader != nil {
+		qs.reader.Close()
+	}
+}
+
+// replayJudgments returns the judgments keyed by the position of each query
+// in the replayed stream rather than in the queries file, so that results are
+// scored in proportion to how often each query was searched.
+func replayJudgments(stream []*query.SearchQuery, j eval.Judgments) eval.Judgments {
+	replayed := make(eval.Judgments)
+	for i, q := range stream {
+		if grades, found := j[q.Number]; found {
+			replayed[i+1] = grades
+		}
+	}
+	return replayed
+}
+
+func perQuery(d time.Duration, queries int) time.Duration {
+	if queries == 0 {
+		return 0
+	}
+	return d / time.Duration(queries)
+}
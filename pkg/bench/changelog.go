@@ -0,0 +1,175 @@
+package bench
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/anrid/search-bench/pkg/data"
+	"github.com/anrid/search-bench/pkg/engine"
+	"github.com/anrid/search-bench/pkg/item"
+	"github.com/ikawaha/kagome/v2/tokenizer"
+)
+
+var errReplayStopped = errors.New("change log replay stopped")
+
+type ReplayChangeLogArgs struct {
+	ChangeLogFile string
+	Index         string
+	Rate          int    // Max number of change log entries to apply per second
+	BatchSize     int    // Number of change log entries to apply per bulk request
+	Analysis      string // Inserts are tokenized with Kagome in `engine.AnalysisKagome` mode (default)
+}
+
+type ReplayStats struct {
+	Updates  int           `json:"updates"`
+	Inserts  int           `json:"inserts"`
+	Skipped  int           `json:"skipped"` // Empty updates
+	Failed   int           `json:"failed"`
+	Batches  int           `json:"batches"`
+	Retries  int           `json:"retries"`  // Bulk requests retried to resend rejected entries
+	Rejected int           `json:"rejected"` // Entries rejected by the engine, then retried
+	Duration time.Duration `json:"duration"`
+}
+
+// Rate returns the number of change log entries applied per second.
+func (s *ReplayStats) Rate() float64 {
+	if s.Duration == 0 {
+		return 0
+	}
+	return float64(s.Updates+s.Inserts) / s.Duration.Seconds()
+}
+
+// ChangeLogReplay applies a change log to an index in the background, e.g.
+// while running the query benchmark.
+type ChangeLogReplay struct {
+	stop  chan struct{}
+	done  chan struct{}
+	stats ReplayStats
+	err   error
+}
+
+// StartChangeLogReplay starts streaming entries from the given change log
+// file as bulk updates and inserts, at no more than `Rate` entries per second.
+// The replay runs until the change log is exhausted or `Stop` is called.
+func StartChangeLogReplay(e engine.Engine, a ReplayChangeLogArgs) *ChangeLogReplay {
+	if a.BatchSize <= 0 {
+		a.BatchSize = 100
+	}
+	if a.Rate <= 0 {
+		a.Rate = 1000
+	}
+	if a.Index == "" {
+		a.Index = engine.ItemsIndexName
+	}
+
+	r := &ChangeLogReplay{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	go r.run(e, a)
+
+	return r
+}
+
+func (r *ChangeLogReplay) run(e engine.Engine, a ReplayChangeLogArgs) {
+	defer close(r.done)
+
+	var tok *tokenizer.Tokenizer
+	if engine.TokenizedByClient(a.Analysis) {
+		var err error
+		if tok, err = data.KagomeV2Tokenizer(); err != nil {
+			r.err = err
+			return
+		}
+	}
+
+	start := time.Now()
+	interval := time.Duration(float64(time.Second) * float64(a.BatchSize) / float64(a.Rate))
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	fmt.Printf(
+		"Replaying change log %s: %d entries per batch, max %d entries per second\n",
+		a.ChangeLogFile, a.BatchSize, a.Rate,
+	)
+
+	var batch []*item.ChangeLogEntry
+
+	apply := func() {
+		for _, cl := range batch {
+			if cl.Insert != nil && tok != nil {
+				TokenizeItems(tok, []*item.Item{cl.Insert})
+			}
+		}
+
+		res, err := e.BulkIndex(&engine.Batch{Index: a.Index, Changes: batch})
+		if err != nil {
+			fmt.Printf("WARNING: failed to apply %d change log entries: %s\n", len(batch), err)
+			r.stats.Failed += len(batch)
+		} else {
+			failed := make(map[string]bool)
+			for _, f := range res.Failures {
+				failed[f.ID] = true
+			}
+			for _, cl := range batch {
+				switch {
+				case failed[cl.ItemID]:
+					r.stats.Failed++
+				case cl.Insert != nil:
+					r.stats.Inserts++
+				default:
+					r.stats.Updates++
+				}
+			}
+			r.stats.Retries += res.Retries
+			r.stats.Rejected += res.Rejections
+		}
+		r.stats.Batches++
+		batch = nil
+	}
+
+	err := item.ReadChangeLog(a.ChangeLogFile, func(cl *item.ChangeLogEntry) error {
+		if cl.Insert == nil && !cl.HasUpdate() {
+			r.stats.Skipped++
+			return nil
+		}
+
+		batch = append(batch, cl)
+		if len(batch) < a.BatchSize {
+			return nil
+		}
+
+		select {
+		case <-r.stop:
+			return errReplayStopped
+		case <-ticker.C:
+		}
+
+		apply()
+		return nil
+	})
+
+	if err == nil && len(batch) > 0 {
+		apply()
+	}
+	if err == nil {
+		fmt.Printf("Change log %s exhausted after %s\n", a.ChangeLogFile, time.Since(start))
+	} else if err != errReplayStopped {
+		r.err = err
+	}
+
+	r.stats.Duration = time.Since(start)
+}
+
+// Stop stops the replay and waits for any in-flight bulk request to finish.
+func (r *ChangeLogReplay) Stop() (*ReplayStats, error) {
+	select {
+	case <-r.done:
+	default:
+		close(r.stop)
+		<-r.done
+	}
+	return &r.stats, r.err
+}
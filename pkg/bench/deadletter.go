@@ -0,0 +1,42 @@
+package bench
+
+import (
+	"os"
+
+	"github.com/anrid/search-bench/pkg/data"
+	"github.com/anrid/search-bench/pkg/engine"
+)
+
+// deadLetterFile writes documents that failed to index permanently to a JSON
+// lines file, so that they can be inspected (or reindexed) later.
+type deadLetterFile struct {
+	f     *os.File
+	Count int
+}
+
+func openDeadLetterFile(filename string) (*deadLetterFile, error) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0777)
+	if err != nil {
+		return nil, err
+	}
+	return &deadLetterFile{f: f}, nil
+}
+
+func (d *deadLetterFile) write(failures []*engine.BulkFailure) error {
+	for _, f := range failures {
+		b, err := data.ToJSON(f)
+		if err != nil {
+			return err
+		}
+		_, err = d.f.Write(append(b, '\n'))
+		if err != nil {
+			return err
+		}
+		d.Count++
+	}
+	return nil
+}
+
+func (d *deadLetterFile) Close() error {
+	return d.f.Close()
+}
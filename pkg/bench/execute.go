@@ -0,0 +1,477 @@
+package bench
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/anrid/search-bench/pkg/data"
+	"github.com/anrid/search-bench/pkg/engine"
+	"github.com/anrid/search-bench/pkg/eval"
+	"github.com/anrid/search-bench/pkg/histogram"
+	"github.com/anrid/search-bench/pkg/query"
+	"github.com/anrid/search-bench/pkg/results"
+)
+
+type ExecuteQueriesArgs struct {
+	Index          string       // Defaults to `engine.ItemsIndexName`
+	Queries        query.Source // Read one query at a time, as queries are dispatched
+	FetchSource    bool
+	FetchMax       int
+	PageSize       int
+	WriteResultsTo io.Writer     // Write a record with all pages of results of every query, if set
+	CollectResults *eval.Results // Collect the first page of results of every query, if set
+	Latencies      *Latencies    // Record the latency of every request, if set
+
+	Concurrency int     // Number of workers executing queries in parallel (default: 1)
+	QPS         float64 // Dispatch queries at this rate regardless of how fast they complete (open loop), if set
+
+	Paging   string // One of the `engine.Paging*` strategies (default: `engine.PagingFromSize`)
+	Analysis string // One of the `engine.Analysis*` modes (default: `engine.AnalysisKagome`)
+
+	QueryTemplate string // Query shape to use instead of the engine's built-in one, if set
+
+	// Number queries by their position in `Queries`, e.g. a replayed stream,
+	// rather than by their position in the queries file (`query.SearchQuery.Number`)
+	NumberByPosition bool
+
+	Retries          int // Retry a failed request this many times (with exponential backoff) before failing the query
+	MaxFailedQueries int // Stop executing queries once more than this many have failed (negative = no limit)
+}
+
+// QueryStats summarizes a single execution of all queries.
+type QueryStats struct {
+	Queries        int64
+	Requests       int64
+	Errors         int64 // Failed queries, i.e. queries with a request that failed even after retrying
+	FailedRequests int64
+	Retries        int64
+	Duration       time.Duration
+	// Time from when a query was due to be executed until all its pages were
+	// fetched. In QPS mode this includes time spent waiting for a free worker.
+	QueryLatency *histogram.Histogram
+}
+
+func NewQueryStats() *QueryStats {
+	return &QueryStats{QueryLatency: histogram.New()}
+}
+
+// Merge adds the stats of another execution to these stats.
+func (s *QueryStats) Merge(o *QueryStats) {
+	s.Queries += o.Queries
+	s.Requests += o.Requests
+	s.Errors += o.Errors
+	s.FailedRequests += o.FailedRequests
+	s.Retries += o.Retries
+	s.Duration += o.Duration
+	s.QueryLatency.Merge(o.QueryLatency)
+}
+
+// Throughput returns the number of queries executed per second.
+func (s *QueryStats) Throughput() float64 {
+	if s.Duration == 0 {
+		return 0
+	}
+	return float64(s.Queries) / s.Duration.Seconds()
+}
+
+func (s *QueryStats) RequestThroughput() float64 {
+	if s.Duration == 0 {
+		return 0
+	}
+	return float64(s.Requests) / s.Duration.Seconds()
+}
+
+// openLoopQueueSize is the number of queries queued for a free worker in open
+// loop mode before the dispatcher blocks.
+const openLoopQueueSize = 100_000
+
+type queryJob struct {
+	qc  int // Position in `Queries`, which orders the results file
+	qn  int // Query number in results
+	q   *query.SearchQuery
+	due time.Time
+}
+
+// queryResult is the outcome of executing all pages of a single query.
+type queryResult struct {
+	line           string // Record to write to the results file, if any
+	requests       int
+	failedRequests int
+	err            error
+}
+
+// ExecuteQueries executes all queries (fetching up to `FetchMax` results per
+// query) using a pool of `Concurrency` workers, reading the next query from
+// `Queries` when it's dispatched. By default the next query is
+// dispatched as soon as a worker is free (closed loop). When `QPS` is set,
+// queries are dispatched at a fixed rate instead (open loop) and their latency
+// is measured from when they were due, so that a backed up engine shows up as
+// growing latency rather than a lower dispatch rate.
+//
+// Failed requests are retried up to `Retries` times. Queries that still fail
+// are counted and skipped, until more than `MaxFailedQueries` have failed, at
+// which point the remaining queries are abandoned and an error is returned
+// along with the stats so far. Errors reading `Queries` end the run the same
+// way.
+func ExecuteQueries(e engine.Engine, a ExecuteQueriesArgs) (*QueryStats, error) {
+	if a.Index == "" {
+		a.Index = engine.ItemsIndexName
+	}
+	if a.PageSize == 0 {
+		a.PageSize = 120
+	}
+	if a.Concurrency <= 0 {
+		a.Concurrency = 1
+	}
+	if a.Paging == "" {
+		a.Paging = engine.PagingFromSize
+	}
+	if !engine.SupportsPaging(e, a.Paging) {
+		return NewQueryStats(), fmt.Errorf("%s doesn't support paging with %s", e.Name(), a.Paging)
+	}
+	if !engine.SupportsAnalysis(e, a.Analysis) {
+		return NewQueryStats(), fmt.Errorf("%s doesn't support analysis mode %s", e.Name(), a.Analysis)
+	}
+	if err := engine.LoadQueryTemplate(e, a.QueryTemplate); err != nil {
+		return NewQueryStats(), err
+	}
+
+	stats := NewQueryStats()
+	var executed, requests, failedRequests, retries, failed int64
+	var latencyMu sync.Mutex
+
+	var writer *resultsWriter
+	if a.WriteResultsTo != nil {
+		writer = newResultsWriter(a.WriteResultsTo)
+	}
+
+	// Rarely block the dispatcher in open loop mode. Queries are due at a
+	// fixed rate even if it does block, so latency still includes the time
+	// spent queued.
+	var jobs chan *queryJob
+	if a.QPS > 0 {
+		jobs = make(chan *queryJob, openLoopQueueSize)
+	} else {
+		jobs = make(chan *queryJob)
+	}
+
+	abort := make(chan struct{})
+	var abortOnce sync.Once
+	var abortErr error
+
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for w := 0; w < a.Concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				select {
+				case <-abort:
+					// Drain remaining jobs, marking them like failed queries so
+					// that results of queries after them are still written
+					if writer != nil {
+						writer.write(j.qc, "")
+					}
+					continue
+				default:
+				}
+
+				res := executeQuery(e, a, j.qc, j.qn, j.q)
+				took := time.Since(j.due)
+
+				atomic.AddInt64(&executed, 1)
+				atomic.AddInt64(&requests, int64(res.requests))
+				atomic.AddInt64(&failedRequests, int64(res.failedRequests))
+				if res.err != nil {
+					atomic.AddInt64(&retries, int64(res.failedRequests-1))
+					n := atomic.AddInt64(&failed, 1)
+					fmt.Printf("WARNING: query #%d failed: %s\n", j.qn, res.err)
+
+					if a.MaxFailedQueries >= 0 && n > int64(a.MaxFailedQueries) {
+						abortOnce.Do(func() {
+							abortErr = fmt.Errorf("more than %d queries failed: %w", a.MaxFailedQueries, res.err)
+							close(abort)
+						})
+					}
+				} else {
+					atomic.AddInt64(&retries, int64(res.failedRequests))
+				}
+
+				latencyMu.Lock()
+				stats.QueryLatency.Record(took)
+				latencyMu.Unlock()
+
+				if writer != nil {
+					writer.write(j.qc, res.line)
+				}
+			}
+		}()
+	}
+
+	var interval time.Duration
+	if a.QPS > 0 {
+		interval = time.Duration(float64(time.Second) / a.QPS)
+	}
+
+dispatch:
+	for i := 0; ; i++ {
+		q, err := a.Queries.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			abortOnce.Do(func() {
+				abortErr = err
+				close(abort)
+			})
+			break
+		}
+
+		due := time.Now()
+		if interval > 0 {
+			due = start.Add(time.Duration(i) * interval)
+			if wait := time.Until(due); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-abort:
+					break dispatch
+				}
+			}
+		}
+
+		qn := q.Number
+		if a.NumberByPosition || qn == 0 {
+			qn = i + 1
+		}
+
+		select {
+		case jobs <- &queryJob{qc: i + 1, qn: qn, q: q, due: due}:
+		case <-abort:
+			break dispatch
+		}
+	}
+	close(jobs)
+
+	wg.Wait()
+
+	stats.Duration = time.Since(start)
+	stats.Queries = executed
+	stats.Requests = requests
+	stats.Errors = failed
+	stats.FailedRequests = failedRequests
+	stats.Retries = retries
+
+	if abortErr != nil {
+		return stats, abortErr
+	}
+	if writer != nil && writer.err != nil {
+		return stats, fmt.Errorf("could not write results: %w", writer.err)
+	}
+
+	return stats, nil
+}
+
+// executeQuery fetches all pages of a single query, retrying failed requests.
+// `qc` counts executed queries and `qn` is the query number in results.
+func executeQuery(e engine.Engine, a ExecuteQueriesArgs, qc, qn int, q *query.SearchQuery) (res queryResult) {
+	var from int
+	var totalDocsFetched int
+
+	queryStart := time.Now()
+
+	// Keyword queries are sorted by score (bestmatch), unless they have an
+	// explicit sort order
+	rec := &results.Record{
+		Version:     results.Version,
+		QueryNumber: qn,
+		Bestmatch:   q.Bestmatch(),
+		Query:       q,
+	}
+
+	var searchAfter []interface{}
+	var pit string
+	if a.Paging == engine.PagingPIT {
+		pager := e.(engine.Pager)
+		if res.err = res.retry(a.Retries, func() (err error) {
+			pit, err = pager.OpenPointInTime(a.Index)
+			return
+		}); res.err != nil {
+			return res
+		}
+		defer func() {
+			if err := pager.ClosePointInTime(pit); err != nil {
+				fmt.Printf("WARNING: %s\n", err)
+			}
+		}()
+	}
+
+	for page := 0; ; page++ {
+		req := &engine.SearchRequest{
+			Index:       a.Index,
+			Query:       q,
+			From:        from,
+			Size:        a.PageSize,
+			FetchSource: a.FetchSource,
+			Paging:      a.Paging,
+			SearchAfter: searchAfter,
+			PIT:         pit,
+			Analysis:    a.Analysis,
+
+			QueryTemplate: a.QueryTemplate,
+		}
+
+		var se *engine.SearchResult
+		var reqStart time.Time
+		if res.err = res.retry(a.Retries, func() (err error) {
+			reqStart = time.Now()
+			se, err = e.Search(req)
+			return
+		}); res.err != nil {
+			return res
+		}
+		latency := time.Since(reqStart)
+
+		if a.Latencies != nil {
+			a.Latencies.Record(q.Shape(), page, latency, time.Duration(se.Took)*time.Millisecond)
+		}
+
+		if a.Paging == engine.PagingPIT && se.PIT != "" {
+			pit = se.PIT
+		}
+		if len(se.Hits) > 0 {
+			searchAfter = se.Hits[len(se.Hits)-1].Sort
+		}
+
+		totalDocsFetched += len(se.Hits)
+
+		if DebugPrint || qc%100 == 0 {
+			fmt.Printf("Executed %d queries - fetched %d / %d (%s) item IDs\n", qc, totalDocsFetched, se.Total, se.TotalRelation)
+		}
+
+		if a.FetchSource && se.Hits != nil && a.Concurrency == 1 {
+			for i, doc := range se.Hits {
+				switch {
+				case doc.Source != nil:
+					fmt.Printf(
+						"%03d. ID: %s  Name: %s  Status: %d  Category: %d\n", i+1,
+						doc.Source.ID, doc.Source.Name, doc.Source.Status, doc.Source.CategoryID,
+					)
+				case doc.SourceNoDesc != nil:
+					fmt.Printf(
+						"%03d. ID: %s  Name: %s  Status: %d  Category: %d  Price: %d  Condition: %d\n", i+1,
+						doc.SourceNoDesc.ID, doc.SourceNoDesc.Name, doc.SourceNoDesc.Status, doc.SourceNoDesc.CategoryID,
+						doc.SourceNoDesc.Price, doc.SourceNoDesc.ItemCondition,
+					)
+				}
+				if i+1 >= 10 {
+					break
+				}
+			}
+		}
+		if a.CollectResults != nil && from == 0 {
+			// Queries without results are collected too, so that they're
+			// scored (as 0) when evaluating
+			r := &eval.Result{QueryNumber: qn, Bestmatch: q.Bestmatch()}
+			for _, doc := range se.Hits {
+				r.IDs = append(r.IDs, doc.ID)
+			}
+			a.CollectResults.Add(r)
+		}
+		if a.WriteResultsTo != nil {
+			page := &results.Page{
+				From:      from,
+				TookMs:    se.Took,
+				LatencyMs: float64(latency) / float64(time.Millisecond),
+				Hits:      make([]*results.Hit, 0, len(se.Hits)),
+			}
+			for _, doc := range se.Hits {
+				page.Hits = append(page.Hits, &results.Hit{ID: doc.ID, Score: doc.Score, Source: doc.Source, SourceNoDesc: doc.SourceNoDesc})
+			}
+			rec.Pages = append(rec.Pages, page)
+			rec.Total = se.Total
+			rec.TotalRelation = se.TotalRelation
+		}
+
+		hasNextPage := se.Total > 0 && se.Total > int64(a.PageSize) && len(se.Hits) == a.PageSize
+		if !hasNextPage || totalDocsFetched >= a.FetchMax {
+			break
+		}
+
+		from += len(se.Hits)
+	}
+
+	if a.WriteResultsTo != nil {
+		rec.LatencyMs = float64(time.Since(queryStart)) / float64(time.Millisecond)
+		b, err := data.ToJSON(rec)
+		if err != nil {
+			res.err = err
+			return res
+		}
+		res.line = string(b) + "\n"
+	}
+
+	return res
+}
+
+// queryBackoff is the initial backoff before retrying a failed request.
+const queryBackoff = 100 * time.Millisecond
+
+// retry calls `f` until it succeeds or has failed `retries` + 1 times, with
+// exponential backoff, counting every call as a request.
+func (res *queryResult) retry(retries int, f func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := f()
+		res.requests++
+		if err == nil {
+			return nil
+		}
+		res.failedRequests++
+		if attempt >= retries {
+			return err
+		}
+		time.Sleep(engine.Backoff(queryBackoff, attempt))
+	}
+}
+
+// resultsWriter writes result records in query order, even when queries
+// complete out of order.
+type resultsWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	next    int
+	pending map[int]string
+	err     error // First write error, after which nothing more is written
+}
+
+func newResultsWriter(w io.Writer) *resultsWriter {
+	return &resultsWriter{w: w, next: 1, pending: make(map[int]string)}
+}
+
+// write queues the line for query number `qc`. An empty line marks a failed
+// or skipped query. Every query must be written, or the lines of the queries
+// after it are never written.
+func (w *resultsWriter) write(qc int, line string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.pending[qc] = line
+
+	for {
+		line, found := w.pending[w.next]
+		if !found {
+			return
+		}
+		delete(w.pending, w.next)
+		w.next++
+
+		if line == "" || w.err != nil {
+			continue
+		}
+		_, w.err = io.WriteString(w.w, line)
+	}
+}
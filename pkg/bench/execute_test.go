@@ -0,0 +1,254 @@
+package bench
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/anrid/search-bench/pkg/engine"
+	"github.com/anrid/search-bench/pkg/eval"
+	"github.com/anrid/search-bench/pkg/query"
+	"github.com/anrid/search-bench/pkg/results"
+)
+
+// fakeEngine returns a single hit, the keyword of the query, for every search.
+type fakeEngine struct {
+	fail string // Fail searches for this keyword
+}
+
+func (e *fakeEngine) Name() string                               { return "fake" }
+func (e *fakeEngine) Version() (string, error)                   { return "1.0", nil }
+func (e *fakeEngine) SanityTest() error                          { return nil }
+func (e *fakeEngine) CreateIndex(string, engine.IndexVars) error { return nil }
+func (e *fakeEngine) BulkIndex(*engine.Batch) (*engine.BulkResult, error) {
+	return &engine.BulkResult{}, nil
+}
+func (e *fakeEngine) Refresh(string) error                     { return nil }
+func (e *fakeEngine) Stats(string) (*engine.IndexStats, error) { return &engine.IndexStats{}, nil }
+func (e *fakeEngine) Settings(string) (interface{}, error)     { return nil, nil }
+
+func (e *fakeEngine) Search(r *engine.SearchRequest) (*engine.SearchResult, error) {
+	if r.Query.Keyword == e.fail {
+		return nil, errors.New("search failed")
+	}
+	return &engine.SearchResult{Hits: []*engine.Hit{{ID: r.Query.Keyword}}, Total: 1, TotalRelation: "eq"}, nil
+}
+
+// numbered returns queries with the given numbers, e.g. as read from a
+// queries file with skipped queries.
+func numbered(numbers ...int) []*query.SearchQuery {
+	var qs []*query.SearchQuery
+	for _, n := range numbers {
+		qs = append(qs, &query.SearchQuery{Keyword: fmt.Sprintf("q%d", n), Number: n})
+	}
+	return qs
+}
+
+// errorSource yields the given queries, then fails.
+type errorSource struct {
+	query.Source
+}
+
+func (s *errorSource) Next() (*query.SearchQuery, error) {
+	q, err := s.Source.Next()
+	if err == io.EOF {
+		return nil, errors.New("truncated queries file")
+	}
+	return q, err
+}
+
+func TestExecuteQueriesNumbersQueries(t *testing.T) {
+	tests := []struct {
+		name             string
+		qs               []*query.SearchQuery
+		numberByPosition bool
+		want             []int
+	}{
+		{"by position in the queries file", numbered(1, 3, 4), false, []int{1, 3, 4}},
+		{"by position in the stream", numbered(4, 1, 4), true, []int{1, 2, 3}},
+		{"unnumbered", []*query.SearchQuery{{Keyword: "a"}, {Keyword: "b"}}, false, []int{1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			collected := eval.NewResults()
+			_, err := ExecuteQueries(&fakeEngine{}, ExecuteQueriesArgs{
+				Queries:          query.SliceSource(tt.qs),
+				NumberByPosition: tt.numberByPosition,
+				WriteResultsTo:   &buf,
+				CollectResults:   collected,
+				Concurrency:      3,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var written, evaluated []int
+			for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+				rec, err := results.ParseLine(line)
+				if err != nil {
+					t.Fatal(err)
+				}
+				written = append(written, rec.QueryNumber)
+			}
+			for _, r := range collected.List() {
+				evaluated = append(evaluated, r.QueryNumber)
+			}
+			if !reflect.DeepEqual(written, tt.want) {
+				t.Errorf("wrote query numbers %v, want %v", written, tt.want)
+			}
+			if !reflect.DeepEqual(evaluated, tt.want) {
+				t.Errorf("collected query numbers %v, want %v", evaluated, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecuteQueriesFailures(t *testing.T) {
+	tests := []struct {
+		name             string
+		source           query.Source
+		fail             string // Keyword of the query that fails
+		maxFailedQueries int
+		wantErr          bool
+		wantErrors       int64
+	}{
+		{"all succeed", query.SliceSource(numbered(1, 2, 3)), "", 0, false, 0},
+		{"failed query skipped", query.SliceSource(numbered(1, 2, 3)), "q2", 1, false, 1},
+		{"too many failed queries", query.SliceSource(numbered(1, 2, 3)), "q2", 0, true, 1},
+		{"queries file error", &errorSource{query.SliceSource(numbered(1))}, "", 0, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats, err := ExecuteQueries(&fakeEngine{fail: tt.fail}, ExecuteQueriesArgs{Queries: tt.source, MaxFailedQueries: tt.maxFailedQueries})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error: %v", err, tt.wantErr)
+			}
+			if stats.Errors != tt.wantErrors {
+				t.Errorf("got %d failed queries, want %d", stats.Errors, tt.wantErrors)
+			}
+		})
+	}
+}
+
+func TestReplayJudgments(t *testing.T) {
+	qs := numbered(1, 3)
+	stream := []*query.SearchQuery{qs[1], qs[0], qs[1]}
+	j := eval.Judgments{1: {"a": 1}, 3: {"b": 2}, 5: {"c": 1}}
+
+	want := eval.Judgments{1: {"b": 2}, 2: {"a": 1}, 3: {"b": 2}}
+	if got := replayJudgments(stream, j); !reflect.DeepEqual(got, want) {
+		t.Errorf("replayJudgments() = %v, want %v", got, want)
+	}
+}
+
+func TestRunBenchmarkStreamsQueriesFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "queries.jsonl")
+	content := "{\"query\": \"a<|>[]<|>[]\"}\n{\"query\": \"bad\"}\n{\"query\": \"b<|>[]<|>[]\", \"c\": \"2\"}\n"
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		replay  query.ReplayArgs
+		queries int
+	}{
+		{"flat", query.ReplayArgs{}, 2},
+		{"expand", query.ReplayArgs{Mode: query.ReplayExpand}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rep, err := RunBenchmark(&fakeEngine{}, RunBenchmarkArgs{
+				NumberOfRuns: 2,
+				QueriesFile:  file,
+				Replay:       tt.replay,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rep.Params["queries"] != tt.queries {
+				t.Errorf("ran %v queries, want %d", rep.Params["queries"], tt.queries)
+			}
+			if rep.Errors.SkippedQueries != 1 || rep.Errors.SkippedQueryReasons["missing parts"] != 1 {
+				t.Errorf("got skipped queries %d %v, want 1 missing parts", rep.Errors.SkippedQueries, rep.Errors.SkippedQueryReasons)
+			}
+		})
+	}
+}
+
+func TestRunBenchmarkReplayFilters(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "queries.jsonl")
+	if err := os.WriteFile(file, []byte("{\"query\": \"a<|>[]<|>[]\", \"c\": \"50\"}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The replayed stream repeats the same query, searched by several workers
+	// at once
+	rep, err := RunBenchmark(&fakeEngine{}, RunBenchmarkArgs{
+		NumberOfRuns:   2,
+		QueriesFile:    file,
+		Filters:        &query.Filters{PriceMin: 100, Sort: query.SortPriceAsc},
+		UseItemsNoDesc: true,
+		Concurrency:    4,
+		Replay:         query.ReplayArgs{Mode: query.ReplayExpand},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Params["queries"] != 50 || rep.Errors.FailedQueries != 0 {
+		t.Errorf("ran %v queries with %d failures, want 50 without failures", rep.Params["queries"], rep.Errors.FailedQueries)
+	}
+
+	q := &query.SearchQuery{Keyword: "a", Number: 1}
+	qs, err := openQueries(RunBenchmarkArgs{
+		Filters:        &query.Filters{Sort: query.SortPriceAsc},
+		UseItemsNoDesc: true,
+		Replay:         query.ReplayArgs{Mode: query.ReplayExpand},
+	}, []*query.SearchQuery{q, q})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		got, err := qs.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == q || got.Sort != query.SortPriceAsc {
+			t.Errorf("got query %+v, want a filtered copy of the replayed query", got)
+		}
+	}
+	if q.Sort != "" {
+		t.Errorf("filters were applied to the replayed query itself: %+v", q)
+	}
+}
+
+func TestRunBenchmarkNeedsItemsNoDesc(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "queries.jsonl")
+	if err := os.WriteFile(file, []byte("{\"query\": \"a<|>[]<|>[]<|>100\"}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, replay := range []query.ReplayArgs{{}, {Mode: query.ReplayExpand}} {
+		rep, err := RunBenchmark(&fakeEngine{}, RunBenchmarkArgs{NumberOfRuns: 1, QueriesFile: file, Replay: replay})
+		if err != nil {
+			t.Fatalf("got error %v for a price filter on the items index (replay: %q)", err, replay.Mode)
+		}
+		if rep.Errors.SkippedQueryReasons["needs items_no_desc"] != 1 {
+			t.Errorf("got skipped queries %v for a price filter on the items index (replay: %q)", rep.Errors.SkippedQueryReasons, replay.Mode)
+		}
+	}
+	if _, err := RunBenchmark(&fakeEngine{}, RunBenchmarkArgs{NumberOfRuns: 1, QueriesFile: file, UseItemsNoDesc: true}); err != nil {
+		t.Errorf("got error %v for a price filter on the items_no_desc index", err)
+	}
+	filters := &query.Filters{Sort: query.SortPriceAsc}
+	if _, err := RunBenchmark(&fakeEngine{}, RunBenchmarkArgs{NumberOfRuns: 1, QueriesFile: file, Filters: filters}); !errors.Is(err, query.ErrNeedsItemsNoDesc) {
+		t.Errorf("got error %v for sorting by price on the items index", err)
+	}
+}
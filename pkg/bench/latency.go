@@ -0,0 +1,186 @@
+package bench
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anrid/search-bench/pkg/histogram"
+)
+
+const (
+	PageAll   = "all"
+	PageFirst = "first"
+	PageNext  = "next"
+	ShapeAll  = "all"
+)
+
+// LatencySeries holds the latencies of one query shape and page combination.
+type LatencySeries struct {
+	Shape  string
+	Page   string
+	Client *histogram.Histogram // Wall time measured by the client
+	Took   *histogram.Histogram // Time reported by the engine (`took`)
+}
+
+// Latencies records per-request latencies split by query shape (see
+// `query.SearchQuery.Shape`) and page (first vs subsequent pages), as well as
+// by page depth across all shapes. It's safe for concurrent use.
+type Latencies struct {
+	mu     sync.Mutex
+	series map[string]*LatencySeries
+}
+
+func NewLatencies() *Latencies {
+	return &Latencies{series: make(map[string]*LatencySeries)}
+}
+
+func (l *Latencies) get(shape, page string) *LatencySeries {
+	key := shape + "/" + page
+	s, found := l.series[key]
+	if !found {
+		s = &LatencySeries{
+			Shape:  shape,
+			Page:   page,
+			Client: histogram.New(),
+			Took:   histogram.New(),
+		}
+		l.series[key] = s
+	}
+	return s
+}
+
+// Record records a single request for the given (zero based) page in its own
+// series as well as in the totals per shape, per page, per page depth and
+// overall.
+func (l *Latencies) Record(shape string, page int, client, took time.Duration) {
+	firstOrNext := PageNext
+	if page == 0 {
+		firstOrNext = PageFirst
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, s := range []*LatencySeries{
+		l.get(shape, firstOrNext),
+		l.get(shape, PageAll),
+		l.get(ShapeAll, firstOrNext),
+		l.get(ShapeAll, PageAll),
+		l.get(ShapeAll, pageDepth(page)),
+	} {
+		s.Client.Record(client)
+		s.Took.Record(took)
+	}
+}
+
+// Merge adds all latencies recorded in `o` to these latencies.
+func (l *Latencies) Merge(o *Latencies) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for _, other := range o.series {
+		s := l.get(other.Shape, other.Page)
+		s.Client.Merge(other.Client)
+		s.Took.Merge(other.Took)
+	}
+}
+
+// Series returns all series sorted by shape and page, with totals last.
+func (l *Latencies) Series() (series []*LatencySeries) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, s := range l.series {
+		series = append(series, s)
+	}
+
+	order := func(v, all string) string {
+		if v == all {
+			return "~" // Sort totals last
+		}
+		return v
+	}
+	sort.Slice(series, func(i, j int) bool {
+		a, b := series[i], series[j]
+		if a.Shape != b.Shape {
+			return order(a.Shape, ShapeAll) < order(b.Shape, ShapeAll)
+		}
+		return pageOrder(a.Page) < pageOrder(b.Page)
+	})
+
+	return
+}
+
+// pageDepth returns the page depth bucket of the given (zero based) page: the
+// first 4 pages on their own, then doubling ranges, i.e. p1, p2, p3, p4,
+// p5-8, p9-16 and so on.
+func pageDepth(page int) string {
+	n := page + 1
+	if n <= 4 {
+		return fmt.Sprintf("p%d", n)
+	}
+	lo := 5
+	for hi := 8; ; lo, hi = hi+1, hi*2 {
+		if n <= hi {
+			return fmt.Sprintf("p%d-%d", lo, hi)
+		}
+	}
+}
+
+// pageOrder sorts first and next pages first, then page depths, then totals.
+func pageOrder(page string) int {
+	switch page {
+	case PageFirst:
+		return -2
+	case PageNext:
+		return -1
+	case PageAll:
+		return math.MaxInt
+	}
+	var n int
+	fmt.Sscanf(page, "p%d", &n)
+	return n
+}
+
+// Print prints a table of latency percentiles per series, both for client
+// wall time and the time reported by the engine.
+func (l *Latencies) Print(title string) {
+	series := l.Series()
+	if len(series) == 0 {
+		return
+	}
+
+	fmt.Printf("%s:\n", title)
+
+	header := fmt.Sprintf(
+		"%-16s %-9s %-6s %8s %9s %9s %9s %9s %9s %9s",
+		"shape", "page", "time", "count", "mean", "p50", "p90", "p99", "p99.9", "max",
+	)
+	fmt.Println(header)
+	fmt.Println(strings.Repeat("-", len(header)))
+
+	ms := func(d time.Duration) string {
+		return fmt.Sprintf("%.2fms", float64(d)/float64(time.Millisecond))
+	}
+
+	for _, s := range series {
+		for _, h := range []struct {
+			name string
+			h    *histogram.Histogram
+		}{{"client", s.Client}, {"took", s.Took}} {
+			sum := h.h.Summary()
+			fmt.Printf(
+				"%-16s %-9s %-6s %8d %9s %9s %9s %9s %9s %9s\n",
+				s.Shape, s.Page, h.name, sum.Count,
+				ms(sum.Mean), ms(sum.P50), ms(sum.P90), ms(sum.P99), ms(sum.P999), ms(sum.Max),
+			)
+		}
+	}
+	fmt.Println()
+}
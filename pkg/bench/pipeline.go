@@ -0,0 +1,183 @@
+package bench
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/anrid/search-bench/pkg/engine"
+)
+
+const (
+	StageRead     = "read"
+	StageTokenize = "tokenize"
+	StageIndex    = "index"
+)
+
+// StageStats holds the number of documents processed by a pipeline stage and
+// the time its workers spent processing them.
+type StageStats struct {
+	Name    string
+	Workers int
+	Docs    int64
+	Busy    time.Duration // Summed across workers, excluding time spent waiting on other stages
+}
+
+// Throughput returns the number of documents processed per second by the
+// stage while busy, i.e. how fast the stage would be if it never had to wait
+// on the other stages.
+func (s *StageStats) Throughput() float64 {
+	if s.Busy == 0 {
+		return 0
+	}
+	return float64(s.Docs) / (s.Busy.Seconds() / float64(s.Workers))
+}
+
+type IndexPipelineArgs struct {
+	TokenizeWorkers int
+	BulkWorkers     int
+	Tokenize        func(b *engine.Batch)
+	BulkIndex       func(b *engine.Batch) error // Called concurrently by all bulk workers
+}
+
+// IndexPipeline tokenizes and bulk indexes batches on separate pools of
+// workers, so that reading, tokenizing and indexing run in parallel. Stages
+// are connected by bounded channels, so a slow stage blocks the stages before
+// it rather than buffering an unbounded number of batches.
+type IndexPipeline struct {
+	a          IndexPipelineArgs
+	tokenize   chan *engine.Batch
+	send       chan *engine.Batch
+	tokenizers sync.WaitGroup
+	senders    sync.WaitGroup
+	lastAdd    time.Time
+
+	mu     sync.Mutex
+	err    error
+	stages map[string]*StageStats
+}
+
+func StartIndexPipeline(a IndexPipelineArgs) *IndexPipeline {
+	if a.TokenizeWorkers <= 0 {
+		a.TokenizeWorkers = 1
+	}
+	if a.BulkWorkers <= 0 {
+		a.BulkWorkers = 1
+	}
+
+	p := &IndexPipeline{
+		a:        a,
+		tokenize: make(chan *engine.Batch, a.TokenizeWorkers),
+		send:     make(chan *engine.Batch, a.BulkWorkers),
+		lastAdd:  time.Now(),
+		stages: map[string]*StageStats{
+			StageRead:     {Name: StageRead, Workers: 1},
+			StageTokenize: {Name: StageTokenize, Workers: a.TokenizeWorkers},
+			StageIndex:    {Name: StageIndex, Workers: a.BulkWorkers},
+		},
+	}
+
+	for w := 0; w < a.TokenizeWorkers; w++ {
+		p.tokenizers.Add(1)
+		go func() {
+			defer p.tokenizers.Done()
+			for b := range p.tokenize {
+				if p.Err() != nil {
+					continue // Drop remaining batches
+				}
+				start := time.Now()
+				a.Tokenize(b)
+				p.record(StageTokenize, b, time.Since(start))
+				p.send <- b
+			}
+		}()
+	}
+
+	for w := 0; w < a.BulkWorkers; w++ {
+		p.senders.Add(1)
+		go func() {
+			defer p.senders.Done()
+			for b := range p.send {
+				if p.Err() != nil {
+					continue // Drop remaining batches
+				}
+				start := time.Now()
+				err := a.BulkIndex(b)
+				p.record(StageIndex, b, time.Since(start))
+				if err != nil {
+					p.mu.Lock()
+					if p.err == nil {
+						p.err = err
+					}
+					p.mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	return p
+}
+
+func (p *IndexPipeline) record(stage string, b *engine.Batch, busy time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := p.stages[stage]
+	s.Docs += int64(b.Len())
+	s.Busy += busy
+}
+
+// Add queues a batch read by the caller, blocking while the pipeline is full.
+// Must be called from a single goroutine. Returns the first error returned by
+// `BulkIndex`, after which all queued batches are dropped.
+func (p *IndexPipeline) Add(b *engine.Batch) error {
+	if err := p.Err(); err != nil {
+		return err
+	}
+
+	// Time since the previous batch was queued was spent reading this one
+	p.record(StageRead, b, time.Since(p.lastAdd))
+	p.tokenize <- b
+	p.lastAdd = time.Now()
+
+	return nil
+}
+
+// Close waits until all queued batches have been indexed and returns the
+// first error returned by `BulkIndex`, if any.
+func (p *IndexPipeline) Close() error {
+	p.mu.Lock()
+	p.stages[StageRead].Busy += time.Since(p.lastAdd)
+	p.mu.Unlock()
+
+	close(p.tokenize)
+	p.tokenizers.Wait()
+	close(p.send)
+	p.senders.Wait()
+
+	return p.Err()
+}
+
+func (p *IndexPipeline) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// Stages returns the stats of each stage, in pipeline order.
+func (p *IndexPipeline) Stages() []*StageStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return []*StageStats{p.stages[StageRead], p.stages[StageTokenize], p.stages[StageIndex]}
+}
+
+// Print prints the throughput of each stage.
+func (p *IndexPipeline) Print() {
+	for _, s := range p.Stages() {
+		fmt.Printf(
+			"Stage %-8s : %d workers, %d docs, busy %s, %.1f docs/sec\n",
+			s.Name, s.Workers, s.Docs, s.Busy.Round(time.Millisecond), s.Throughput(),
+		)
+	}
+}
@@ -0,0 +1,135 @@
+package bench
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/anrid/search-bench/pkg/engine"
+	"github.com/anrid/search-bench/pkg/item"
+)
+
+func testBatch(n int) *engine.Batch {
+	return &engine.Batch{Index: engine.ItemsIndexName, Items: []*item.Item{{ID: fmt.Sprint(n)}}}
+}
+
+func TestIndexPipeline(t *testing.T) {
+	var mu sync.Mutex
+	indexed := make(map[string]bool)
+	var tokenized int64
+
+	p := StartIndexPipeline(IndexPipelineArgs{
+		TokenizeWorkers: 3,
+		BulkWorkers:     2,
+		Tokenize:        func(b *engine.Batch) { atomic.AddInt64(&tokenized, 1) },
+		BulkIndex: func(b *engine.Batch) error {
+			mu.Lock()
+			defer mu.Unlock()
+			indexed[b.Items[0].ID] = true
+			return nil
+		},
+	})
+	for n := 0; n < 100; n++ {
+		if err := p.Add(testBatch(n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(indexed) != 100 || tokenized != 100 {
+		t.Errorf("tokenized %d and indexed %d of 100 batches", tokenized, len(indexed))
+	}
+	for _, s := range p.Stages() {
+		if s.Docs != 100 {
+			t.Errorf("stage %s processed %d docs, want 100", s.Name, s.Docs)
+		}
+	}
+}
+
+func TestIndexPipelineFirstError(t *testing.T) {
+	var calls int64
+	p := StartIndexPipeline(IndexPipelineArgs{
+		Tokenize: func(b *engine.Batch) {},
+		BulkIndex: func(b *engine.Batch) error {
+			return fmt.Errorf("bulk request #%d failed", atomic.AddInt64(&calls, 1))
+		},
+	})
+
+	// Adding fails once the error reaches the reader
+	var err error
+	var added int
+	for added = 0; added < 1000 && err == nil; added++ {
+		err = p.Add(testBatch(added))
+		time.Sleep(time.Millisecond)
+	}
+	if err == nil || err.Error() != "bulk request #1 failed" {
+		t.Fatalf("got error %v from Add, want the first error", err)
+	}
+
+	if err := p.Close(); err == nil || err.Error() != "bulk request #1 failed" {
+		t.Errorf("got error %v from Close, want the first error", err)
+	}
+	// Batches queued after the error are dropped rather than indexed
+	if calls != 1 {
+		t.Errorf("sent %d of %d batches, want only the first one", calls, added)
+	}
+}
+
+func TestIndexPipelineBounded(t *testing.T) {
+	release := make(chan struct{})
+	p := StartIndexPipeline(IndexPipelineArgs{
+		TokenizeWorkers: 1,
+		BulkWorkers:     1,
+		Tokenize:        func(b *engine.Batch) {},
+		BulkIndex: func(b *engine.Batch) error {
+			<-release
+			return nil
+		},
+	})
+
+	var added int64
+	done := make(chan error)
+	go func() {
+		for n := 0; n < 20; n++ {
+			if err := p.Add(testBatch(n)); err != nil {
+				done <- err
+				return
+			}
+			atomic.AddInt64(&added, 1)
+		}
+		done <- nil
+	}()
+
+	// One batch being indexed, one waiting to be sent, one tokenized batch
+	// waiting on the send queue and one waiting to be tokenized
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt64(&added); n > 4 {
+		t.Errorf("queued %d batches while indexing was blocked, want at most 4", n)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s := p.Stages()[2]; s.Docs != 20 {
+		t.Errorf("indexed %d of 20 batches", s.Docs)
+	}
+}
+
+func TestIndexPipelineCloseWithoutBatches(t *testing.T) {
+	p := StartIndexPipeline(IndexPipelineArgs{
+		Tokenize:  func(b *engine.Batch) {},
+		BulkIndex: func(b *engine.Batch) error { return errors.New("unexpected batch") },
+	})
+	if err := p.Close(); err != nil {
+		t.Error(err)
+	}
+}
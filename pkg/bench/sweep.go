@@ -0,0 +1,176 @@
+package bench
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/anrid/search-bench/pkg/engine"
+	"github.com/anrid/search-bench/pkg/eval"
+	"github.com/anrid/search-bench/pkg/report"
+)
+
+// Variant is one combination of index variables in a settings sweep.
+type Variant struct {
+	Name string // e.g. "bm25_b=0.5,bm25_k1=1.2", empty when not sweeping
+	Vars engine.IndexVars
+}
+
+// Variants returns every combination of the swept values, each merged with
+// the base variables. Sweeps are given as `<var>=<value>,<value>,..`, e.g.
+// `bm25_b=0.3,0.75,1.0`. Without sweeps, a single unnamed variant using the
+// base variables is returned.
+func Variants(base engine.IndexVars, sweeps []string) ([]*Variant, error) {
+	variants := []engine.IndexVars{{}}
+
+	for _, sweep := range sweeps {
+		name, values, found := strings.Cut(sweep, "=")
+		if !found || name == "" || values == "" {
+			return nil, fmt.Errorf("invalid sweep '%s' (expected <var>=<value>,<value>,..)", sweep)
+		}
+
+		var next []engine.IndexVars
+		for _, vars := range variants {
+			if _, dup := vars[name]; dup {
+				return nil, fmt.Errorf("index variable '%s' is swept more than once", name)
+			}
+			for _, value := range strings.Split(values, ",") {
+				v := engine.IndexVars{name: strings.TrimSpace(value)}
+				for k, val := range vars {
+					v[k] = val
+				}
+				next = append(next, v)
+			}
+		}
+		variants = next
+	}
+
+	var res []*Variant
+	for _, swept := range variants {
+		v := &Variant{Vars: engine.IndexVars{}}
+		if len(swept) > 0 {
+			v.Name = swept.String()
+		}
+		for k, val := range base {
+			v.Vars[k] = val
+		}
+		for k, val := range swept {
+			v.Vars[k] = val
+		}
+		res = append(res, v)
+	}
+
+	return res, nil
+}
+
+// Filename suffixes the given filename with the variant, e.g. report.json ->
+// report.bm25_b-0.5_bm25_k1-1.2.json
+func (v *Variant) Filename(filename string) string {
+	if v.Name == "" {
+		return filename
+	}
+	return SuffixFilename(filename, strings.NewReplacer("=", "-", ",", "_").Replace(v.Name))
+}
+
+// SuffixFilename inserts a suffix before the extension of the given filename,
+// keeping compound extensions like .jsonl.gz intact.
+func SuffixFilename(filename, suffix string) string {
+	if filename == "" {
+		return filename
+	}
+	ext := filepath.Ext(filename)
+	if ext == ".gz" {
+		// e.g. results.jsonl.gz -> results.<suffix>.jsonl.gz
+		ext = filepath.Ext(strings.TrimSuffix(filename, ext)) + ext
+	}
+	return strings.TrimSuffix(filename, ext) + "." + suffix + ext
+}
+
+// SweepRun holds the reports of indexing and benchmarking a single variant,
+// with a single query template.
+type SweepRun struct {
+	Variant       *Variant
+	QueryTemplate string
+	Index         *report.Report // Nil when not indexing, or for all but the first query template
+	Benchmark     *report.Report // Nil when only indexing
+}
+
+// Name returns the variant and query template of the run, e.g.
+// "bm25_b=0.5 / cross_fields".
+func (r *SweepRun) Name() string {
+	var parts []string
+	if r.Variant.Name != "" {
+		parts = append(parts, r.Variant.Name)
+	}
+	if r.QueryTemplate != "" {
+		parts = append(parts, r.QueryTemplate)
+	}
+	return strings.Join(parts, " / ")
+}
+
+// PrintSweep prints a table comparing indexing and query performance (and
+// relevance, when evaluating results) across all variants in a sweep, and
+// across query templates.
+func PrintSweep(engineName string, runs []*SweepRun) {
+	// Show nDCG at the smallest cutoff, if results were evaluated
+	prefix := "eval." + eval.GroupAll + ".ndcg@"
+	var ndcg string
+	minK := -1
+	for _, r := range runs {
+		if r.Benchmark == nil || len(r.Benchmark.Phases) == 0 {
+			continue
+		}
+		for key := range r.Benchmark.Phases[0].Extra {
+			if k, err := strconv.Atoi(strings.TrimPrefix(key, prefix)); err == nil && strings.HasPrefix(key, prefix) && (minK < 0 || k < minK) {
+				ndcg, minK = key, k
+			}
+		}
+	}
+
+	width := len("variant")
+	for _, r := range runs {
+		width = max(width, len(r.Name()))
+	}
+
+	fmt.Printf("Sweep results (%s):\n", engineName)
+	fmt.Printf("%-*s  %12s  %10s  %10s  %10s  %10s  %10s  %10s", width, "variant", "docs", "size (MB)", "index (s)", "docs/sec", "query avg", "query p99", "queries/s")
+	if ndcg != "" {
+		fmt.Printf("  %10s", fmt.Sprintf("ndcg@%d", minK))
+	}
+	fmt.Println()
+
+	for _, r := range runs {
+		fmt.Printf("%-*s", width, r.Name())
+
+		if r.Index != nil {
+			idx := r.Index.Phases[0]
+			fmt.Printf("  %12d  %10.1f  %10.1f  %10.0f",
+				r.Index.ItemCount, float64(r.Index.StatsAfter.SizeInBytes)/1024/1024, idx.AverageMs/1000, idx.Throughput)
+		} else {
+			fmt.Printf("  %12s  %10s  %10s  %10s", "-", "-", "-", "-")
+		}
+
+		if r.Benchmark == nil || len(r.Benchmark.Phases) == 0 {
+			fmt.Println()
+			continue
+		}
+		q := r.Benchmark.Phases[0]
+		var p99 float64
+		for _, l := range q.Latencies {
+			if l.Shape == ShapeAll && l.Page == PageAll && l.Measure == "query" {
+				p99 = l.P99Ms
+			}
+		}
+		fmt.Printf("  %8.1fms  %8.1fms  %10.1f", q.AverageMs/float64(max(q.Count, 1)), p99, q.Throughput)
+		if ndcg != "" {
+			if v, ok := q.Extra[ndcg].(float64); ok {
+				fmt.Printf("  %10.4f", v)
+			} else {
+				fmt.Printf("  %10s", "n/a")
+			}
+		}
+		fmt.Println()
+	}
+	fmt.Println()
+}
@@ -0,0 +1,91 @@
+package bench
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/anrid/search-bench/pkg/engine"
+)
+
+func TestVariants(t *testing.T) {
+	tests := []struct {
+		name    string
+		base    engine.IndexVars
+		sweeps  []string
+		want    []*Variant
+		wantErr bool
+	}{
+		{
+			name: "no sweeps",
+			base: engine.IndexVars{"shards": "2"},
+			want: []*Variant{{Vars: engine.IndexVars{"shards": "2"}}},
+		},
+		{
+			name:   "one sweep",
+			base:   engine.IndexVars{"shards": "2"},
+			sweeps: []string{"bm25_b=0.3, 0.75"},
+			want: []*Variant{
+				{Name: "bm25_b=0.3", Vars: engine.IndexVars{"shards": "2", "bm25_b": "0.3"}},
+				{Name: "bm25_b=0.75", Vars: engine.IndexVars{"shards": "2", "bm25_b": "0.75"}},
+			},
+		},
+		{
+			name:   "every combination",
+			sweeps: []string{"bm25_b=0.3,0.75", "bm25_k1=1.2,2"},
+			want: []*Variant{
+				{Name: "bm25_b=0.3,bm25_k1=1.2", Vars: engine.IndexVars{"bm25_b": "0.3", "bm25_k1": "1.2"}},
+				{Name: "bm25_b=0.3,bm25_k1=2", Vars: engine.IndexVars{"bm25_b": "0.3", "bm25_k1": "2"}},
+				{Name: "bm25_b=0.75,bm25_k1=1.2", Vars: engine.IndexVars{"bm25_b": "0.75", "bm25_k1": "1.2"}},
+				{Name: "bm25_b=0.75,bm25_k1=2", Vars: engine.IndexVars{"bm25_b": "0.75", "bm25_k1": "2"}},
+			},
+		},
+		{
+			name:   "sweep overrides base",
+			base:   engine.IndexVars{"bm25_b": "0.5"},
+			sweeps: []string{"bm25_b=1"},
+			want:   []*Variant{{Name: "bm25_b=1", Vars: engine.IndexVars{"bm25_b": "1"}}},
+		},
+		{name: "missing values", sweeps: []string{"bm25_b="}, wantErr: true},
+		{name: "missing name", sweeps: []string{"=1,2"}, wantErr: true},
+		{name: "not a sweep", sweeps: []string{"bm25_b"}, wantErr: true},
+		{name: "swept twice", sweeps: []string{"bm25_b=1", "bm25_b=2"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Variants(tt.base, tt.sweeps)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Variants() error = %v, want error: %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Variants() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSuffixFilename(t *testing.T) {
+	tests := []struct {
+		filename, suffix, want string
+	}{
+		{"report.json", "index", "report.index.json"},
+		{"out/results.jsonl.gz", "cross_fields", "out/results.cross_fields.jsonl.gz"},
+		{"results.gz", "a", "results.a.gz"},
+		{"results", "a", "results.a"},
+		{"", "a", ""},
+	}
+	for _, tt := range tests {
+		if got := SuffixFilename(tt.filename, tt.suffix); got != tt.want {
+			t.Errorf("SuffixFilename(%q, %q) = %q, want %q", tt.filename, tt.suffix, got, tt.want)
+		}
+	}
+}
+
+func TestVariantFilename(t *testing.T) {
+	v := &Variant{Name: "bm25_b=0.5,bm25_k1=1.2"}
+	if got, want := v.Filename("report.csv"), "report.bm25_b-0.5_bm25_k1-1.2.csv"; got != want {
+		t.Errorf("Filename() = %q, want %q", got, want)
+	}
+	if got := (&Variant{}).Filename("report.csv"); got != "report.csv" {
+		t.Errorf("Filename() of the unnamed variant = %q", got)
+	}
+}
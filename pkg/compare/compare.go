@@ -1,212 +1,313 @@
 package compare
 
 import (
-	"bufio"
 	"fmt"
-	"log"
-	"os"
+	"io"
+	"math"
 	"path/filepath"
-	"strings"
 
 	"github.com/anrid/search-bench/pkg/data"
+	"github.com/anrid/search-bench/pkg/results"
 )
 
 const (
 	DebugPrint = false
 )
 
-type Line struct {
-	FromFile string
-	Text     string
-}
-
-func ReadFilesLineByLine(files []string, forEachLine func(lineNumber int, lines []*Line) error) {
-	var names []string
-
+// ReadFilesByQuery reads results files (in any format) side by side, calling
+// `forEachQuery` with the records of each query number in ascending order.
+// Records are nil for files missing a query, e.g. legacy results files skip
+// queries without results, and all files skip failed queries.
+//
+// Unreadable and unsorted files, and files that disagree on whether a query
+// is bestmatch, return an error, as does `forEachQuery`.
+func ReadFilesByQuery(files []string, forEachQuery func(recs []*results.Record) error) error {
 	// Open all results files
-	var fs []*os.File
+	var rs []*results.Reader
 	for _, file := range files {
-		f, err := os.Open(file)
+		r, err := results.Open(file)
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
-		fs = append(fs, f)
-		defer f.Close()
-
-		names = append(names, filepath.Base(f.Name()))
+		defer r.Close()
+		rs = append(rs, r)
 	}
 
-	// Read results from all files line-by-line
-	var scans []*bufio.Scanner
-	for _, f := range fs {
-		scans = append(scans, bufio.NewScanner(f))
+	heads := make([]*results.Record, len(rs))
+	next := func(i int) error {
+		rec, err := rs[i].Next()
+		if err == io.EOF {
+			heads[i] = nil
+			return nil
+		}
+		if err != nil {
+			if heads[i] != nil {
+				return fmt.Errorf("could not read results file %s after query #%d: %w", files[i], heads[i].QueryNumber, err)
+			}
+			return fmt.Errorf("could not read results file %s: %w", files[i], err)
+		}
+		if heads[i] != nil && rec.QueryNumber <= heads[i].QueryNumber {
+			return fmt.Errorf("results file %s isn't sorted by query number (query #%d after #%d)", files[i], rec.QueryNumber, heads[i].QueryNumber)
+		}
+		heads[i] = rec
+		return nil
 	}
 
-	var lines []*Line
-	var lineNumber int
+	for i := range rs {
+		if err := next(i); err != nil {
+			return err
+		}
+	}
 
 	for {
-		var end int
-
-		for i, s := range scans {
-			if s.Scan() {
-				text := strings.Trim(s.Text(), "\n\t\r ")
-				if text == "" {
-					end++
-					break
-				} else {
-					lines = append(lines, &Line{
-						FromFile: names[i],
-						Text:     text,
-					})
-				}
-			} else {
-				end++
+		// Lowest query number across all files
+		qn := -1
+		for _, h := range heads {
+			if h != nil && (qn == -1 || h.QueryNumber < qn) {
+				qn = h.QueryNumber
 			}
 		}
-
-		if end > 0 {
+		if qn == -1 {
 			break
 		}
 
-		lineNumber++
+		recs := make([]*results.Record, len(rs))
+		for i, h := range heads {
+			if h == nil || h.QueryNumber != qn {
+				continue
+			}
+			recs[i] = h
+			if err := next(i); err != nil {
+				return err
+			}
+		}
 
-		err := forEachLine(lineNumber, lines)
-		if err != nil {
-			break
+		var first *results.Record
+		for i, rec := range recs {
+			if rec == nil {
+				continue
+			}
+			if first == nil {
+				first = rec
+			} else if rec.Bestmatch != first.Bestmatch {
+				return fmt.Errorf(
+					"query #%d is bestmatch=%t in one file but bestmatch=%t in file %s",
+					qn, first.Bestmatch, rec.Bestmatch, files[i],
+				)
+			}
 		}
 
-		lines = nil
+		if err := forEachQuery(recs); err != nil {
+			return err
+		}
 	}
+
+	return nil
 }
 
-func CompareResults(fileA, fileB string) {
-	stats := struct {
-		SortByDate struct {
-			Identical                int
-			Different                int
-			Total                    int
-			DiffPct                  float64
-			PrimaryKeyDiffRatio      float64
-			PrimaryKeyDiffRatioCount float64
-			PrimaryKeyAvgDiffPct     float64
-		}
-		Bestmatch struct {
-			Identical                int
-			Different                int
-			Total                    int
-			DiffPct                  float64
-			PrimaryKeyDiffRatio      float64
-			PrimaryKeyDiffRatioCount float64
-			PrimaryKeyAvgDiffPct     float64
+// present returns the first record found, i.e. one that isn't nil.
+func present(recs []*results.Record) *results.Record {
+	for _, rec := range recs {
+		if rec != nil {
+			return rec
 		}
-	}{}
+	}
+	return nil
+}
 
-	ReadFilesLineByLine([]string{fileA, fileB}, func(lineNumber int, lines []*Line) error {
-		if len(lines) != 2 {
-			log.Panic("expected to compare lines from 2 files")
-		}
+// ids returns the IDs on the first page of results, or none for a missing
+// record.
+func ids(rec *results.Record) []string {
+	if rec == nil {
+		return nil
+	}
+	return rec.IDs()
+}
 
-		lineA := lines[0]
-		lineB := lines[1]
+// Stats summarizes the differences between two results files for one kind of
+// query (bestmatch or sort-by-date).
+type Stats struct {
+	Identical                int
+	Different                int
+	ReorderedOnly            int // Same IDs in a different order
+	Total                    int
+	DiffPct                  float64
+	PrimaryKeyDiffRatio      float64
+	PrimaryKeyDiffRatioCount float64
+	PrimaryKeyAvgDiffPct     float64
+
+	// Rank-aware metrics, averaged across all queries
+	AvgRBO              float64
+	AvgKendallTau       float64 // Over the IDs found in both lists, for queries with 2+ shared IDs
+	AvgJaccard          map[string]float64
+	AvgRankDisplacement float64 // Over the IDs found in both lists
+
+	Missing int // Queries missing from one of the files, compared as if without results
+
+	// Hit counts and scores, only known in the JSON lines results format
+	TotalCompared   int // Queries with a known total number of hits in both files
+	TotalChanged    int // Queries with a different total number of hits (or relation)
+	AvgTotalDiffPct float64
+	ScoresCompared  int     // IDs found on both first pages with scores in both files
+	AvgScoreDiff    float64 // Absolute difference in score
+	AvgScoreDiffPct float64 // Difference in score relative to the higher score
+
+	sumRBO, sumTau, sumDisplacement float64
+	tauCount, displacementCount     int
+	sumJaccard                      map[string]float64
+	sumTotalDiffPct                 float64
+	sumScoreDiff, sumScoreDiffPct   float64
+}
 
-		pA := strings.SplitN(lineA.Text, "|", 3)
-		queryNumberA := pA[0]
-		isBestmatchA := false
-		if pA[1] == "bm=1" {
-			isBestmatchA = true
-		}
-		idsA := strings.SplitN(pA[2], ",", -1)
+// add compares the results of a single query in two files. Either record may
+// be nil if the query is missing from that file.
+func (s *Stats) add(a, b *results.Record) {
+	idsA, idsB := ids(a), ids(b)
 
-		pB := strings.SplitN(lineB.Text, "|", 3)
-		queryNumberB := pB[0]
-		isBestmatchB := false
-		if pB[1] == "bm=1" {
-			isBestmatchB = true
+	s.Total++
+
+	if Equal(idsA, idsB) {
+		s.Identical++
+	} else {
+		s.Different++
+
+		onlyA, onlyB, _ := Diff(idsA, idsB)
+		if len(onlyA) == 0 && len(onlyB) == 0 {
+			s.ReorderedOnly++
 		}
-		idsB := strings.SplitN(pB[2], ",", -1)
 
-		if queryNumberA != queryNumberB {
-			log.Panicf(
-				"at query #%s in file %s but query #%s in file %s on the same line",
-				queryNumberA, lineA.FromFile,
-				queryNumberB, lineB.FromFile,
-			)
+		if len(onlyA) > 0 && len(onlyB) == len(onlyA) && len(idsA) == len(idsB) {
+			s.PrimaryKeyDiffRatio += float64(len(onlyA)) / float64(len(idsA))
+			s.PrimaryKeyDiffRatioCount++
 		}
+	}
 
-		if isBestmatchA != isBestmatchB {
-			log.Panicf(
-				"query #%s in file %s as %s but query #%s in file %s as %s on the same line",
-				queryNumberA, lineA.FromFile, pA[1],
-				queryNumberB, lineB.FromFile, pB[1],
-			)
+	s.sumRBO += RBO(idsA, idsB, RBOPersistence)
+	if tau, ok := KendallTau(idsA, idsB); ok {
+		s.sumTau += tau
+		s.tauCount++
+	}
+	if d, ok := RankDisplacement(idsA, idsB); ok {
+		s.sumDisplacement += d
+		s.displacementCount++
+	}
+	if s.sumJaccard == nil {
+		s.sumJaccard = make(map[string]float64)
+	}
+	for _, k := range JaccardCutoffs {
+		s.sumJaccard[fmt.Sprintf("@%d", k)] += Jaccard(idsA, idsB, k)
+	}
+
+	if a == nil || b == nil {
+		s.Missing++
+		return
+	}
+
+	if a.HasTotal() && b.HasTotal() {
+		s.TotalCompared++
+		if a.Total != b.Total || a.TotalRelation != b.TotalRelation {
+			s.TotalChanged++
+		}
+		if m := max(a.Total, b.Total); m > 0 {
+			s.sumTotalDiffPct += math.Abs(float64(a.Total-b.Total)) / float64(m) * 100
 		}
+	}
 
-		if !Equal(idsA, idsB) {
-			if isBestmatchA {
-				stats.Bestmatch.Different++
-			} else {
-				stats.SortByDate.Different++
+	if a.HasScores() && b.HasScores() {
+		scoresA := make(map[string]float64)
+		for _, h := range a.FirstPage() {
+			scoresA[h.ID] = h.Score
+		}
+		for _, h := range b.FirstPage() {
+			scoreA, found := scoresA[h.ID]
+			if !found {
+				continue
 			}
+			d := math.Abs(scoreA - h.Score)
+			s.ScoresCompared++
+			s.sumScoreDiff += d
+			if m := math.Max(math.Abs(scoreA), math.Abs(h.Score)); m > 0 {
+				s.sumScoreDiffPct += d / m * 100
+			}
+		}
+	}
+}
+
+// finish computes percentages and averages once all pairs have been added.
+func (s *Stats) finish() {
+	if s.PrimaryKeyDiffRatioCount > 0 {
+		s.PrimaryKeyAvgDiffPct = (s.PrimaryKeyDiffRatio / s.PrimaryKeyDiffRatioCount) * 100
+	}
+	if s.Total > 0 {
+		s.DiffPct = (float64(s.Different) / float64(s.Total)) * 100
+		s.AvgRBO = s.sumRBO / float64(s.Total)
+		s.AvgJaccard = make(map[string]float64)
+		for k, v := range s.sumJaccard {
+			s.AvgJaccard[k] = v / float64(s.Total)
+		}
+	}
+	if s.tauCount > 0 {
+		s.AvgKendallTau = s.sumTau / float64(s.tauCount)
+	}
+	if s.displacementCount > 0 {
+		s.AvgRankDisplacement = s.sumDisplacement / float64(s.displacementCount)
+	}
+	if s.TotalCompared > 0 {
+		s.AvgTotalDiffPct = s.sumTotalDiffPct / float64(s.TotalCompared)
+	}
+	if s.ScoresCompared > 0 {
+		s.AvgScoreDiff = s.sumScoreDiff / float64(s.ScoresCompared)
+		s.AvgScoreDiffPct = s.sumScoreDiffPct / float64(s.ScoresCompared)
+	}
+}
 
-			onlyA, onlyB, _ := Diff(idsA, idsB)
+func CompareResults(fileA, fileB string) error {
+	stats := struct {
+		SortByDate Stats
+		Bestmatch  Stats
+	}{}
+
+	err := ReadFilesByQuery([]string{fileA, fileB}, func(recs []*results.Record) error {
+		a, b := recs[0], recs[1]
+		rec := present(recs)
 
-			if DebugPrint {
+		if DebugPrint {
+			idsA, idsB := ids(a), ids(b)
+			if !Equal(idsA, idsB) {
+				onlyA, onlyB, _ := Diff(idsA, idsB)
 				if len(onlyA) > 0 {
 					fmt.Printf(
-						"#%-5s %-20s IDs found only in A : %3d\n",
-						queryNumberA, lineA.FromFile, len(onlyA),
+						"#%-5d %-20s IDs found only in A : %3d\n",
+						rec.QueryNumber, filepath.Base(fileA), len(onlyA),
 					)
 				}
 				if len(onlyB) > 0 {
 					fmt.Printf(
-						"#%-5s %-20s IDs found only in B : %3d \n",
-						queryNumberA, lineB.FromFile, len(onlyB),
+						"#%-5d %-20s IDs found only in B : %3d \n",
+						rec.QueryNumber, filepath.Base(fileB), len(onlyB),
 					)
 				}
 			}
-
-			if len(onlyA) > 0 && len(onlyB) == len(onlyA) && len(idsA) == len(idsB) {
-				diff := float64(len(onlyA)) / float64(len(idsA))
-				if isBestmatchA {
-					stats.Bestmatch.PrimaryKeyDiffRatio += diff
-					stats.Bestmatch.PrimaryKeyDiffRatioCount++
-				} else {
-					stats.SortByDate.PrimaryKeyDiffRatio += diff
-					stats.SortByDate.PrimaryKeyDiffRatioCount++
-				}
-			}
-		} else {
-			if isBestmatchA {
-				stats.Bestmatch.Identical++
-			} else {
-				stats.SortByDate.Identical++
-			}
 		}
 
-		if isBestmatchA {
-			stats.Bestmatch.Total++
+		if rec.Bestmatch {
+			stats.Bestmatch.add(a, b)
 		} else {
-			stats.SortByDate.Total++
+			stats.SortByDate.add(a, b)
 		}
 
 		return nil
 	})
-
-	if stats.Bestmatch.PrimaryKeyDiffRatioCount > 0 {
-		stats.Bestmatch.PrimaryKeyAvgDiffPct = (stats.Bestmatch.PrimaryKeyDiffRatio / stats.Bestmatch.PrimaryKeyDiffRatioCount) * 100
-	}
-	if stats.SortByDate.PrimaryKeyDiffRatioCount > 0 {
-		stats.SortByDate.PrimaryKeyAvgDiffPct = (stats.SortByDate.PrimaryKeyDiffRatio / stats.SortByDate.PrimaryKeyDiffRatioCount) * 100
-	}
-	if stats.Bestmatch.Total > 0 {
-		stats.Bestmatch.DiffPct = (float64(stats.Bestmatch.Different) / float64(stats.Bestmatch.Total)) * 100
-	}
-	if stats.SortByDate.Total > 0 {
-		stats.SortByDate.DiffPct = (float64(stats.SortByDate.Different) / float64(stats.SortByDate.Total)) * 100
+	if err != nil {
+		return err
 	}
 
+	stats.Bestmatch.finish()
+	stats.SortByDate.finish()
+
 	fmt.Printf("Comparison:\n%s\n\n", data.ToPrettyJSON(stats))
+
+	return nil
 }
 
 func Equal(a, b []string) bool {
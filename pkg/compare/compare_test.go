@@ -0,0 +1,147 @@
+package compare
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/anrid/search-bench/pkg/results"
+)
+
+// writeResults writes a results file with a record for each of the given
+// query numbers, in the given order. Negative numbers are sort-by-date
+// queries.
+func writeResults(t *testing.T, name string, numbers []int) string {
+	t.Helper()
+
+	var b strings.Builder
+	for _, qn := range numbers {
+		bestmatch := qn > 0
+		if qn < 0 {
+			qn = -qn
+		}
+		fmt.Fprintf(&b, `{"v": %d, "qn": %d, "bm": %t, "total": 1, "pages": [{"hits": [{"id": "%d"}]}]}`+"\n", results.Version, qn, bestmatch, qn)
+	}
+
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestReadFilesByQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   [][]int
+		want    []string // Query number and which files have it, e.g. "2 x-x"
+		wantErr string   // Also naming the file
+		errFile int
+	}{
+		{
+			name:  "same queries",
+			files: [][]int{{1, 2, 3}, {1, 2, 3}},
+			want:  []string{"1 xx", "2 xx", "3 xx"},
+		},
+		{
+			name:  "missing queries",
+			files: [][]int{{1, 3}, {1, 2, 3, 5}, {2, 4}},
+			want:  []string{"1 xx-", "2 -xx", "3 xx-", "4 --x", "5 -x-"},
+		},
+		{
+			name:  "empty file",
+			files: [][]int{{1, 2}, {}},
+			want:  []string{"1 x-", "2 x-"},
+		},
+		{
+			name:  "query numbers with gaps",
+			files: [][]int{{2, 10, 200}, {10, 11}},
+			want:  []string{"2 x-", "10 xx", "11 -x", "200 x-"},
+		},
+		{
+			name:    "out of order",
+			files:   [][]int{{1, 2, 3}, {1, 3, 2}},
+			want:    []string{"1 xx", "2 x-"},
+			wantErr: "isn't sorted by query number (query #2 after #3)",
+			errFile: 1,
+		},
+		{
+			name:    "duplicate query",
+			files:   [][]int{{1, 1}, {1}},
+			wantErr: "isn't sorted by query number (query #1 after #1)",
+		},
+		{
+			name:    "bestmatch mismatch",
+			files:   [][]int{{1, 2}, {1, -2}},
+			want:    []string{"1 xx"},
+			wantErr: "query #2 is bestmatch=true in one file but bestmatch=false in file",
+			errFile: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var files []string
+			for i, numbers := range tt.files {
+				files = append(files, writeResults(t, fmt.Sprintf("results%d.jsonl", i), numbers))
+			}
+
+			var got []string
+			err := ReadFilesByQuery(files, func(recs []*results.Record) error {
+				found := ""
+				for _, rec := range recs {
+					if rec == nil {
+						found += "-"
+					} else {
+						found += "x"
+					}
+				}
+				got = append(got, fmt.Sprintf("%d %s", present(recs).QueryNumber, found))
+				return nil
+			})
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("got error %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr) || !strings.Contains(err.Error(), files[tt.errFile])):
+				t.Errorf("got error %v, want %q in %s", err, tt.wantErr, files[tt.errFile])
+			}
+		})
+	}
+}
+
+func TestReadFilesByQueryUnreadableLine(t *testing.T) {
+	good := writeResults(t, "a.jsonl", []int{1, 2})
+	bad := writeResults(t, "b.jsonl", []int{1})
+	f, err := os.OpenFile(bad, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("{not json\n")
+	f.Close()
+
+	err = ReadFilesByQuery([]string{good, bad}, func(recs []*results.Record) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), bad) || !strings.Contains(err.Error(), "after query #1") {
+		t.Errorf("got error %v, want the file and the last query read", err)
+	}
+}
+
+func TestReadFilesByQueryStops(t *testing.T) {
+	errStop := errors.New("stop")
+	files := []string{writeResults(t, "a.jsonl", []int{1, 2, 3})}
+
+	var calls int
+	err := ReadFilesByQuery(files, func(recs []*results.Record) error {
+		calls++
+		return errStop
+	})
+	if !errors.Is(err, errStop) || calls != 1 {
+		t.Errorf("got error %v after %d calls, want the error from the first call", err, calls)
+	}
+}
@@ -0,0 +1,418 @@
+package compare
+
+import (
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/anrid/search-bench/pkg/item"
+	"github.com/anrid/search-bench/pkg/query"
+	"github.com/anrid/search-bench/pkg/results"
+)
+
+// DrillDownArgs configures a drill-down report of the queries for which two
+// results files differ.
+type DrillDownArgs struct {
+	FileA, FileB string
+	Queries      []*query.SearchQuery // Queries used to produce legacy results files, optional
+	ReportFile   string               // Written as HTML when ending in .html or .htm, otherwise as markdown
+}
+
+// Hit is a single result in a ranked list. Score and source are only set
+// when the results file carries them.
+type Hit struct {
+	ID           string
+	Score        *float64
+	Source       *item.Item
+	SourceNoDesc *item.ItemNoDesc
+}
+
+// DrillDownRow is a single rank in the side by side view of two ranked lists.
+// `RankInB` and `RankInA` are the (one based) ranks of the same ID in the
+// other list, or 0 when the ID is only found on one side.
+type DrillDownRow struct {
+	Rank    int
+	A, B    *Hit
+	RankInB int
+	RankInA int
+}
+
+// DiffQuery holds the details of a query for which both results files differ.
+type DiffQuery struct {
+	QueryNumber int
+	Bestmatch   bool
+	Query       *query.SearchQuery // nil if neither stored in the results nor given
+	RBO         float64
+	Jaccard10   float64
+	TotalA      string // Total number of hits, if known
+	TotalB      string
+	Rows        []*DrillDownRow
+	OnlyA       []*Hit // IDs unique to file A, in ranked order
+	OnlyB       []*Hit // IDs unique to file B, in ranked order
+}
+
+// DrillDown holds all queries for which two results files differ, most
+// different (lowest RBO) first.
+type DrillDown struct {
+	A, B              string
+	Queries           int
+	BestmatchDiffs    int
+	SortByDateDiffs   int
+	HasQueries        bool
+	HasSources        bool
+	HasScores         bool
+	Diffs             []*DiffQuery
+	MissingQueryTexts int // Differing queries not found among the given queries
+}
+
+// CreateDrillDown collects the details of every query for which the two
+// results files differ.
+func CreateDrillDown(a DrillDownArgs) (*DrillDown, error) {
+	dd := &DrillDown{
+		A:          filepath.Base(a.FileA),
+		B:          filepath.Base(a.FileB),
+		HasQueries: len(a.Queries) > 0,
+	}
+
+	// Queries by their number in the queries file, which skips malformed queries
+	byNumber := make(map[int]*query.SearchQuery, len(a.Queries))
+	for i, q := range a.Queries {
+		qn := q.Number
+		if qn == 0 {
+			qn = i + 1
+		}
+		byNumber[qn] = q
+	}
+
+	err := ReadFilesByQuery([]string{a.FileA, a.FileB}, func(recs []*results.Record) error {
+		recA, recB := recs[0], recs[1]
+		rec := present(recs)
+		idsA, idsB := ids(recA), ids(recB)
+
+		dd.Queries++
+
+		if Equal(idsA, idsB) {
+			return nil
+		}
+
+		if rec.Bestmatch {
+			dd.BestmatchDiffs++
+		} else {
+			dd.SortByDateDiffs++
+		}
+
+		d := &DiffQuery{
+			QueryNumber: rec.QueryNumber,
+			Bestmatch:   rec.Bestmatch,
+			RBO:         RBO(idsA, idsB, RBOPersistence),
+			Jaccard10:   Jaccard(idsA, idsB, 10),
+			TotalA:      total(recA),
+			TotalB:      total(recB),
+		}
+
+		// Prefer the query stored in the results, if any
+		switch {
+		case rec.Query != nil:
+			d.Query = rec.Query
+		case byNumber[rec.QueryNumber] != nil:
+			d.Query = byNumber[rec.QueryNumber]
+		case dd.HasQueries:
+			dd.MissingQueryTexts++
+		}
+
+		d.Rows, d.OnlyA, d.OnlyB = sideBySide(toHits(recA), toHits(recB))
+		dd.Diffs = append(dd.Diffs, d)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(dd.Diffs, func(i, j int) bool { return dd.Diffs[i].RBO < dd.Diffs[j].RBO })
+
+	for _, d := range dd.Diffs {
+		for _, r := range d.Rows {
+			for _, h := range []*Hit{r.A, r.B} {
+				if h != nil && (h.Source != nil || h.SourceNoDesc != nil) {
+					dd.HasSources = true
+				}
+				if h != nil && h.Score != nil {
+					dd.HasScores = true
+				}
+			}
+		}
+	}
+
+	return dd, nil
+}
+
+func toHits(rec *results.Record) []*Hit {
+	if rec == nil {
+		return nil
+	}
+	hits := make([]*Hit, 0, len(rec.FirstPage()))
+	for _, h := range rec.FirstPage() {
+		hit := &Hit{ID: h.ID, Source: h.Source, SourceNoDesc: h.SourceNoDesc}
+		if rec.HasScores() {
+			score := h.Score
+			hit.Score = &score
+		}
+		hits = append(hits, hit)
+	}
+	return hits
+}
+
+// total returns the total number of hits and its relation, if known.
+func total(rec *results.Record) string {
+	switch {
+	case rec == nil:
+		return "missing"
+	case !rec.HasTotal():
+		return ""
+	case rec.TotalRelation == "gte":
+		return fmt.Sprintf("%d+", rec.Total)
+	default:
+		return strconv.FormatInt(rec.Total, 10)
+	}
+}
+
+// sideBySide lines up two ranked lists and finds the hits unique to each side.
+func sideBySide(a, b []*Hit) (rows []*DrillDownRow, onlyA, onlyB []*Hit) {
+	rankA := make(map[string]int, len(a))
+	rankB := make(map[string]int, len(b))
+	for i, h := range a {
+		rankA[h.ID] = i + 1
+	}
+	for i, h := range b {
+		rankB[h.ID] = i + 1
+	}
+
+	for i := 0; i < max(len(a), len(b)); i++ {
+		r := &DrillDownRow{Rank: i + 1}
+		if i < len(a) {
+			r.A = a[i]
+			r.RankInB = rankB[a[i].ID]
+			if r.RankInB == 0 {
+				onlyA = append(onlyA, a[i])
+			}
+		}
+		if i < len(b) {
+			r.B = b[i]
+			r.RankInA = rankA[b[i].ID]
+			if r.RankInA == 0 {
+				onlyB = append(onlyB, b[i])
+			}
+		}
+		rows = append(rows, r)
+	}
+
+	return
+}
+
+// WriteDrillDown writes a drill-down report of the queries for which two
+// results files differ.
+func WriteDrillDown(a DrillDownArgs) error {
+	dd, err := CreateDrillDown(a)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(a.ReportFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(a.ReportFile)) {
+	case ".html", ".htm":
+		err = dd.WriteHTML(f)
+	default:
+		err = dd.WriteMarkdown(f)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Wrote drill-down report of %d differing queries to %s\n", len(dd.Diffs), a.ReportFile)
+	if dd.MissingQueryTexts > 0 {
+		fmt.Printf("WARNING: %d differing queries not found in the queries file, was it the one used to produce the results?\n", dd.MissingQueryTexts)
+	}
+
+	return f.Close()
+}
+
+var templateFuncs = map[string]interface{}{
+	"statuses": func(q *query.SearchQuery) string {
+		var s []string
+		for _, st := range q.Statuses {
+			s = append(s, st.String())
+		}
+		return strings.Join(s, ", ")
+	},
+	"filters": func(q *query.SearchQuery) string {
+		var s []string
+		switch {
+		case q.PriceMin > 0 && q.PriceMax > 0:
+			s = append(s, fmt.Sprintf("price %d-%d", q.PriceMin, q.PriceMax))
+		case q.PriceMin > 0:
+			s = append(s, fmt.Sprintf("price >= %d", q.PriceMin))
+		case q.PriceMax > 0:
+			s = append(s, fmt.Sprintf("price <= %d", q.PriceMax))
+		}
+		for _, c := range q.Conditions {
+			s = append(s, "condition "+c.String())
+		}
+		for _, kw := range q.RawExcludeKeywords {
+			s = append(s, "excluding "+kw)
+		}
+		if q.Sort != "" {
+			s = append(s, "sort "+q.Sort)
+		}
+		return strings.Join(s, ", ")
+	},
+	"categories": func(q *query.SearchQuery) string {
+		var s []string
+		for _, id := range q.CategoryIDs {
+			s = append(s, strconv.FormatInt(id, 10))
+		}
+		return strings.Join(s, ", ")
+	},
+	"score": func(h *Hit) string {
+		if h == nil || h.Score == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*h.Score, 'f', 4, 64)
+	},
+	"sort": func(bestmatch bool) string {
+		if bestmatch {
+			return "bestmatch"
+		}
+		return "sort-by-date"
+	},
+	"source": func(h *Hit) string {
+		switch {
+		case h == nil:
+			return ""
+		case h.Source != nil:
+			return fmt.Sprintf("%s (%s, category %d)", h.Source.Name, h.Source.Status, h.Source.CategoryID)
+		case h.SourceNoDesc != nil:
+			s := h.SourceNoDesc
+			return fmt.Sprintf("%s (%s, category %d, price %d, %s)", s.Name, s.Status, s.CategoryID, s.Price, s.ItemCondition)
+		}
+		return ""
+	},
+	"md": markdownEscaper.Replace,
+	"mdcell": func(h *Hit, otherRank, rank int) string {
+		switch {
+		case h == nil:
+			return ""
+		case otherRank == 0:
+			return "**" + markdownEscaper.Replace(h.ID) + "**"
+		case otherRank != rank:
+			return fmt.Sprintf("%s → #%d", markdownEscaper.Replace(h.ID), otherRank)
+		default:
+			return markdownEscaper.Replace(h.ID)
+		}
+	},
+}
+
+var markdownEscaper = strings.NewReplacer(`\`, `\\`, "|", `\|`, "*", `\*`, "_", `\_`, "`", "\\`", "<", "&lt;", ">", "&gt;")
+
+// WriteMarkdown writes the drill-down report as markdown.
+func (dd *DrillDown) WriteMarkdown(w io.Writer) error {
+	t := texttemplate.Must(texttemplate.New("drilldown.md").Funcs(templateFuncs).Parse(markdownTemplate))
+	return t.Execute(w, dd)
+}
+
+// WriteHTML writes the drill-down report as a standalone HTML page.
+func (dd *DrillDown) WriteHTML(w io.Writer) error {
+	t := htmltemplate.Must(htmltemplate.New("drilldown.html").Funcs(templateFuncs).Parse(htmlTemplate))
+	return t.Execute(w, dd)
+}
+
+const markdownTemplate = `# {{md .A}} vs {{md .B}}
+
+{{len .Diffs}} of {{.Queries}} queries differ ({{.BestmatchDiffs}} bestmatch, {{.SortByDateDiffs}} sort-by-date), most different first.
+IDs in **bold** are only found on one side, "→ #n" is the rank of the same ID on the other side.
+{{range .Diffs}}
+## Query #{{.QueryNumber}} ({{sort .Bestmatch}})
+{{with .Query}}
+- Keyword: {{if .RawKeyword}}{{md .RawKeyword}} (tokenized: {{md .Keyword}}){{else}}none{{end}}
+- Categories: {{with categories .}}{{.}}{{else}}any{{end}}
+- Statuses: {{with statuses .}}{{.}}{{else}}any{{end}}
+{{- with filters .}}
+- Filters: {{md .}}
+{{- end}}
+{{- end}}
+- RBO: {{printf "%.4f" .RBO}}, Jaccard@10: {{printf "%.4f" .Jaccard10}}
+{{- if or .TotalA .TotalB}}
+- Total hits: {{with .TotalA}}{{.}}{{else}}unknown{{end}} in {{md $.A}}, {{with .TotalB}}{{.}}{{else}}unknown{{end}} in {{md $.B}}
+{{- end}}
+- Only in {{md $.A}} ({{len .OnlyA}}): {{range $i, $h := .OnlyA}}{{if $i}}, {{end}}{{md $h.ID}}{{end}}
+- Only in {{md $.B}} ({{len .OnlyB}}): {{range $i, $h := .OnlyB}}{{if $i}}, {{end}}{{md $h.ID}}{{end}}
+
+| # | {{md $.A}} |{{if $.HasSources}} item |{{end}}{{if $.HasScores}} score |{{end}} {{md $.B}} |{{if $.HasSources}} item |{{end}}{{if $.HasScores}} score |{{end}}
+|--:|---|{{if $.HasSources}}---|{{end}}{{if $.HasScores}}--:|{{end}}---|{{if $.HasSources}}---|{{end}}{{if $.HasScores}}--:|{{end}}
+{{range .Rows -}}
+| {{.Rank}} | {{mdcell .A .RankInB .Rank}} |{{if $.HasSources}} {{md (source .A)}} |{{end}}{{if $.HasScores}} {{score .A}} |{{end}} {{mdcell .B .RankInA .Rank}} |{{if $.HasSources}} {{md (source .B)}} |{{end}}{{if $.HasScores}} {{score .B}} |{{end}}
+{{end}}{{end}}`
+
+const htmlTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.A}} vs {{.B}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+td.rank, td.score { text-align: right; }
+.only { background: #fdd; font-weight: bold; }
+.moved { color: #888; }
+</style>
+</head>
+<body>
+<h1>{{.A}} vs {{.B}}</h1>
+<p>{{len .Diffs}} of {{.Queries}} queries differ ({{.BestmatchDiffs}} bestmatch, {{.SortByDateDiffs}} sort-by-date), most different first.
+Highlighted IDs are only found on one side, "→ #n" is the rank of the same ID on the other side.</p>
+{{range .Diffs}}
+<h2 id="q{{.QueryNumber}}">Query #{{.QueryNumber}} ({{sort .Bestmatch}})</h2>
+<ul>
+{{- with .Query}}
+<li>Keyword: {{if .RawKeyword}}{{.RawKeyword}} (tokenized: {{.Keyword}}){{else}}none{{end}}</li>
+<li>Categories: {{with categories .}}{{.}}{{else}}any{{end}}</li>
+<li>Statuses: {{with statuses .}}{{.}}{{else}}any{{end}}</li>
+{{- with filters .}}
+<li>Filters: {{.}}</li>
+{{- end}}
+{{- end}}
+<li>RBO: {{printf "%.4f" .RBO}}, Jaccard@10: {{printf "%.4f" .Jaccard10}}</li>
+{{- if or .TotalA .TotalB}}
+<li>Total hits: {{with .TotalA}}{{.}}{{else}}unknown{{end}} in {{$.A}}, {{with .TotalB}}{{.}}{{else}}unknown{{end}} in {{$.B}}</li>
+{{- end}}
+<li>Only in {{$.A}} ({{len .OnlyA}}): {{range $i, $h := .OnlyA}}{{if $i}}, {{end}}{{$h.ID}}{{end}}</li>
+<li>Only in {{$.B}} ({{len .OnlyB}}): {{range $i, $h := .OnlyB}}{{if $i}}, {{end}}{{$h.ID}}{{end}}</li>
+</ul>
+<table>
+<tr><th>#</th><th>{{$.A}}</th>{{if $.HasSources}}<th>item</th>{{end}}{{if $.HasScores}}<th>score</th>{{end}}<th>{{$.B}}</th>{{if $.HasSources}}<th>item</th>{{end}}{{if $.HasScores}}<th>score</th>{{end}}</tr>
+{{- range .Rows}}
+<tr><td class="rank">{{.Rank}}</td>
+{{- if .A}}<td{{if eq .RankInB 0}} class="only"{{end}}>{{.A.ID}}{{if and (ne .RankInB 0) (ne .RankInB .Rank)}} <span class="moved">→ #{{.RankInB}}</span>{{end}}</td>{{else}}<td></td>{{end}}
+{{- if $.HasSources}}<td>{{source .A}}</td>{{end}}
+{{- if $.HasScores}}<td class="score">{{score .A}}</td>{{end}}
+{{- if .B}}<td{{if eq .RankInA 0}} class="only"{{end}}>{{.B.ID}}{{if and (ne .RankInA 0) (ne .RankInA .Rank)}} <span class="moved">→ #{{.RankInA}}</span>{{end}}</td>{{else}}<td></td>{{end}}
+{{- if $.HasSources}}<td>{{source .B}}</td>{{end}}
+{{- if $.HasScores}}<td class="score">{{score .B}}</td>{{end}}</tr>
+{{- end}}
+</table>
+{{end}}
+</body>
+</html>
+`
@@ -0,0 +1,210 @@
+package compare
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/anrid/search-bench/pkg/results"
+)
+
+// PairStats holds the comparison of two results files.
+type PairStats struct {
+	A, B       string
+	Bestmatch  Stats
+	SortByDate Stats
+}
+
+// Matrix holds the pairwise comparison of any number of results files.
+type Matrix struct {
+	Files             []string
+	Pairs             map[[2]int]*PairStats // Keyed by file indexes (i < j)
+	Queries           int
+	BestmatchQueries  int
+	SortByDateQueries int
+	AllAgree          int
+	AllDisagree       []int // Query numbers where no two files have the same results
+}
+
+// CompareMany compares every pair of the given results files, line by line,
+// and finds the queries where all files disagree.
+func CompareMany(files []string) (*Matrix, error) {
+	m := &Matrix{
+		Files: files,
+		Pairs: make(map[[2]int]*PairStats),
+	}
+	for i := range files {
+		for j := i + 1; j < len(files); j++ {
+			m.Pairs[[2]int{i, j}] = &PairStats{A: filepath.Base(files[i]), B: filepath.Base(files[j])}
+		}
+	}
+
+	err := ReadFilesByQuery(files, func(recs []*results.Record) error {
+		rec := present(recs)
+
+		m.Queries++
+		if rec.Bestmatch {
+			m.BestmatchQueries++
+		} else {
+			m.SortByDateQueries++
+		}
+
+		var identicalPairs int
+		for i := range recs {
+			for j := i + 1; j < len(recs); j++ {
+				p := m.Pairs[[2]int{i, j}]
+				if rec.Bestmatch {
+					p.Bestmatch.add(recs[i], recs[j])
+				} else {
+					p.SortByDate.add(recs[i], recs[j])
+				}
+				if Equal(ids(recs[i]), ids(recs[j])) {
+					identicalPairs++
+				}
+			}
+		}
+
+		switch identicalPairs {
+		case 0:
+			m.AllDisagree = append(m.AllDisagree, rec.QueryNumber)
+		case len(m.Pairs):
+			m.AllAgree++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range m.Pairs {
+		p.Bestmatch.finish()
+		p.SortByDate.finish()
+	}
+
+	return m, nil
+}
+
+// Print prints matrices of the share of differing results and overlap
+// metrics for bestmatch and sort-by-date queries, followed by the queries
+// where all files disagree.
+func (m *Matrix) Print() {
+	fmt.Printf(
+		"Compared %d queries (%d bestmatch, %d sort-by-date) across %d files\n\n",
+		m.Queries, m.BestmatchQueries, m.SortByDateQueries, len(m.Files),
+	)
+
+	metrics := []matrixMetric{
+		{"% of queries with different results", func(s *Stats) float64 { return s.DiffPct }, false},
+		{"% of primary keys different on average", func(s *Stats) float64 { return s.PrimaryKeyAvgDiffPct }, false},
+		{"Average rank-biased overlap", func(s *Stats) float64 { return s.AvgRBO }, false},
+		{"Average Jaccard@10", func(s *Stats) float64 { return s.AvgJaccard["@10"] }, false},
+	}
+
+	// Hit counts and scores are only known in the JSON lines results format
+	var totals, scores bool
+	for _, p := range m.Pairs {
+		totals = totals || p.Bestmatch.TotalCompared > 0 || p.SortByDate.TotalCompared > 0
+		scores = scores || p.Bestmatch.ScoresCompared > 0
+	}
+	if totals {
+		metrics = append(metrics, matrixMetric{"% of queries with a different total number of hits", func(s *Stats) float64 {
+			if s.TotalCompared == 0 {
+				return math.NaN()
+			}
+			return float64(s.TotalChanged) / float64(s.TotalCompared) * 100
+		}, false})
+	}
+	if scores {
+		metrics = append(metrics, matrixMetric{"Average score difference in %", func(s *Stats) float64 {
+			if s.ScoresCompared == 0 {
+				return math.NaN()
+			}
+			return s.AvgScoreDiffPct
+		}, true})
+	}
+
+	for _, group := range []string{"bestmatch", "sort-by-date"} {
+		for _, metric := range metrics {
+			if metric.bestmatchOnly && group != "bestmatch" {
+				continue
+			}
+			m.printMatrix(metric.title+" ("+group+")", func(p *PairStats) float64 {
+				if group == "bestmatch" {
+					return metric.value(&p.Bestmatch)
+				}
+				return metric.value(&p.SortByDate)
+			})
+		}
+	}
+
+	fmt.Printf("All files agree on %d queries\n", m.AllAgree)
+	fmt.Printf("All files disagree on %d queries", len(m.AllDisagree))
+	if len(m.AllDisagree) > 0 {
+		var shown []string
+		for _, qn := range m.AllDisagree {
+			if len(shown) == 50 {
+				break
+			}
+			shown = append(shown, strconv.Itoa(qn))
+		}
+		fmt.Printf(": #%s", strings.Join(shown, ", #"))
+		if len(shown) < len(m.AllDisagree) {
+			fmt.Printf(" ..")
+		}
+	}
+	fmt.Printf("\n\n")
+}
+
+type matrixMetric struct {
+	title         string
+	value         func(s *Stats) float64
+	bestmatchOnly bool
+}
+
+func (m *Matrix) printMatrix(title string, value func(p *PairStats) float64) {
+	var names []string
+	width := 10
+	for _, f := range m.Files {
+		name := filepath.Base(f)
+		names = append(names, name)
+		width = max(width, len(name))
+	}
+
+	fmt.Printf("%s:\n", title)
+
+	fmt.Printf("%-*s", width, "")
+	for _, name := range names {
+		fmt.Printf("  %*s", width, name)
+	}
+	fmt.Println()
+
+	for i, name := range names {
+		fmt.Printf("%-*s", width, name)
+		for j := range names {
+			var cell string
+			switch {
+			case i == j:
+				cell = "-"
+			case i < j:
+				cell = formatCell(value(m.Pairs[[2]int{i, j}]))
+			default:
+				cell = formatCell(value(m.Pairs[[2]int{j, i}]))
+			}
+			fmt.Printf("  %*s", width, cell)
+		}
+		fmt.Println()
+	}
+	fmt.Println()
+}
+
+// formatCell formats a value in a matrix, where NaN means the value isn't
+// known, e.g. hit counts in legacy results files.
+func formatCell(v float64) string {
+	if math.IsNaN(v) {
+		return "n/a"
+	}
+	return fmt.Sprintf("%.2f", v)
+}
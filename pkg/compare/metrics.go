@@ -0,0 +1,160 @@
+package compare
+
+import (
+	"math"
+)
+
+const (
+	// RBOPersistence is the persistence (p) used for rank-biased overlap. With
+	// p = 0.9 the top 10 results account for ~86% of the score.
+	RBOPersistence = 0.9
+)
+
+// JaccardCutoffs are the depths at which Jaccard similarity is computed: the
+// top 10, the first 40 (the first page on mobile) and the full first page.
+var JaccardCutoffs = []int{10, 40, 120}
+
+// RBO returns the (extrapolated) rank-biased overlap of two ranked lists of
+// unique IDs, from 0 (disjoint) to 1 (identical). Unlike set based metrics it
+// weighs differences at the top of the lists more heavily, and it handles
+// lists of different lengths.
+func RBO(a, b []string, p float64) float64 {
+	s, l := a, b
+	if len(s) > len(l) {
+		s, l = l, s
+	}
+	if len(l) == 0 {
+		return 1
+	}
+	if len(s) == 0 {
+		return 0
+	}
+
+	seenS := make(map[string]bool)
+	seenL := make(map[string]bool)
+
+	// overlap[d] is the number of IDs found in both lists at depth d
+	overlap := make([]float64, len(l)+1)
+	var sum float64
+
+	for i := 0; i < len(l); i++ {
+		d := i + 1
+		x := l[i]
+		overlap[d] = overlap[d-1]
+
+		if i < len(s) && s[i] == x {
+			overlap[d]++
+		} else {
+			seenL[x] = true
+			if seenS[x] {
+				overlap[d]++
+			}
+			if i < len(s) {
+				y := s[i]
+				seenS[y] = true
+				if seenL[y] {
+					overlap[d]++
+				}
+			}
+		}
+
+		sum += overlap[d] / float64(d) * math.Pow(p, float64(d))
+	}
+
+	// Extrapolate the overlap of the shorter list beyond its end
+	xs := overlap[len(s)]
+	for d := len(s) + 1; d <= len(l); d++ {
+		sum += xs * float64(d-len(s)) / float64(d*len(s)) * math.Pow(p, float64(d))
+	}
+
+	xl := overlap[len(l)]
+	tail := ((xl-xs)/float64(len(l)) + xs/float64(len(s))) * math.Pow(p, float64(len(l)))
+
+	return (1-p)/p*sum + tail
+}
+
+// KendallTau returns the Kendall rank correlation (tau-a) of the IDs found in
+// both lists, from -1 (reversed) to 1 (same order). `ok` is false when fewer
+// than 2 IDs are shared.
+func KendallTau(a, b []string) (tau float64, ok bool) {
+	rankB := ranks(b)
+
+	// Ranks in b of the shared IDs, in the order of a
+	var shared []int
+	for _, id := range a {
+		if r, found := rankB[id]; found {
+			shared = append(shared, r)
+		}
+	}
+
+	n := len(shared)
+	if n < 2 {
+		return 0, false
+	}
+
+	var concordant, discordant int
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			if shared[i] < shared[j] {
+				concordant++
+			} else {
+				discordant++
+			}
+		}
+	}
+
+	return float64(concordant-discordant) / float64(n*(n-1)/2), true
+}
+
+// Jaccard returns the Jaccard similarity of the top `k` IDs of both lists.
+func Jaccard(a, b []string, k int) float64 {
+	a, b = top(a, k), top(b, k)
+	if len(a) == 0 && len(b) == 0 {
+		return 1
+	}
+
+	_, _, both := Diff(a, b)
+	union := len(a) + len(b) - len(both)
+
+	return float64(len(both)) / float64(union)
+}
+
+// RankDisplacement returns the average absolute difference in rank of the IDs
+// found in both lists. `ok` is false when no IDs are shared.
+func RankDisplacement(a, b []string) (avg float64, ok bool) {
+	rankB := ranks(b)
+
+	var sum, n int
+	for i, id := range a {
+		if r, found := rankB[id]; found {
+			d := i - r
+			if d < 0 {
+				d = -d
+			}
+			sum += d
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, false
+	}
+
+	return float64(sum) / float64(n), true
+}
+
+func ranks(ids []string) map[string]int {
+	m := make(map[string]int, len(ids))
+	for i, id := range ids {
+		if _, found := m[id]; !found {
+			m[id] = i
+		}
+	}
+	return m
+}
+
+func top(ids []string, k int) []string {
+	if len(ids) > k {
+		return ids[:k]
+	}
+	return ids
+}
@@ -0,0 +1,115 @@
+package compare
+
+import (
+	"math"
+	"testing"
+)
+
+func list(s ...string) []string { return s }
+
+func approx(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestRBO(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []string
+		want float64
+	}{
+		{"identical", list("a", "b", "c"), list("a", "b", "c"), 1},
+		{"disjoint", list("a", "b"), list("c", "d"), 0},
+		{"both empty", nil, nil, 1},
+		{"one empty", list("a"), nil, 0},
+		{"top 2 swapped", list("a", "b"), list("b", "a"), 0.9},
+		{"prefix of the longer list", list("a"), list("a", "b"), 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RBO(tt.a, tt.b, RBOPersistence); !approx(got, tt.want) {
+				t.Errorf("RBO(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+			if got := RBO(tt.b, tt.a, RBOPersistence); !approx(got, tt.want) {
+				t.Errorf("RBO(%v, %v) = %v, want %v", tt.b, tt.a, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRBOWeighsTopRanksMore(t *testing.T) {
+	a := list("a", "b", "c", "d", "e")
+	top := RBO(a, list("b", "a", "c", "d", "e"), RBOPersistence)
+	bottom := RBO(a, list("a", "b", "c", "e", "d"), RBOPersistence)
+	if top >= bottom {
+		t.Errorf("swapping the top 2 gives RBO %v, swapping the bottom 2 gives %v", top, bottom)
+	}
+}
+
+func TestKendallTau(t *testing.T) {
+	tests := []struct {
+		name   string
+		a, b   []string
+		want   float64
+		wantOK bool
+	}{
+		{"same order", list("a", "b", "c"), list("a", "b", "c"), 1, true},
+		{"reversed", list("a", "b", "c"), list("c", "b", "a"), -1, true},
+		{"one swap", list("a", "b", "c"), list("a", "c", "b"), 1.0 / 3, true},
+		{"unshared IDs are ignored", list("a", "x", "b"), list("a", "b", "y"), 1, true},
+		{"one shared ID", list("a", "b"), list("a", "c"), 0, false},
+		{"empty", nil, list("a"), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := KendallTau(tt.a, tt.b)
+			if ok != tt.wantOK || !approx(got, tt.want) {
+				t.Errorf("KendallTau(%v, %v) = %v, %v, want %v, %v", tt.a, tt.b, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestJaccard(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []string
+		k    int
+		want float64
+	}{
+		{"identical", list("a", "b"), list("b", "a"), 10, 1},
+		{"disjoint", list("a"), list("b"), 10, 0},
+		{"half shared", list("a", "b", "c"), list("a", "b", "d"), 3, 0.5},
+		{"cut off at k", list("a", "b", "c"), list("a", "b", "d"), 2, 1},
+		{"both empty", nil, nil, 10, 1},
+		{"one empty", list("a"), nil, 10, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Jaccard(tt.a, tt.b, tt.k); !approx(got, tt.want) {
+				t.Errorf("Jaccard(%v, %v, %d) = %v, want %v", tt.a, tt.b, tt.k, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRankDisplacement(t *testing.T) {
+	tests := []struct {
+		name   string
+		a, b   []string
+		want   float64
+		wantOK bool
+	}{
+		{"same order", list("a", "b"), list("a", "b"), 0, true},
+		{"reversed", list("a", "b", "c"), list("c", "b", "a"), 4.0 / 3, true},
+		{"shifted by one", list("a", "b"), list("x", "a", "b"), 1, true},
+		{"disjoint", list("a"), list("b"), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := RankDisplacement(tt.a, tt.b)
+			if ok != tt.wantOK || !approx(got, tt.want) {
+				t.Errorf("RankDisplacement(%v, %v) = %v, %v, want %v, %v", tt.a, tt.b, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
@@ -2,8 +2,9 @@ package data
 
 import (
 	"encoding/json"
-	"log"
+	"fmt"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/bytedance/sonic"
@@ -11,47 +12,46 @@ import (
 	"github.com/ikawaha/kagome/v2/tokenizer"
 )
 
-var _t *tokenizer.Tokenizer
+var (
+	_t     *tokenizer.Tokenizer
+	_tErr  error
+	_tOnce sync.Once
+)
 
-func KagomeV2Tokenizer() *tokenizer.Tokenizer {
-	if _t == nil {
-		var err error
-		_t, err = tokenizer.New(ipa.Dict(), tokenizer.OmitBosEos())
-		if err != nil {
-			log.Panic(err)
+// KagomeV2Tokenizer returns a shared tokenizer, which is safe for concurrent
+// use. The dictionary is loaded on the first call.
+func KagomeV2Tokenizer() (*tokenizer.Tokenizer, error) {
+	_tOnce.Do(func() {
+		_t, _tErr = tokenizer.New(ipa.Dict(), tokenizer.OmitBosEos())
+		if _tErr != nil {
+			_tErr = fmt.Errorf("could not load Kagome tokenizer: %w", _tErr)
 		}
-	}
-	return _t
+	})
+	return _t, _tErr
 }
 
-func ToJSON(o interface{}) []byte {
-	b, err := sonic.Marshal(o)
-	if err != nil {
-		log.Panic(err)
-	}
-	return b
+func ToJSON(o interface{}) ([]byte, error) {
+	return sonic.Marshal(o)
 }
 
-func ToPrettyJSON(o interface{}) []byte {
+// ToPrettyJSON returns indented JSON for printing, or the error if the value
+// can't be marshalled (e.g. a NaN float).
+func ToPrettyJSON(o interface{}) string {
 	b, err := json.MarshalIndent(o, "", "  ")
 	if err != nil {
-		log.Panic(err)
+		return fmt.Sprintf("<%s>", err)
 	}
-	return b
+	return string(b)
 }
 
-func ToUnixTimestamp(s string) int64 {
+func ToUnixTimestamp(s string) (int64, error) {
 	t, err := time.Parse("2006-01-02 15:04:05 MST", s)
 	if err != nil {
-		log.Panic(err)
+		return 0, err
 	}
-	return t.UnixMilli()
+	return t.UnixMilli(), nil
 }
 
-func ToInt64(s string) int64 {
-	i, err := strconv.ParseInt(s, 10, 64)
-	if err != nil {
-		log.Panic(err)
-	}
-	return i
+func ToInt64(s string) (int64, error) {
+	return strconv.ParseInt(s, 10, 64)
 }
@@ -0,0 +1,152 @@
+package elastic
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/anrid/search-bench/pkg/engine"
+)
+
+// AnalyzerName is the name of the analyzer added to indexes for analysis
+// modes where ES analyzes text itself.
+const AnalyzerName = "bench_ja"
+
+// analysisVars are the index variables used by analysis modes rather than
+// by index templates.
+var analysisVars = map[string]bool{
+	engine.IndexVarAnalysis:    true,
+	"kuromoji_mode":            true,
+	"kuromoji_user_dictionary": true,
+	"kuromoji_filters":         true,
+	"ngram_min":                true,
+	"ngram_max":                true,
+}
+
+// SupportsAnalysis returns true for all analysis modes. Note that the
+// `kuromoji` mode requires the analysis-kuromoji plugin.
+func (e *Engine) SupportsAnalysis(mode string) bool {
+	switch mode {
+	case engine.AnalysisKagome, engine.AnalysisKuromoji, engine.AnalysisNgram, engine.AnalysisCJKBigram:
+		return true
+	}
+	return false
+}
+
+// analysisSettings returns the analysis settings for the given analysis mode
+// (nil for `AnalysisKagome`), defining the `AnalyzerName` analyzer.
+func analysisSettings(vars engine.IndexVars) (Map, error) {
+	switch mode := vars.Analysis(); mode {
+	case engine.AnalysisKagome:
+		// Text is tokenized with Kagome and indexed as whitespace separated
+		// tokens, which the standard analyzer handles
+		return nil, nil
+
+	case engine.AnalysisKuromoji:
+		tokenizer := Map{"type": "kuromoji_tokenizer", "mode": vars["kuromoji_mode"]}
+		if dict := vars["kuromoji_user_dictionary"]; dict != "" {
+			// Relative to the ES config dir
+			tokenizer["user_dictionary"] = dict
+		}
+		return Map{
+			"tokenizer": Map{"bench_kuromoji": tokenizer},
+			"analyzer": Map{AnalyzerName: Map{
+				"type":      "custom",
+				"tokenizer": "bench_kuromoji",
+				"filter":    splitList(vars["kuromoji_filters"]),
+			}},
+		}, nil
+
+	case engine.AnalysisNgram:
+		min, err := strconv.Atoi(vars["ngram_min"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid ngram_min '%s'", vars["ngram_min"])
+		}
+		max, err := strconv.Atoi(vars["ngram_max"])
+		if err != nil || max < min {
+			return nil, fmt.Errorf("invalid ngram_max '%s'", vars["ngram_max"])
+		}
+		return Map{
+			"tokenizer": Map{"bench_ngram": Map{
+				"type":        "ngram",
+				"min_gram":    min,
+				"max_gram":    max,
+				"token_chars": []string{"letter", "digit"},
+			}},
+			"analyzer": Map{AnalyzerName: Map{
+				"type":      "custom",
+				"tokenizer": "bench_ngram",
+				"filter":    []string{"cjk_width", "lowercase"},
+			}},
+		}, nil
+
+	case engine.AnalysisCJKBigram:
+		return Map{
+			"analyzer": Map{AnalyzerName: Map{
+				"type":      "custom",
+				"tokenizer": "standard",
+				"filter":    []string{"cjk_width", "lowercase", "cjk_bigram"},
+			}},
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported analysis mode '%s' (supported: %s)", mode, strings.Join(engine.AnalysisModes, ", "))
+	}
+}
+
+// applyAnalysis adds the analysis settings for the analysis mode to the
+// index mappings and settings, and analyzes all text fields that don't set
+// an analyzer of their own with `AnalyzerName`.
+func applyAnalysis(body Map, vars engine.IndexVars) error {
+	analysis, err := analysisSettings(vars)
+	if err != nil || analysis == nil {
+		return err
+	}
+
+	index := subMap(subMap(body, "settings"), "index")
+	if _, found := index["analysis"]; found {
+		return fmt.Errorf("index template already defines analysis settings, which isn't supported with analysis mode '%s'", vars.Analysis())
+	}
+	index["analysis"] = analysis
+
+	if vars.Analysis() == engine.AnalysisNgram {
+		min, _ := strconv.Atoi(vars["ngram_min"])
+		max, _ := strconv.Atoi(vars["ngram_max"])
+		if max-min > 1 {
+			index["max_ngram_diff"] = max - min
+		}
+	}
+
+	props := subMap(subMap(body, "mappings"), "properties")
+	for _, p := range props {
+		field, ok := p.(Map)
+		if !ok || field["type"] != "text" {
+			continue
+		}
+		if _, found := field["analyzer"]; !found {
+			field["analyzer"] = AnalyzerName
+		}
+	}
+
+	return nil
+}
+
+// subMap returns the map at the given key, adding it if missing.
+func subMap(m Map, key string) Map {
+	sub, ok := m[key].(Map)
+	if !ok {
+		sub = make(Map)
+		m[key] = sub
+	}
+	return sub
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
@@ -0,0 +1,160 @@
+package elastic
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/anrid/search-bench/pkg/engine"
+	"github.com/bytedance/sonic"
+)
+
+const (
+	DefaultBulkBackoff = 100 * time.Millisecond
+)
+
+// BulkOp is a single action in a bulk request, e.g. indexing a document.
+type BulkOp struct {
+	Action string // "index" or "update"
+	Index  string
+	ID     string
+	Doc    interface{}
+
+	lastError *BulkItem // Set when the document was rejected
+}
+
+type BulkResponse struct {
+	Took   int64                  `json:"took"`
+	Errors bool                   `json:"errors"`
+	Items  []map[string]*BulkItem `json:"items"` // Keyed by action, e.g. "index"
+}
+
+type BulkItem struct {
+	Index  string `json:"_index"`
+	ID     string `json:"_id"`
+	Status int    `json:"status"`
+	Error  *struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error"`
+}
+
+// IsRejected returns true if the document was rejected because ES was
+// overloaded, in which case it's safe to retry.
+func (i *BulkItem) IsRejected() bool {
+	return i.Status == http.StatusTooManyRequests ||
+		(i.Error != nil && i.Error.Type == "es_rejected_execution_exception")
+}
+
+// Bulk sends a bulk request and checks the result of every document. Rejected
+// documents are retried up to `BulkRetries` times with exponential backoff
+// and jitter, while documents that fail for other reasons (e.g. a mapping
+// error) are returned as permanent failures. An error is only returned when
+// the request as a whole fails.
+func (c *Client) Bulk(ops []*BulkOp) (*engine.BulkResult, error) {
+	res := new(engine.BulkResult)
+
+	for attempt := 0; ; attempt++ {
+		var docs []interface{}
+		for _, op := range ops {
+			docs = append(docs, Map{op.Action: Map{"_index": op.Index, "_id": op.ID}})
+			docs = append(docs, op.Doc)
+		}
+
+		bulk, err := BuildBulkBody(docs...)
+		if err != nil {
+			return res, err
+		}
+		if len(bulk) > 10_000_000 {
+			fmt.Printf("WARNING: bulk index body is %d bytes large!\n", len(bulk))
+		}
+
+		body, code, err := c.Call(http.MethodPost, c.URL+"/_bulk", bulk)
+		if err != nil {
+			return res, err
+		}
+
+		var retry []*BulkOp
+
+		switch code {
+		case http.StatusOK:
+			br := new(BulkResponse)
+			err = sonic.Unmarshal(body, br)
+			if err != nil {
+				return res, fmt.Errorf("could not parse bulk response: %w", err)
+			}
+			if len(br.Items) != len(ops) {
+				return res, fmt.Errorf("expected %d items in bulk response, got %d", len(ops), len(br.Items))
+			}
+
+			for n, it := range br.Items {
+				op := ops[n]
+				i := it[op.Action]
+				switch {
+				case i == nil:
+					return res, fmt.Errorf("missing '%s' result for document %s in bulk response", op.Action, op.ID)
+				case i.Error == nil && i.Status < 300:
+					res.Indexed++
+				case i.IsRejected():
+					op.lastError = i
+					retry = append(retry, op)
+				default:
+					res.Failures = append(res.Failures, bulkFailure(op, i))
+				}
+			}
+
+		case http.StatusTooManyRequests:
+			// The whole request was rejected
+			for _, op := range ops {
+				op.lastError = &BulkItem{Index: op.Index, ID: op.ID, Status: code}
+			}
+			retry = ops
+
+		default:
+			return res, fmt.Errorf("got bad HTTP status code %d : %.500s", code, body)
+		}
+
+		if len(retry) == 0 {
+			return res, nil
+		}
+
+		if attempt == 0 {
+			// Retries only hold documents rejected before, so each rejected
+			// document is counted once however many attempts it takes
+			res.Rejections += len(retry)
+		}
+
+		if attempt >= c.BulkRetries {
+			for _, op := range retry {
+				f := bulkFailure(op, op.lastError)
+				f.Reason = fmt.Sprintf("still rejected after %d retries: %s", c.BulkRetries, f.Reason)
+				res.Failures = append(res.Failures, f)
+			}
+			return res, nil
+		}
+
+		backoff := engine.Backoff(c.BulkBackoff, attempt)
+
+		if DebugPrint {
+			fmt.Printf("Retrying %d rejected documents in %s\n", len(retry), backoff)
+		}
+
+		time.Sleep(backoff)
+		res.Retries++
+		ops = retry
+	}
+}
+
+func bulkFailure(op *BulkOp, i *BulkItem) *engine.BulkFailure {
+	f := &engine.BulkFailure{
+		Index:  op.Index,
+		ID:     op.ID,
+		Status: i.Status,
+		Doc:    op.Doc,
+	}
+	if i.Error != nil {
+		f.Type = i.Error.Type
+		f.Reason = i.Error.Reason
+	}
+	return f
+}
@@ -0,0 +1,181 @@
+package elastic
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anrid/search-bench/pkg/engine"
+)
+
+// bulkServer answers bulk requests per document: documents in `reject` are
+// rejected with 429 in that many requests, documents in `fail` fail with a
+// mapping error, and the others are indexed. Requests listed in `status` fail
+// as a whole with that HTTP status code instead.
+type bulkServer struct {
+	status   map[int]int
+	reject   map[string]int
+	fail     map[string]bool
+	requests [][]string // IDs sent in each request
+}
+
+func (s *bulkServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var ids []string
+	lines := bufio.NewScanner(r.Body)
+	for n := 0; lines.Scan(); n++ {
+		if n%2 == 1 || len(lines.Bytes()) == 0 {
+			continue // Document source or the final newline
+		}
+		var action map[string]struct {
+			ID string `json:"_id"`
+		}
+		if err := json.Unmarshal(lines.Bytes(), &action); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ids = append(ids, action["index"].ID)
+	}
+	s.requests = append(s.requests, ids)
+
+	if code := s.status[len(s.requests)]; code != 0 {
+		w.WriteHeader(code)
+		fmt.Fprintf(w, `{"error": "status %d"}`, code)
+		return
+	}
+
+	var items []string
+	for _, id := range ids {
+		switch {
+		case s.reject[id] > 0:
+			s.reject[id]--
+			items = append(items, fmt.Sprintf(`{"index": {"_index": "items", "_id": %q, "status": 429, "error": {"type": "es_rejected_execution_exception", "reason": "queue full"}}}`, id))
+		case s.fail[id]:
+			items = append(items, fmt.Sprintf(`{"index": {"_index": "items", "_id": %q, "status": 400, "error": {"type": "mapper_parsing_exception", "reason": "bad field"}}}`, id))
+		default:
+			items = append(items, fmt.Sprintf(`{"index": {"_index": "items", "_id": %q, "status": 201}}`, id))
+		}
+	}
+	fmt.Fprintf(w, `{"took": 1, "errors": false, "items": [%s]}`, strings.Join(items, ","))
+}
+
+func TestBulk(t *testing.T) {
+	tests := []struct {
+		name           string
+		server         *bulkServer
+		retries        int
+		wantIndexed    int
+		wantRetries    int
+		wantRejections int
+		wantFailures   []string // IDs
+		wantReason     string   // Of the last failure
+		wantRequests   [][]string
+		wantErr        bool
+	}{
+		{
+			name:         "all indexed",
+			server:       &bulkServer{},
+			retries:      3,
+			wantIndexed:  3,
+			wantRequests: [][]string{{"a", "b", "c"}},
+		},
+		{
+			name:           "rejected documents are retried",
+			server:         &bulkServer{reject: map[string]int{"b": 2}},
+			retries:        3,
+			wantIndexed:    3,
+			wantRetries:    2,
+			wantRejections: 1,
+			wantRequests:   [][]string{{"a", "b", "c"}, {"b"}, {"b"}},
+		},
+		{
+			name:         "partial failure isn't retried",
+			server:       &bulkServer{fail: map[string]bool{"c": true}},
+			retries:      3,
+			wantIndexed:  2,
+			wantFailures: []string{"c"},
+			wantReason:   "bad field",
+			wantRequests: [][]string{{"a", "b", "c"}},
+		},
+		{
+			name:           "rejected too many times",
+			server:         &bulkServer{reject: map[string]int{"a": 5, "c": 1}, fail: map[string]bool{"b": true}},
+			retries:        2,
+			wantIndexed:    1,
+			wantRetries:    2,
+			wantRejections: 2,
+			wantFailures:   []string{"b", "a"},
+			wantReason:     "still rejected after 2 retries: queue full",
+			wantRequests:   [][]string{{"a", "b", "c"}, {"a", "c"}, {"a"}},
+		},
+		{
+			name:           "whole request rejected",
+			server:         &bulkServer{status: map[int]int{1: http.StatusTooManyRequests}},
+			retries:        3,
+			wantIndexed:    3,
+			wantRetries:    1,
+			wantRejections: 3,
+			wantRequests:   [][]string{{"a", "b", "c"}, {"a", "b", "c"}},
+		},
+		{
+			name:         "request failed",
+			server:       &bulkServer{status: map[int]int{1: http.StatusInternalServerError}},
+			retries:      3,
+			wantRequests: [][]string{{"a", "b", "c"}},
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(tt.server)
+			defer ts.Close()
+
+			c, err := NewClient(&engine.Config{URL: ts.URL, BulkRetries: tt.retries, BulkBackoff: time.Millisecond})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var ops []*BulkOp
+			for _, id := range []string{"a", "b", "c"} {
+				ops = append(ops, &BulkOp{Action: "index", Index: "items", ID: id, Doc: Map{"name": id}})
+			}
+			res, err := c.Bulk(ops)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error: %t", err, tt.wantErr)
+			}
+
+			if !reflect.DeepEqual(tt.server.requests, tt.wantRequests) {
+				t.Errorf("sent %v, want %v", tt.server.requests, tt.wantRequests)
+			}
+			if tt.wantErr {
+				return
+			}
+			if res.Indexed != tt.wantIndexed || res.Retries != tt.wantRetries || res.Rejections != tt.wantRejections {
+				t.Errorf("got indexed %d, retries %d, rejections %d, want %d, %d, %d",
+					res.Indexed, res.Retries, res.Rejections, tt.wantIndexed, tt.wantRetries, tt.wantRejections)
+			}
+
+			var failures []string
+			for _, f := range res.Failures {
+				failures = append(failures, f.ID)
+			}
+			if !reflect.DeepEqual(failures, tt.wantFailures) {
+				t.Errorf("got failures %v, want %v", failures, tt.wantFailures)
+			}
+			if n := len(res.Failures); n > 0 {
+				last := res.Failures[n-1]
+				if last.Reason != tt.wantReason {
+					t.Errorf("got reason %q, want %q", last.Reason, tt.wantReason)
+				}
+				if last.Doc == nil {
+					t.Error("failure without the document, for the dead letter file")
+				}
+			}
+		})
+	}
+}
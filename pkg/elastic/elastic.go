@@ -4,20 +4,19 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 
 	"github.com/anrid/search-bench/pkg/data"
+	"github.com/anrid/search-bench/pkg/engine"
 	"github.com/anrid/search-bench/pkg/item"
 	"github.com/anrid/search-bench/pkg/query"
 	"github.com/bytedance/sonic"
 )
 
 const (
-	Host                 = "http://127.0.0.1:9200"
+	DefaultURL           = "http://127.0.0.1:9200"
 	SanityTestIndexName  = "test"
 	ItemsIndexName       = "items"
 	ItemsNoDescIndexName = "items_no_desc"
@@ -26,245 +25,201 @@ const (
 
 type Map = map[string]interface{}
 
-type RunIndexerArgs struct {
-	DataDir        string
-	FilenameFilter string
-	UseItemsNoDesc bool
-	BatchSize      int
-	Max            int
+// Client is an Elasticsearch REST API client.
+type Client struct {
+	URL         string
+	Username    string
+	Password    string
+	APIKey      string
+	HTTP        *http.Client
+	BulkRetries int
+	BulkBackoff time.Duration
 }
 
-func RunIndexer(a RunIndexerArgs) {
-	fmt.Printf("Running indexer: max %d items ..\n", a.Max)
-
-	var batcher item.Batcher
-	if a.UseItemsNoDesc {
-		batcher = &item.ItemsNoDescBatch{
-			Size:         a.BatchSize,
-			ForEachBatch: BulkIndexItemsNoDesc,
-		}
-		CreateItemsNoDescIndex()
-	} else {
-		batcher = &item.ItemsBatch{
-			Size:         a.BatchSize,
-			ForEachBatch: BulkIndexItems,
-		}
-		CreateItemsIndex()
+func NewClient(cfg *engine.Config) (*Client, error) {
+	httpClient, err := cfg.HTTPClient()
+	if err != nil {
+		return nil, err
 	}
 
-	start := time.Now()
-
-	item.Import(item.ImportArgs{
-		DataDir:          a.DataDir,
-		FilenameFilter:   a.FilenameFilter,
-		Batcher:          batcher,
-		MaxItemsToImport: a.Max,
-	})
-
-	var stats *ESIndexStats
-	if a.UseItemsNoDesc {
-		Refresh(ItemsNoDescIndexName)
-		stats = IndexStats(ItemsNoDescIndexName)
-	} else {
-		Refresh(ItemsIndexName)
-		stats = IndexStats(ItemsIndexName)
+	c := &Client{
+		URL:         strings.TrimSuffix(cfg.URL, "/"),
+		Username:    cfg.Username,
+		Password:    cfg.Password,
+		APIKey:      cfg.APIKey,
+		HTTP:        httpClient,
+		BulkRetries: cfg.BulkRetries,
+		BulkBackoff: cfg.BulkBackoff,
+	}
+	if c.URL == "" {
+		c.URL = DefaultURL
+	}
+	if c.BulkBackoff == 0 {
+		c.BulkBackoff = DefaultBulkBackoff
 	}
 
-	fmt.Printf("Index stats (after):\n%s\n", data.ToPrettyJSON(stats))
-	fmt.Printf("Finished indexing %d items in %s\n", stats.All.Primaries.Docs.Count, time.Since(start))
+	return c, nil
 }
 
-type RunBenchmarkArgs struct {
-	NumberOfRuns int // Number of times to execute the given queries, then calculate the average run time
-	Queries      []*query.SearchQuery
-	FetchSource  bool // Fetch full item source and print a preview
-
-	ResultsFile string // Write all query results to a file, maintaining the sort order (e.g. Bestmatch)
-	// If `FetchSource` = true  : Store complete items in results file
-	//                  = false : Store only item IDs in results file
+// TextFields returns the fields keywords are matched on in the given index.
+func TextFields(index string) []string {
+	if index == ItemsNoDescIndexName {
+		return []string{"name"}
+	}
+	return []string{"name", "desc"}
 }
 
-func RunBenchmark(a RunBenchmarkArgs) {
-	fmt.Printf("Running benchmark: %d queries x %d runs ..\n", len(a.Queries), a.NumberOfRuns)
+// BuildQuery translates a search query into an ES bool query, matching the
+// keyword on any of the given fields, and the sort order to use (nil if
+// none).
+func BuildQuery(q *query.SearchQuery, fields []string) (boolQuery Map, sort *Map) {
+	boolQuery = Map{}
+	filterTerms := []Map{}
 
-	statsBefore := IndexStats(ItemsIndexName)
-	fmt.Printf("Index stats (before):\n%s\n", data.ToPrettyJSON(statsBefore))
-
-	var resultsFile *os.File
-	var err error
-	if a.ResultsFile != "" {
-		resultsFile, err = os.OpenFile(a.ResultsFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0777)
-		if err != nil {
-			log.Panic(err)
+	if len(q.CategoryIDs) > 0 {
+		filterTerms = append(filterTerms, Map{"terms": Map{"category_id": q.CategoryIDs}})
+	}
+	if len(q.Statuses) > 0 {
+		filterTerms = append(filterTerms, Map{"terms": Map{"status": q.Statuses}})
+	}
+	if q.PriceMin > 0 || q.PriceMax > 0 {
+		price := Map{}
+		if q.PriceMin > 0 {
+			price["gte"] = q.PriceMin
 		}
+		if q.PriceMax > 0 {
+			price["lte"] = q.PriceMax
+		}
+		filterTerms = append(filterTerms, Map{"range": Map{"price": price}})
+	}
+	if len(q.Conditions) > 0 {
+		filterTerms = append(filterTerms, Map{"terms": Map{"item_condition": q.Conditions}})
+	}
+	if len(filterTerms) > 0 {
+		boolQuery["filter"] = filterTerms
+		sort = &Map{"created": "desc"}
 	}
 
-	var totalDuration time.Duration
-
-	for run := 0; run < a.NumberOfRuns; run++ {
-		runStart := time.Now()
-
-		ExecuteQueries(ExecuteQueriesArgs{
-			Queries:        a.Queries,
-			FetchSource:    a.FetchSource,
-			FetchMax:       240,
-			PageSize:       120,
-			WriteResultsTo: resultsFile,
-		})
-
-		totalDuration += time.Since(runStart)
-
-		// Store results from first run only!
-		if run == 0 && resultsFile != nil {
-			resultsFile.Close()
-			resultsFile = nil
+	if q.Keyword != "" {
+		var should []Map
+		for _, f := range fields {
+			should = append(should, Map{"match": Map{f: Map{"query": q.Keyword}}})
 		}
+		boolQuery["should"] = should
+		boolQuery["minimum_should_match"] = 1
+		sort = &Map{"_score": "desc"}
 	}
 
-	fmt.Printf(
-		"Executed %d queries x %d runs. Average time %s\n",
-		len(a.Queries), a.NumberOfRuns, totalDuration/time.Duration(a.NumberOfRuns),
-	)
+	if len(q.ExcludeKeywords) > 0 {
+		boolQuery["must_not"] = Exclusions(q, fields)
+		if sort == nil {
+			sort = &Map{"created": "desc"}
+		}
+	}
 
-	statsAfter := IndexStats(ItemsIndexName)
-	fmt.Printf("Index stats (after):\n%s\n", data.ToPrettyJSON(statsAfter))
-}
+	if field, order := q.SortField(); field != "" {
+		sort = &Map{field: order}
+	}
 
-type ExecuteQueriesArgs struct {
-	Queries        []*query.SearchQuery
-	FetchSource    bool
-	FetchMax       int
-	PageSize       int
-	WriteResultsTo *os.File
+	return
 }
 
-func ExecuteQueries(a ExecuteQueriesArgs) {
-	if a.PageSize == 0 {
-		a.PageSize = 120
+// Exclusions returns the `must_not` clauses excluding items that match all
+// terms of any of the excluded keywords of the query in any of the fields.
+func Exclusions(q *query.SearchQuery, fields []string) []Map {
+	var mustNot []Map
+	for _, kw := range q.ExcludeKeywords {
+		for _, f := range fields {
+			mustNot = append(mustNot, Map{"match": Map{f: Map{"query": kw, "operator": "and"}}})
+		}
 	}
-	var qc int
+	return mustNot
+}
 
-	createdSort := Map{"created": "desc"}
-	scoreSort := Map{"_score": "desc"}
+// DefaultQuery returns the search request body (`query` and `sort`) used
+// when no query template is given.
+func DefaultQuery(q *query.SearchQuery, fields []string) Map {
+	boolQuery, sort := BuildQuery(q, fields)
 
-	for _, q := range a.Queries {
-		qc++
+	body := Map{
+		"query": Map{
+			"bool": boolQuery,
+		},
+	}
+	if sort != nil {
+		body["sort"] = *sort
+	}
+	return body
+}
 
-		var from int64
-		var totalDocsFetched int
-		var sort *Map
+// Search executes a single page of a query, given as a search request body
+// with a `query` and optionally a `sort`, skipping `from` hits or, if `after`
+// is set, continuing after the last hit of the previous page.
+func (c *Client) Search(index string, body Map, from, size int, fetchSource bool, after *SearchAfter) (*SearchResult, error) {
+	esQuery := Map{
+		"size":    size,
+		"_source": fetchSource,
+	}
+	for k, v := range body {
+		esQuery[k] = v
+	}
 
-		boolQuery := Map{}
-		filterTerms := []Map{}
+	url := c.URL + "/" + index + "/_search?request_cache=false"
 
-		if len(q.CategoryIDs) > 0 {
-			filterTerms = append(filterTerms, Map{"terms": Map{"category_id": q.CategoryIDs}})
+	if after == nil {
+		esQuery["from"] = from
+	} else {
+		// Break ties on the item ID, so that hits with the same sort values
+		// are neither skipped nor repeated across pages
+		var sorts []interface{}
+		switch sort := body["sort"].(type) {
+		case nil:
+		case []interface{}:
+			sorts = append(sorts, sort...)
+		default:
+			sorts = append(sorts, sort)
 		}
-		if len(q.Statuses) > 0 {
-			filterTerms = append(filterTerms, Map{"terms": Map{"status": q.Statuses}})
+		esQuery["sort"] = append(sorts, Map{"id": "asc"})
+
+		if after.Values != nil {
+			esQuery["search_after"] = after.Values
 		}
-		if len(filterTerms) > 0 {
-			boolQuery["filter"] = filterTerms
-			sort = &createdSort
+		if after.PIT != "" {
+			// Searches within a point in time must not specify an index
+			esQuery["pit"] = Map{"id": after.PIT, "keep_alive": PITKeepAlive}
+			url = c.URL + "/_search?request_cache=false"
 		}
+	}
 
-		if q.Keyword != "" {
-			boolQuery["should"] = []Map{
-				{"match": Map{"name": Map{"query": q.Keyword}}},
-				{"match": Map{"desc": Map{"query": q.Keyword}}},
-			}
-			boolQuery["minimum_should_match"] = 1
-			sort = &scoreSort
-		}
+	if DebugPrint {
+		fmt.Printf("Query:\n%s\n", data.ToPrettyJSON(esQuery))
+	}
 
-		for {
-			esQuery := Map{
-				"query": Map{
-					"bool": boolQuery,
-				},
-				"size":    a.PageSize,
-				"_source": a.FetchSource,
-				"from":    from,
-			}
-			if sort != nil {
-				esQuery["sort"] = *sort
-			}
-
-			if DebugPrint {
-				fmt.Printf("Query:\n%s\n", data.ToPrettyJSON(esQuery))
-			}
-
-			res, code, err := Call(http.MethodPost, Host+"/"+ItemsIndexName+"/_search?request_cache=false", data.ToJSON(esQuery))
-			if err != nil {
-				log.Panic(err)
-			}
-			if code >= 300 {
-				fmt.Printf("Query dump:\n=====================\n%s\n", data.ToPrettyJSON(esQuery))
-				log.Panicf("got unexpected status code %d : %s", code, res)
-			}
-
-			// preview := res[:]
-			// if len(preview) > 500 {
-			// 	preview = preview[0:500]
-			// }
-			// fmt.Printf("Preview: %s\n", preview)
-
-			se := new(SearchResult)
-			err = sonic.Unmarshal(res, se)
-			if err != nil {
-				log.Panic(err)
-			}
-
-			totalDocsFetched += len(se.Hits.Hits)
-
-			if DebugPrint || qc%100 == 0 {
-				fmt.Printf("Executed %d queries - fetched %d / %d (%s) item IDs\n", qc, totalDocsFetched, se.Hits.Total.Value, se.Hits.Total.Relation)
-			}
-
-			if a.FetchSource && se.Hits.Hits != nil {
-				for i, doc := range se.Hits.Hits {
-					fmt.Printf(
-						"%03d. ID: %s  Name: %s  Status: %d  Category: %d\n", i+1,
-						doc.Source.ID, doc.Source.Name, doc.Source.Status, doc.Source.CategoryID,
-					)
-					if i+1 >= 10 {
-						break
-					}
-				}
-				// TODO: Store hits in results file, if one is open
-			}
-			if !a.FetchSource && len(se.Hits.Hits) > 0 && from == 0 /* only first page! */ {
-				// Write first page of results to results file, if one is open
-				if a.WriteResultsTo != nil {
-					var ids []string
-					for _, doc := range se.Hits.Hits {
-						ids = append(ids, doc.ID)
-					}
-
-					isBestmatch := "bm=0"
-					if se.Hits.Hits[0].Score > 0 {
-						isBestmatch = "bm=1"
-					}
-
-					_, err = a.WriteResultsTo.WriteString(fmt.Sprintf("%d|%s|%s\n", qc, isBestmatch, strings.Join(ids, ",")))
-					if err != nil {
-						log.Panic(err)
-					}
-				}
-			}
-
-			hasNextPage := se.Hits.Total.Value > 0 && se.Hits.Total.Value > int64(a.PageSize) && len(se.Hits.Hits) == int(a.PageSize)
-			if !hasNextPage || totalDocsFetched >= a.FetchMax {
-				break
-			}
-
-			from += int64(len(se.Hits.Hits))
-		}
+	b, err := data.ToJSON(esQuery)
+	if err != nil {
+		return nil, err
+	}
+	res, code, err := c.Call(http.MethodPost, url, b)
+	if err != nil {
+		return nil, err
 	}
+	if code >= 300 {
+		fmt.Printf("Query dump:\n=====================\n%s\n", data.ToPrettyJSON(esQuery))
+		return nil, fmt.Errorf("got unexpected status code %d : %s", code, res)
+	}
+
+	se := new(SearchResult)
+	err = sonic.Unmarshal(res, se)
+	if err != nil {
+		return nil, err
+	}
+
+	return se, nil
 }
 
 type SearchResult struct {
-	Took int64 `json:"took"` // 2
+	Took  int64  `json:"took"`   // 2
+	PITID string `json:"pit_id"` // Only set when searching within a point in time
 
 	Hits struct {
 		Total struct {
@@ -272,181 +227,99 @@ type SearchResult struct {
 			Relation string `json:"relation"`
 		} `json:"total"`
 		Hits []struct {
-			Index  string     `json:"_index"` // "test"
-			ID     string     `json:"_id"`    // "102"
-			Score  float64    `json:"_score"` // 10.781843
-			Source *item.Item `json:"_source"`
+			Index  string        `json:"_index"` // "test"
+			ID     string        `json:"_id"`    // "102"
+			Score  float64       `json:"_score"` // 10.781843
+			Source *Source       `json:"_source"`
+			Sort   []interface{} `json:"sort"` // Only set when sorting
 		} `json:"hits"`
 	} `json:"hits"`
 }
 
-func BulkIndexItems(itemsTotal int, items []*item.Item) error {
-	tok := data.KagomeV2Tokenizer()
-
-	for _, i := range items {
-		name := tok.Wakati(i.Name)
-		i.Name = strings.Join(name, " ")
-
-		desc := tok.Wakati(i.Desc)
-		i.Desc = strings.Join(desc, " ")
-	}
+// Source is an item as stored in either the items or the items_no_desc index.
+type Source struct {
+	item.ItemNoDesc
+	Desc string `json:"desc"`
+}
 
-	var docs []interface{}
+func (c *Client) BulkIndexItems(items []*item.Item) (*engine.BulkResult, error) {
+	var ops []*BulkOp
 	for _, i := range items {
-		docs = append(docs, Map{"index": Map{"_index": ItemsIndexName, "_id": i.ID}})
-		docs = append(docs, i)
+		ops = append(ops, &BulkOp{Action: "index", Index: ItemsIndexName, ID: i.ID, Doc: i})
 	}
 
-	bulk := BuildBulkBody(docs...)
-	if len(bulk) > 10_000_000 {
-		fmt.Printf("WARNING: bulk index body is %d bytes large!\n", len(bulk))
-	}
-
-	fmt.Printf("Bulk indexing %d items (JSON payload: %d bytes)\n", len(items), len(bulk))
-	res, code, err := Call(http.MethodPost, Host+"/_bulk", bulk)
-	EnsureNoError(res, code, err)
-
-	return nil
+	fmt.Printf("Bulk indexing %d items\n", len(items))
+	return c.Bulk(ops)
 }
 
-func BulkIndexItemsNoDesc(itemsTotal int, items []*item.ItemNoDesc) error {
-	tok := data.KagomeV2Tokenizer()
-
+func (c *Client) BulkIndexItemsNoDesc(items []*item.ItemNoDesc) (*engine.BulkResult, error) {
+	var ops []*BulkOp
 	for _, i := range items {
-		name := tok.Wakati(i.Name)
-		i.Name = strings.Join(name, " ")
+		ops = append(ops, &BulkOp{Action: "index", Index: ItemsNoDescIndexName, ID: i.ID, Doc: i})
 	}
 
-	var docs []interface{}
-	for _, i := range items {
-		docs = append(docs, Map{"index": Map{"_index": ItemsNoDescIndexName, "_id": i.ID}})
-		docs = append(docs, i)
-	}
-
-	bulk := BuildBulkBody(docs...)
-	if len(bulk) > 10_000_000 {
-		fmt.Printf("WARNING: bulk index body is %d bytes large!\n", len(bulk))
-	}
-
-	fmt.Printf("Bulk indexing %d items (JSON payload: %d bytes)\n", len(items), len(bulk))
-	res, code, err := Call(http.MethodPost, Host+"/_bulk", bulk)
-	EnsureNoError(res, code, err)
-
-	return nil
+	fmt.Printf("Bulk indexing %d items\n", len(items))
+	return c.Bulk(ops)
 }
 
-func EnsureNoError(res []byte, statusCode int, err error) {
-	if err != nil {
-		log.Panic(err)
-	}
-	if !strings.Contains(string(res), `"errors":false`) {
-		log.Panicf("got ES error: %s", res)
-	}
-	if statusCode != 200 {
-		log.Panicf("got bad HTTP status code %d : %s", statusCode, res)
+// BulkApplyChanges applies change log updates and inserts to the given index.
+func (c *Client) BulkApplyChanges(index string, changes []*item.ChangeLogEntry) (*engine.BulkResult, error) {
+	var ops []*BulkOp
+	for _, cl := range changes {
+		if cl.Insert != nil {
+			ops = append(ops, &BulkOp{Action: "index", Index: index, ID: cl.ItemID, Doc: cl.Insert})
+		} else {
+			ops = append(ops, &BulkOp{Action: "update", Index: index, ID: cl.ItemID, Doc: Map{"doc": cl.Update}})
+		}
 	}
+
+	return c.Bulk(ops)
 }
 
-func CreateItemsIndex() {
-	res, code, err := Call(http.MethodDelete, Host+"/"+ItemsIndexName, nil)
+// CreateIndex (re)creates an index with the given mappings and settings,
+// e.g. as rendered from an `IndexTemplate`.
+func (c *Client) CreateIndex(index string, body Map) error {
+	res, code, err := c.Call(http.MethodDelete, c.URL+"/"+index, nil)
 	if err != nil {
-		log.Panic(err)
+		return fmt.Errorf("could not delete index %s: %w", index, err)
 	}
 
 	if DebugPrint {
 		fmt.Printf("res: %s (code: %d)\n", res, code)
 	}
 
-	res, code, err = Call(http.MethodPut, Host+"/"+ItemsIndexName, data.ToJSON(Map{
-		"mappings": Map{
-			"properties": Map{
-				"id":          Map{"type": "keyword"},
-				"name":        Map{"type": "text"},
-				"desc":        Map{"type": "text"},
-				"status":      Map{"type": "integer"},
-				"created":     Map{"type": "date", "format": "epoch_millis"},
-				"category_id": Map{"type": "integer"},
-			},
-		},
-		"settings": Map{
-			"number_of_shards": 1,
-			"index": Map{
-				"queries.cache.enabled": "false",
-				"similarity": Map{
-					"default": Map{
-						"type": "BM25",
-						"b":    0.75,
-						"k1":   1.2,
-					},
-				},
-			},
-		},
-	}))
+	b, err := data.ToJSON(body)
 	if err != nil {
-		log.Panic(err)
-	}
-
-	if DebugPrint {
-		fmt.Printf("res: %s (code: %d)\n", res, code)
+		return err
 	}
-}
-
-func CreateItemsNoDescIndex() {
-	res, code, err := Call(http.MethodDelete, Host+"/"+ItemsNoDescIndexName, nil)
+	res, code, err = c.Call(http.MethodPut, c.URL+"/"+index, b)
 	if err != nil {
-		log.Panic(err)
-	}
-
-	if DebugPrint {
-		fmt.Printf("res: %s (code: %d)\n", res, code)
+		return fmt.Errorf("could not create index %s: %w", index, err)
 	}
-
-	res, code, err = Call(http.MethodPut, Host+"/"+ItemsNoDescIndexName, data.ToJSON(Map{
-		"mappings": Map{
-			"properties": Map{
-				"id":             Map{"type": "keyword"},
-				"name":           Map{"type": "text"},
-				"status":         Map{"type": "integer"},
-				"created":        Map{"type": "date", "format": "epoch_millis"},
-				"updated":        Map{"type": "date", "format": "epoch_millis"},
-				"category_id":    Map{"type": "integer"},
-				"item_condition": Map{"type": "integer"},
-			},
-		},
-		"settings": Map{
-			"number_of_shards": 1,
-			"index": Map{
-				"queries.cache.enabled": "false",
-				"similarity": Map{
-					"default": Map{
-						"type": "BM25",
-						"b":    0.75,
-						"k1":   1.2,
-					},
-				},
-			},
-		},
-	}))
-	if err != nil {
-		log.Panic(err)
+	if code >= 300 {
+		return fmt.Errorf("could not create index %s (code: %d): %s", index, code, res)
 	}
 
 	if DebugPrint {
 		fmt.Printf("res: %s (code: %d)\n", res, code)
 	}
+
+	return nil
 }
 
-func SanityTest() {
-	res, code, err := Call(http.MethodDelete, Host+"/"+SanityTestIndexName, nil)
+// SanityTest creates a test index, indexes a few documents and checks that a
+// query finds them.
+func (c *Client) SanityTest() error {
+	res, code, err := c.Call(http.MethodDelete, c.URL+"/"+SanityTestIndexName, nil)
 	if err != nil {
-		log.Panic(err)
+		return fmt.Errorf("sanity test failed: %w", err)
 	}
 
 	if DebugPrint {
 		fmt.Printf("res: %s (code: %d)\n", res, code)
 	}
 
-	res, code, err = Call(http.MethodPut, Host+"/"+SanityTestIndexName, data.ToJSON(Map{
+	mappings, err := data.ToJSON(Map{
 		"mappings": Map{
 			"properties": Map{
 				"age":   Map{"type": "integer"},
@@ -454,16 +327,23 @@ func SanityTest() {
 				"name":  Map{"type": "text"},
 			},
 		},
-	}))
+	})
 	if err != nil {
-		log.Panic(err)
+		return err
+	}
+	res, code, err = c.Call(http.MethodPut, c.URL+"/"+SanityTestIndexName, mappings)
+	if err != nil {
+		return fmt.Errorf("sanity test failed: %w", err)
+	}
+	if code >= 300 {
+		return fmt.Errorf("sanity test failed to create index %s (code: %d): %.500s", SanityTestIndexName, code, res)
 	}
 
 	if DebugPrint {
 		fmt.Printf("res: %s (code: %d)\n", res, code)
 	}
 
-	bulk := BuildBulkBody(
+	bulk, err := BuildBulkBody(
 		Map{"index": Map{"_index": "test", "_id": "101"}},
 		Map{"age": 30, "name": "Mr Magoo", "email": "mr@magoo.se"},
 		Map{"index": Map{"_index": "test", "_id": "102"}},
@@ -471,20 +351,28 @@ func SanityTest() {
 		Map{"index": Map{"_index": "test", "_id": "102"}},
 		Map{"age": 21, "name": "Mrs Daisy Malone", "email": "dmalone@molly.se"},
 	)
+	if err != nil {
+		return err
+	}
 	// fmt.Printf("Bulk request:\n%s\n", string(bulk))
 
-	res, code, err = Call(http.MethodPost, Host+"/_bulk", bulk)
+	res, code, err = c.Call(http.MethodPost, c.URL+"/_bulk", bulk)
 	if err != nil {
-		log.Panic(err)
+		return fmt.Errorf("sanity test failed: %w", err)
+	}
+	if code >= 300 {
+		return fmt.Errorf("sanity test bulk insert failed (code: %d): %.500s", code, res)
 	}
 
 	if DebugPrint {
 		fmt.Printf("res: %s (code: %d)\n", res, code)
 	}
 
-	Refresh(SanityTestIndexName)
+	if err := c.Refresh(SanityTestIndexName); err != nil {
+		return fmt.Errorf("sanity test failed: %w", err)
+	}
 
-	res, code, err = Call(http.MethodPost, Host+"/"+SanityTestIndexName+"/_search", data.ToJSON(
+	q, err := data.ToJSON(
 		Map{
 			"query": Map{
 				"query_string": Map{
@@ -492,9 +380,13 @@ func SanityTest() {
 				},
 			},
 		},
-	))
+	)
 	if err != nil {
-		log.Panic(err)
+		return err
+	}
+	res, code, err = c.Call(http.MethodPost, c.URL+"/"+SanityTestIndexName+"/_search", q)
+	if err != nil {
+		return fmt.Errorf("sanity test failed: %w", err)
 	}
 
 	if DebugPrint {
@@ -502,10 +394,11 @@ func SanityTest() {
 	}
 
 	if !strings.Contains(string(res), "Mrs Daisy Malone") {
-		log.Panicf("expected result to contain the string \"Mrs Daisy Malone\"")
+		return fmt.Errorf("sanity test failed: expected result to contain the string \"Mrs Daisy Malone\" (got: %.500s)", res)
 	}
 
-	fmt.Println("Connected to ES, created test index and executed a few queries - sanity test passed!")
+	fmt.Println("Connected to ES at " + c.URL + ", created test index and executed a few queries - sanity test passed!")
+	return nil
 }
 
 type ESIndexStats struct {
@@ -537,51 +430,103 @@ type ESIndexStats struct {
 	} `json:"_all"`
 }
 
-func IndexStats(index string) *ESIndexStats {
-	res, _, err := Call(http.MethodGet, Host+"/"+index+"/_stats", nil)
+func (c *Client) IndexStats(index string) (*ESIndexStats, error) {
+	res, err := c.get(c.URL + "/" + index + "/_stats")
 	if err != nil {
-		log.Panic(err)
+		return nil, fmt.Errorf("could not get stats of index %s: %w", index, err)
 	}
 
 	if DebugPrint {
 		all := make(map[string]interface{})
-		err = sonic.Unmarshal(res, &all)
-		if err != nil {
-			log.Panic(err)
+		if err := sonic.Unmarshal(res, &all); err == nil {
+			fmt.Printf("All Stats:\n%s\n\n", data.ToPrettyJSON(all))
 		}
-		fmt.Printf("All Stats:\n%s\n\n", data.ToPrettyJSON(all))
 	}
 
 	stats := new(ESIndexStats)
 	err = sonic.Unmarshal(res, stats)
 	if err != nil {
-		log.Panic(err)
+		return nil, fmt.Errorf("could not parse stats of index %s: %w", index, err)
+	}
+
+	return stats, nil
+}
+
+// Version returns the ES version number from `GET /`.
+func (c *Client) Version() (string, error) {
+	res, err := c.get(c.URL + "/")
+	if err != nil {
+		return "", fmt.Errorf("could not get ES version: %w", err)
+	}
+
+	info := struct {
+		Version struct {
+			Number string `json:"number"`
+		} `json:"version"`
+	}{}
+	err = sonic.Unmarshal(res, &info)
+	if err != nil {
+		return "", fmt.Errorf("could not parse ES version: %w", err)
+	}
+
+	return info.Version.Number, nil
+}
+
+func (c *Client) IndexSettings(index string) (Map, error) {
+	res, err := c.get(c.URL + "/" + index + "/_settings")
+	if err != nil {
+		return nil, fmt.Errorf("could not get settings of index %s: %w", index, err)
 	}
 
-	return stats
+	settings := Map{}
+	err = sonic.Unmarshal(res, &settings)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse settings of index %s: %w", index, err)
+	}
+
+	return settings, nil
 }
 
-func Refresh(index string) {
-	res, code, err := Call(http.MethodGet, Host+"/"+index+"/_refresh", nil)
+func (c *Client) Refresh(index string) error {
+	res, err := c.get(c.URL + "/" + index + "/_refresh")
 	if err != nil {
-		log.Panic(err)
+		return fmt.Errorf("could not refresh index %s: %w", index, err)
 	}
 
 	if DebugPrint {
-		fmt.Printf("res: %s (code: %d)\n", res, code)
+		fmt.Printf("res: %s\n", res)
+	}
+
+	return nil
+}
+
+// get sends a GET request, returning an error for any status code other than
+// 2xx.
+func (c *Client) get(url string) ([]byte, error) {
+	res, code, err := c.Call(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if code >= 300 {
+		return nil, fmt.Errorf("got unexpected status code %d : %.500s", code, res)
 	}
+	return res, nil
 }
 
-func BuildBulkBody(obs ...interface{}) (bulk []byte) {
+func BuildBulkBody(obs ...interface{}) (bulk []byte, err error) {
 	for _, o := range obs {
-		bulk = append(bulk, data.ToJSON(o)...)
+		b, err := data.ToJSON(o)
+		if err != nil {
+			return nil, err
+		}
+		bulk = append(bulk, b...)
 		bulk = append(bulk, []byte("\n")...)
 	}
 	bulk = append(bulk, []byte("\n")...)
 	return
 }
 
-func Call(method, url string, body []byte) (respBody []byte, statusCode int, err error) {
+func (c *Client) Call(method, url string, body []byte) (respBody []byte, statusCode int, err error) {
 	var r io.Reader
 	if body != nil {
 		r = bytes.NewReader(body)
@@ -594,10 +539,17 @@ func Call(method, url string, body []byte) (respBody []byte, statusCode int, err
 
 	req.Header.Add("content-type", "application/json")
 
-	resp, err := http.DefaultClient.Do(req)
+	if c.APIKey != "" {
+		req.Header.Add("authorization", "ApiKey "+c.APIKey)
+	} else if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+
+	resp, err := c.HTTP.Do(req)
 	if err != nil {
 		return nil, 0, err
 	}
+	defer resp.Body.Close()
 
 	statusCode = resp.StatusCode
 
@@ -0,0 +1,178 @@
+package elastic
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/anrid/search-bench/pkg/engine"
+	"github.com/anrid/search-bench/pkg/item"
+)
+
+func init() {
+	engine.Register("elastic", func(cfg *engine.Config) (engine.Engine, error) {
+		c, err := NewClient(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return &Engine{c: c, templateDir: cfg.IndexTemplateDir}, nil
+	})
+}
+
+// Engine implements `engine.Engine` for Elasticsearch.
+type Engine struct {
+	c              *Client
+	templateDir    string
+	queryTemplates sync.Map // Name -> *QueryTemplate
+}
+
+func (e *Engine) Name() string {
+	return "elastic"
+}
+
+func (e *Engine) Version() (string, error) {
+	return e.c.Version()
+}
+
+func (e *Engine) SanityTest() error {
+	return e.c.SanityTest()
+}
+
+// CreateIndex creates the index from its template, see `LoadIndexTemplate`.
+func (e *Engine) CreateIndex(index string, vars engine.IndexVars) error {
+	t, body, err := e.renderIndexTemplate(index, vars)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Creating index %s from template %s", index, t.Name)
+	if len(vars) > 0 {
+		fmt.Printf(" (%s)", vars)
+	}
+	fmt.Println()
+
+	return e.c.CreateIndex(index, body)
+}
+
+// CheckIndexTemplate loads and renders the template of the given index.
+func (e *Engine) CheckIndexTemplate(index string, vars engine.IndexVars) error {
+	_, _, err := e.renderIndexTemplate(index, vars)
+	return err
+}
+
+func (e *Engine) renderIndexTemplate(index string, vars engine.IndexVars) (*IndexTemplate, Map, error) {
+	t, err := LoadIndexTemplate(e.templateDir, index)
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := t.Render(vars)
+	if err != nil {
+		return nil, nil, err
+	}
+	return t, body, nil
+}
+
+func (e *Engine) BulkIndex(b *engine.Batch) (*engine.BulkResult, error) {
+	if len(b.Items) > 0 {
+		return e.c.BulkIndexItems(b.Items)
+	}
+	if len(b.ItemsNoDesc) > 0 {
+		return e.c.BulkIndexItemsNoDesc(b.ItemsNoDesc)
+	}
+	if len(b.Changes) > 0 {
+		return e.c.BulkApplyChanges(b.Index, b.Changes)
+	}
+	return new(engine.BulkResult), nil
+}
+
+func (e *Engine) Search(r *engine.SearchRequest) (*engine.SearchResult, error) {
+	var after *SearchAfter
+	if r.Paging == engine.PagingSearchAfter || r.Paging == engine.PagingPIT {
+		after = &SearchAfter{Values: r.SearchAfter, PIT: r.PIT}
+	}
+
+	var body Map
+	if r.QueryTemplate != "" {
+		t, found := e.queryTemplates.Load(r.QueryTemplate)
+		if !found {
+			return nil, fmt.Errorf("query template '%s' isn't loaded", r.QueryTemplate)
+		}
+		var err error
+		body, err = t.(*QueryTemplate).Render(r.SearchQuery(), TextFields(r.Index))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		body = DefaultQuery(r.SearchQuery(), TextFields(r.Index))
+	}
+
+	se, err := e.c.Search(r.Index, body, r.From, r.Size, r.FetchSource, after)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &engine.SearchResult{
+		Took:          se.Took,
+		Total:         se.Hits.Total.Value,
+		TotalRelation: se.Hits.Total.Relation,
+		PIT:           se.PITID,
+	}
+	for _, h := range se.Hits.Hits {
+		hit := &engine.Hit{
+			ID:    h.ID,
+			Score: h.Score,
+			Sort:  h.Sort,
+		}
+		if h.Source != nil {
+			if r.Index == ItemsNoDescIndexName {
+				s := h.Source.ItemNoDesc
+				hit.SourceNoDesc = &s
+			} else {
+				hit.Source = &item.Item{
+					ID:         h.Source.ID,
+					Name:       h.Source.Name,
+					Desc:       h.Source.Desc,
+					Status:     h.Source.Status,
+					Created:    h.Source.Created,
+					CategoryID: h.Source.CategoryID,
+				}
+			}
+		}
+		res.Hits = append(res.Hits, hit)
+	}
+
+	return res, nil
+}
+
+func (e *Engine) Refresh(index string) error {
+	return e.c.Refresh(index)
+}
+
+func (e *Engine) Stats(index string) (*engine.IndexStats, error) {
+	stats, err := e.c.IndexStats(index)
+	if err != nil {
+		return nil, err
+	}
+
+	return &engine.IndexStats{
+		DocsCount:   stats.All.Primaries.Docs.Count,
+		SizeInBytes: stats.All.Primaries.Store.SizeInBytes,
+		Native:      stats,
+	}, nil
+}
+
+func (e *Engine) Settings(index string) (interface{}, error) {
+	return e.c.IndexSettings(index)
+}
+
+// LoadQueryTemplate loads a query template, see `elastic.LoadQueryTemplate`.
+func (e *Engine) LoadQueryTemplate(name string) error {
+	if _, found := e.queryTemplates.Load(name); found {
+		return nil
+	}
+	t, err := LoadQueryTemplate(name)
+	if err != nil {
+		return err
+	}
+	e.queryTemplates.Store(name, t)
+	return nil
+}
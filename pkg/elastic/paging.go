@@ -0,0 +1,96 @@
+package elastic
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/anrid/search-bench/pkg/data"
+	"github.com/anrid/search-bench/pkg/engine"
+	"github.com/bytedance/sonic"
+)
+
+// PITKeepAlive is how long a point in time is kept alive after each request.
+const PITKeepAlive = "1m"
+
+// SearchAfter selects the page of results to fetch with `search_after`,
+// optionally within a point in time.
+type SearchAfter struct {
+	Values []interface{} // Sort values of the last hit on the previous page, nil for the first page
+	PIT    string        // Point in time ID, if any
+}
+
+// OpenPointInTime opens a point in time on the given index (ES 7.10+).
+func (c *Client) OpenPointInTime(index string) (string, error) {
+	res, code, err := c.Call(http.MethodPost, c.URL+"/"+index+"/_pit?keep_alive="+PITKeepAlive, nil)
+	if err != nil {
+		return "", err
+	}
+	if code >= 300 {
+		return "", fmt.Errorf("could not open point in time: got unexpected status code %d : %s", code, res)
+	}
+
+	pit := struct {
+		ID string `json:"id"`
+	}{}
+	err = sonic.Unmarshal(res, &pit)
+	if err != nil {
+		return "", err
+	}
+
+	return pit.ID, nil
+}
+
+func (c *Client) ClosePointInTime(id string) error {
+	b, err := data.ToJSON(Map{"id": id})
+	if err != nil {
+		return err
+	}
+	res, code, err := c.Call(http.MethodDelete, c.URL+"/_pit", b)
+	if err != nil {
+		return err
+	}
+	if code >= 300 && code != http.StatusNotFound {
+		return fmt.Errorf("could not close point in time: got unexpected status code %d : %s", code, res)
+	}
+	return nil
+}
+
+// SupportsPointInTime returns true if the given ES version supports point in
+// time searches, i.e. 7.10 or later.
+func SupportsPointInTime(version string) bool {
+	p := strings.SplitN(version, ".", 3)
+	if len(p) < 2 {
+		return false
+	}
+	major, err := strconv.Atoi(p[0])
+	if err != nil {
+		return false
+	}
+	minor, err := strconv.Atoi(p[1])
+	if err != nil {
+		return false
+	}
+	return major > 7 || (major == 7 && minor >= 10)
+}
+
+func (e *Engine) SupportsPaging(strategy string) bool {
+	switch strategy {
+	case engine.PagingFromSize, engine.PagingSearchAfter:
+		return true
+	case engine.PagingPIT:
+		version, err := e.Version()
+		return err == nil && SupportsPointInTime(version)
+	default:
+		return false
+	}
+}
+
+func (e *Engine) OpenPointInTime(index string) (string, error) {
+	return e.c.OpenPointInTime(index)
+}
+
+func (e *Engine) ClosePointInTime(id string) error {
+	return e.c.ClosePointInTime(id)
+}
@@ -0,0 +1,179 @@
+package elastic
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/anrid/search-bench/pkg/data"
+	"github.com/anrid/search-bench/pkg/item"
+	"github.com/anrid/search-bench/pkg/query"
+	"github.com/bytedance/sonic"
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed templates/queries/*.yaml
+var builtinQueryTemplates embed.FS
+
+// QueryTemplate is a query shape written in JSON or YAML, rendered with
+// `QueryParams`, i.e. the fields of a `query.SearchQuery` (`.Keyword`,
+// `.RawKeyword`, `.CategoryIDs`, `.Statuses`, `.ExcludeKeywords`, `.PriceMin`,
+// `.PriceMax`, `.Conditions` and `.Sort`) and the text fields of the index
+// (`.Fields`), into a search request body with a `query` and optionally a
+// `sort`. Keys with null values, e.g. an empty `sort:` in YAML, are dropped.
+// Besides the built-in template functions, templates can use `json` to quote
+// values, `filters` for the filters of the query, `exclusions` for the
+// `must_not` clauses of its excluded keywords (on `.Fields`, unless fields
+// are given) and `sort` for its default sort order.
+type QueryTemplate struct {
+	Name string
+	tmpl *template.Template
+	yaml bool
+}
+
+// QueryParams are the parameters a query template is rendered with.
+type QueryParams struct {
+	*query.SearchQuery
+	Fields []string // Text fields of the index, e.g. only `name` in the items_no_desc index
+}
+
+// QueryTemplateNames returns the names of the built-in query templates.
+func QueryTemplateNames() (names []string) {
+	files, _ := fs.Glob(builtinQueryTemplates, "templates/queries/*.yaml")
+	for _, f := range files {
+		names = append(names, strings.TrimSuffix(filepath.Base(f), ".yaml"))
+	}
+	sort.Strings(names)
+	return
+}
+
+// LoadQueryTemplate loads a built-in query template by name (see
+// `QueryTemplateNames`) or a template file (.json, .yaml or .yml).
+func LoadQueryTemplate(name string) (*QueryTemplate, error) {
+	var src []byte
+	var err error
+	ext := filepath.Ext(name)
+	switch ext {
+	case ".json", ".yaml", ".yml":
+		src, err = os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		src, err = builtinQueryTemplates.ReadFile("templates/queries/" + name + ".yaml")
+		if err != nil {
+			return nil, fmt.Errorf("unknown query template '%s' (built-in: %s, or a .json, .yaml or .yml file)", name, strings.Join(QueryTemplateNames(), ", "))
+		}
+		ext = ".yaml"
+	}
+
+	tmpl, err := template.New(name).Funcs(template.FuncMap{
+		"json":    toJSON,
+		"filters": func(p *QueryParams) (string, error) { return toJSON(filters(p.SearchQuery)) },
+		"exclusions": func(p *QueryParams, fields ...string) (string, error) {
+			if len(fields) == 0 {
+				fields = p.Fields
+			}
+			return toJSON(Exclusions(p.SearchQuery, fields))
+		},
+		"sort": func(p *QueryParams) (string, error) { return toJSON(sortOrder(p.SearchQuery)) },
+	}).Parse(string(src))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse query template %s: %w", name, err)
+	}
+
+	t := &QueryTemplate{Name: name, tmpl: tmpl, yaml: ext != ".json"}
+
+	// Render a query with every parameter set, so that broken templates fail
+	// up front rather than on the first query
+	_, err = t.Render(&query.SearchQuery{
+		RawKeyword:         "test",
+		Keyword:            "test",
+		CategoryIDs:        []int64{1},
+		Statuses:           []item.Status{item.StatusOnSale},
+		RawExcludeKeywords: []string{"test"},
+		ExcludeKeywords:    []string{"test"},
+		PriceMin:           1,
+		PriceMax:           1,
+		Conditions:         []item.ItemCondition{item.ItemConditionLikeNew},
+		Sort:               query.SortPriceAsc,
+	}, TextFields(ItemsIndexName))
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// Render returns the search request body (`query` and `sort`) for the given
+// query, matching keywords on the given text fields.
+func (t *QueryTemplate) Render(q *query.SearchQuery, fields []string) (Map, error) {
+	var buf bytes.Buffer
+	if err := t.tmpl.Execute(&buf, &QueryParams{SearchQuery: q, Fields: fields}); err != nil {
+		return nil, fmt.Errorf("could not render query template %s: %w", t.Name, err)
+	}
+
+	body := make(Map)
+	var err error
+	if t.yaml {
+		err = yaml.Unmarshal(buf.Bytes(), &body)
+	} else {
+		err = sonic.Unmarshal(buf.Bytes(), &body)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid query template %s (after rendering): %w\n%s", t.Name, err, buf.String())
+	}
+	if _, found := body["query"]; !found {
+		return nil, fmt.Errorf("query template %s has no query", t.Name)
+	}
+
+	return dropNulls(body).(Map), nil
+}
+
+// filters returns the filters of a query, or nil if it has none.
+func filters(q *query.SearchQuery) []Map {
+	withoutKeyword := *q
+	withoutKeyword.Keyword = ""
+	boolQuery, _ := BuildQuery(&withoutKeyword, nil)
+	f, _ := boolQuery["filter"].([]Map)
+	return f
+}
+
+// sortOrder returns the default sort order of a query, or nil if it has none.
+func sortOrder(q *query.SearchQuery) []Map {
+	_, sort := BuildQuery(q, nil)
+	if sort == nil {
+		return nil
+	}
+	return []Map{*sort}
+}
+
+// dropNulls removes keys with null values from maps, recursively.
+func dropNulls(v interface{}) interface{} {
+	switch v := v.(type) {
+	case Map:
+		for k, val := range v {
+			if val == nil {
+				delete(v, k)
+			} else {
+				v[k] = dropNulls(val)
+			}
+		}
+	case []interface{}:
+		for i, val := range v {
+			v[i] = dropNulls(val)
+		}
+	}
+	return v
+}
+
+func toJSON(v interface{}) (string, error) {
+	b, err := data.ToJSON(v)
+	return string(b), err
+}
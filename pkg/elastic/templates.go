@@ -0,0 +1,119 @@
+package elastic
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"text/template"
+
+	"github.com/anrid/search-bench/pkg/engine"
+	"github.com/bytedance/sonic"
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed templates/*.json
+var builtinTemplates embed.FS
+
+// DefaultIndexVars are the values of the variables used by the built-in index
+// templates and by analysis modes, unless overridden.
+var DefaultIndexVars = engine.IndexVars{
+	"shards":           "1",
+	"replicas":         "1",
+	"refresh_interval": "1s",
+	"codec":            "default", // or "best_compression"
+	"query_cache":      "false",
+	"bm25_b":           "0.75",
+	"bm25_k1":          "1.2",
+
+	engine.IndexVarAnalysis:    engine.AnalysisKagome,
+	"kuromoji_mode":            "search",
+	"kuromoji_user_dictionary": "", // e.g. "userdict_ja.txt" in the ES config dir
+	"kuromoji_filters":         "kuromoji_baseform,kuromoji_part_of_speech,cjk_width,ja_stop,kuromoji_stemmer,lowercase",
+	"ngram_min":                "2",
+	"ngram_max":                "3",
+}
+
+// IndexTemplate is an index mapping and settings template, written in JSON or
+// YAML, with `{{.var}}` placeholders for index variables.
+type IndexTemplate struct {
+	Name   string
+	Source string
+	yaml   bool
+}
+
+// LoadIndexTemplate loads the template for the given index from `dir`, trying
+// `<index>.json`, `<index>.yaml` and `<index>.yml` in order, or the built-in
+// template if `dir` is empty.
+func LoadIndexTemplate(dir, index string) (*IndexTemplate, error) {
+	if dir == "" {
+		b, err := builtinTemplates.ReadFile("templates/" + index + ".json")
+		if err != nil {
+			return nil, fmt.Errorf("no built-in template for index '%s'", index)
+		}
+		return &IndexTemplate{Name: "built-in " + index + ".json", Source: string(b)}, nil
+	}
+
+	for _, ext := range []string{".json", ".yaml", ".yml"} {
+		filename := filepath.Join(dir, index+ext)
+		b, err := os.ReadFile(filename)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &IndexTemplate{Name: filename, Source: string(b), yaml: ext != ".json"}, nil
+	}
+
+	return nil, fmt.Errorf("no template for index '%s' in %s (expected %s.json, .yaml or .yml)", index, dir, index)
+}
+
+// Render substitutes the given variables (merged with `DefaultIndexVars`)
+// into the template and returns the index mappings and settings, including
+// the analyzer for the analysis mode (see `applyAnalysis`).
+func (t *IndexTemplate) Render(vars engine.IndexVars) (Map, error) {
+	all := make(engine.IndexVars)
+	for k, v := range DefaultIndexVars {
+		all[k] = v
+	}
+	for k, v := range vars {
+		if !t.Uses(k) && !analysisVars[k] {
+			fmt.Printf("WARNING: index variable '%s' isn't used by index template %s\n", k, t.Name)
+		}
+		all[k] = v
+	}
+
+	tmpl, err := template.New(t.Name).Option("missingkey=error").Parse(t.Source)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse index template %s: %w", t.Name, err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, all); err != nil {
+		return nil, fmt.Errorf("could not render index template %s: %w", t.Name, err)
+	}
+
+	m := make(Map)
+	if t.yaml {
+		err = yaml.Unmarshal(buf.Bytes(), &m)
+	} else {
+		err = sonic.Unmarshal(buf.Bytes(), &m)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid index template %s (after substituting variables): %w\n%s", t.Name, err, buf.String())
+	}
+
+	if err := applyAnalysis(m, all); err != nil {
+		return nil, fmt.Errorf("index template %s: %w", t.Name, err)
+	}
+
+	return m, nil
+}
+
+// Uses returns true if the template refers to the given variable.
+func (t *IndexTemplate) Uses(name string) bool {
+	return regexp.MustCompile(`\.` + regexp.QuoteMeta(name) + `\b`).MatchString(t.Source)
+}
@@ -0,0 +1,354 @@
+package engine
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/anrid/search-bench/pkg/item"
+	"github.com/anrid/search-bench/pkg/query"
+)
+
+const (
+	ItemsIndexName       = "items"
+	ItemsNoDescIndexName = "items_no_desc"
+)
+
+// Engine is a search engine backend that can be benchmarked.
+type Engine interface {
+	// Name returns the name the engine was registered with, e.g. "elastic".
+	Name() string
+	// Version returns the version of the engine, e.g. "8.11.1".
+	Version() (string, error)
+	// SanityTest creates a small test index and runs a few queries against it,
+	// returning an error if any of them fail.
+	SanityTest() error
+	// CreateIndex (re)creates the given index, dropping any existing data.
+	// The variables are substituted into the engine's index template, e.g.
+	// the number of shards or BM25 parameters. Engines ignore variables they
+	// don't support.
+	CreateIndex(index string, vars IndexVars) error
+	// BulkIndex indexes a batch of (already tokenized) items, or applies a
+	// batch of change log updates and inserts. Documents that fail are
+	// returned in the result, an error means the whole batch failed.
+	BulkIndex(b *Batch) (*BulkResult, error)
+	// Search executes a single page of the given query.
+	Search(r *SearchRequest) (*SearchResult, error)
+	// Refresh makes all indexed documents visible to search.
+	Refresh(index string) error
+	// Stats returns index stats like document count and size on disk.
+	Stats(index string) (*IndexStats, error)
+	// Settings returns the settings of the given index, as reported by the engine.
+	Settings(index string) (interface{}, error)
+}
+
+// IndexVars are variables substituted into index templates, e.g.
+// `shards=2` or `bm25_k1=1.5`. Variables left unset use the engine defaults.
+type IndexVars map[string]string
+
+// String returns the variables as comma separated `key=value` pairs, in key
+// order.
+func (v IndexVars) String() string {
+	var pairs []string
+	for k, val := range v {
+		pairs = append(pairs, k+"="+val)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Analysis modes, i.e. how Japanese text is split into terms when indexing
+// and querying. Set with the `analysis` index variable.
+const (
+	AnalysisKagome    = "kagome"     // Tokenized by the client with Kagome, indexed as whitespace separated tokens
+	AnalysisKuromoji  = "kuromoji"   // Analyzed by the engine with its Japanese morphological analyzer
+	AnalysisNgram     = "ngram"      // Analyzed by the engine into character n-grams
+	AnalysisCJKBigram = "cjk_bigram" // Analyzed by the engine into overlapping CJK bigrams
+
+	IndexVarAnalysis = "analysis"
+)
+
+var AnalysisModes = []string{AnalysisKagome, AnalysisKuromoji, AnalysisNgram, AnalysisCJKBigram}
+
+// Analysis returns the analysis mode set in the variables, defaulting to
+// `AnalysisKagome`.
+func (v IndexVars) Analysis() string {
+	if mode := v[IndexVarAnalysis]; mode != "" {
+		return mode
+	}
+	return AnalysisKagome
+}
+
+// TokenizedByClient returns true if text is tokenized before it's sent to
+// the engine in the given analysis mode, rather than analyzed by the engine.
+func TokenizedByClient(analysis string) bool {
+	return analysis == "" || analysis == AnalysisKagome
+}
+
+// Analyzer is implemented by engines that support analysis modes other than
+// `AnalysisKagome`.
+type Analyzer interface {
+	SupportsAnalysis(mode string) bool
+}
+
+// SupportsAnalysis returns true if the engine supports the given analysis
+// mode.
+func SupportsAnalysis(e Engine, mode string) bool {
+	if TokenizedByClient(mode) {
+		return true
+	}
+	a, ok := e.(Analyzer)
+	return ok && a.SupportsAnalysis(mode)
+}
+
+type Batch struct {
+	Index       string
+	Items       []*item.Item
+	ItemsNoDesc []*item.ItemNoDesc
+	Changes     []*item.ChangeLogEntry // Inserts must be tokenized already
+}
+
+func (b *Batch) Len() int {
+	return len(b.Items) + len(b.ItemsNoDesc) + len(b.Changes)
+}
+
+// BulkResult summarizes a bulk request, including any retries of documents
+// rejected by the engine.
+type BulkResult struct {
+	Indexed    int            // Documents indexed, updated or inserted
+	Retries    int            // Bulk requests sent to retry rejected documents
+	Rejections int            // Documents rejected at least once (e.g. 429 Too Many Requests) and retried, each counted once
+	Failures   []*BulkFailure // Documents that failed permanently
+}
+
+// BulkFailure is a document that could not be indexed, e.g. due to a mapping
+// error or after being rejected too many times.
+type BulkFailure struct {
+	Index  string      `json:"index"`
+	ID     string      `json:"id"`
+	Status int         `json:"status"`
+	Type   string      `json:"type"`
+	Reason string      `json:"reason"`
+	Doc    interface{} `json:"doc,omitempty"`
+}
+
+// Paging strategies, i.e. how the pages following the first page of results
+// are fetched.
+const (
+	PagingFromSize    = "from_size"    // Skip `From` hits, supported by all engines
+	PagingSearchAfter = "search_after" // Continue after the sort values of the last hit, with a tiebreaker sort on `id`
+	PagingPIT         = "pit"          // Like `PagingSearchAfter`, within a point in time (a consistent view of the index)
+)
+
+var PagingStrategies = []string{PagingFromSize, PagingSearchAfter, PagingPIT}
+
+type SearchRequest struct {
+	Index       string
+	Query       *query.SearchQuery
+	From        int
+	Size        int
+	FetchSource bool
+
+	Paging      string        // Defaults to `PagingFromSize`
+	SearchAfter []interface{} // Sort values of the last hit on the previous page, nil for the first page
+	PIT         string        // Point in time ID when paging with `PagingPIT`
+
+	Analysis string // Analysis mode of the index, defaults to `AnalysisKagome`
+
+	QueryTemplate string // Query shape to use instead of the engine's built-in one, see `QueryTemplater`
+}
+
+// SearchQuery returns the query to send to the engine: for analysis modes
+// where the engine analyzes text itself, the keyword and excluded keywords
+// are replaced with the raw, untokenized keywords.
+func (r *SearchRequest) SearchQuery() *query.SearchQuery {
+	if TokenizedByClient(r.Analysis) || (r.Query.RawKeyword == "" && len(r.Query.RawExcludeKeywords) == 0) {
+		return r.Query
+	}
+	q := *r.Query
+	q.Keyword = q.RawKeyword
+	q.ExcludeKeywords = q.RawExcludeKeywords
+	return &q
+}
+
+type SearchResult struct {
+	Took          int64 // Time in millis as reported by the engine
+	Total         int64
+	TotalRelation string // "eq" or "gte"
+	Hits          []*Hit
+	PIT           string // Point in time ID to use for the next page, when paging with `PagingPIT`
+}
+
+type Hit struct {
+	ID           string
+	Score        float64
+	Source       *item.Item       // Only set when `FetchSource` = true, searching the items index
+	SourceNoDesc *item.ItemNoDesc // Only set when `FetchSource` = true, searching the items_no_desc index
+	Sort         []interface{}    // Sort values, only set when paging with `search_after`
+}
+
+// Pager is implemented by engines that support paging strategies other than
+// `PagingFromSize`.
+type Pager interface {
+	// SupportsPaging returns true if the engine supports the given paging
+	// strategy, e.g. depending on its version.
+	SupportsPaging(strategy string) bool
+	// OpenPointInTime opens a point in time on the given index, kept alive
+	// between the requests for all pages of a query.
+	OpenPointInTime(index string) (string, error)
+	ClosePointInTime(id string) error
+}
+
+// SupportsPaging returns true if the engine supports the given paging strategy.
+func SupportsPaging(e Engine, strategy string) bool {
+	if strategy == "" || strategy == PagingFromSize {
+		return true
+	}
+	p, ok := e.(Pager)
+	return ok && p.SupportsPaging(strategy)
+}
+
+// QueryTemplater is implemented by engines that support query templates,
+// i.e. query shapes defined in files rather than built into the engine.
+type QueryTemplater interface {
+	// LoadQueryTemplate loads and checks the given (built-in) query template
+	// or template file, before it's used in `SearchRequest.QueryTemplate`.
+	LoadQueryTemplate(name string) error
+}
+
+// LoadQueryTemplate loads the given query template, failing if the engine
+// doesn't support query templates. An empty name means the built-in query
+// shape.
+func LoadQueryTemplate(e Engine, name string) error {
+	if name == "" {
+		return nil
+	}
+	t, ok := e.(QueryTemplater)
+	if !ok {
+		return fmt.Errorf("%s doesn't support query templates", e.Name())
+	}
+	return t.LoadQueryTemplate(name)
+}
+
+// IndexTemplater is implemented by engines that create indexes from
+// templates rendered with `IndexVars`.
+type IndexTemplater interface {
+	// CheckIndexTemplate loads and renders the template of the given index,
+	// without creating it.
+	CheckIndexTemplate(index string, vars IndexVars) error
+}
+
+// CheckIndexTemplate checks that the given index can be created with the given
+// vars, e.g. before indexing the first of several sweep variants. Engines that
+// don't use index templates always pass.
+func CheckIndexTemplate(e Engine, index string, vars IndexVars) error {
+	t, ok := e.(IndexTemplater)
+	if !ok {
+		return nil
+	}
+	return t.CheckIndexTemplate(index, vars)
+}
+
+type IndexStats struct {
+	DocsCount   int64       `json:"docs_count"`
+	SizeInBytes int64       `json:"size_in_bytes"`
+	Native      interface{} `json:"native"` // Engine specific stats
+}
+
+// Config holds connection settings for an engine. Engines ignore settings
+// they don't support, and use their defaults for settings left empty.
+type Config struct {
+	URL                string
+	Username           string // Basic auth
+	Password           string
+	APIKey             string // Sent as `Authorization: ApiKey <key>`, takes precedence over basic auth
+	CACertFile         string // PEM encoded CA certificate used to verify the server
+	InsecureSkipVerify bool   // Skip TLS certificate verification
+	Timeout            time.Duration
+
+	BulkRetries int           // Retry documents rejected in bulk requests this many times
+	BulkBackoff time.Duration // Initial backoff before retrying, see `Backoff`
+
+	IndexTemplateDir string // Load index templates (`<index>.json`, `.yaml` or `.yml`) from this dir instead of the built-in ones
+}
+
+// MaxBackoff caps the wait between retries, see `Backoff`.
+const MaxBackoff = 10 * time.Second
+
+// Backoff returns how long to wait before retrying after the given failed
+// attempt (0 for the first): `initial` doubled for each attempt, capped at
+// `MaxBackoff`, with jitter so that concurrent clients don't retry in
+// lockstep.
+func Backoff(initial time.Duration, attempt int) time.Duration {
+	backoff := MaxBackoff
+	if attempt < 32 && initial<<attempt < MaxBackoff {
+		backoff = initial << attempt
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// HTTPClient returns an HTTP client using the TLS settings and request
+// timeout in the config.
+func (c *Config) HTTPClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+
+	if c.CACertFile != "" {
+		pem, err := os.ReadFile(c.CACertFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("found no certificates in CA cert file %s", c.CACertFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	// Allow concurrent query workers to reuse connections
+	transport.MaxIdleConnsPerHost = 100
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   c.Timeout,
+	}, nil
+}
+
+type Factory func(c *Config) (Engine, error)
+
+var registry = make(map[string]Factory)
+
+// Register makes an engine available by name. It's meant to be called from
+// the `init` function of the package implementing the engine.
+func Register(name string, f Factory) {
+	if _, found := registry[name]; found {
+		panic(fmt.Sprintf("engine '%s' is already registered", name))
+	}
+	registry[name] = f
+}
+
+func New(name string, c *Config) (Engine, error) {
+	f, found := registry[name]
+	if !found {
+		return nil, fmt.Errorf("unsupported search engine '%s' (registered: %v)", name, Names())
+	}
+	if c == nil {
+		c = new(Config)
+	}
+	return f(c)
+}
+
+func Names() (names []string) {
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
@@ -0,0 +1,262 @@
+package eval
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	GroupAll        = "all"
+	GroupBestmatch  = "bestmatch"
+	GroupSortByDate = "sort_by_date"
+)
+
+// Judgments holds graded relevance judgments: query number -> item ID ->
+// grade, where 0 means not relevant and higher grades are more relevant.
+type Judgments map[int]map[string]int
+
+// LoadJudgments loads a judgments file with one judgment per line:
+//
+//	<query number> <item ID> <grade>
+//
+// Fields are separated by whitespace. TREC qrels files, which have an unused
+// iteration column after the query number, are accepted as well. Empty lines
+// and lines starting with # are ignored.
+func LoadJudgments(judgmentsFile string) (Judgments, error) {
+	f, err := os.Open(judgmentsFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	j := make(Judgments)
+
+	var lineNumber int
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 4 {
+			fields = append(fields[:1], fields[2:]...) // TREC qrels
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected 3 fields (query number, item ID and grade)", judgmentsFile, lineNumber)
+		}
+
+		qn, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid query number: %w", judgmentsFile, lineNumber, err)
+		}
+		grade, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid grade: %w", judgmentsFile, lineNumber, err)
+		}
+
+		if j[qn] == nil {
+			j[qn] = make(map[string]int)
+		}
+		j[qn][fields[1]] = grade
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Loaded judgments for %d queries from %s\n", len(j), judgmentsFile)
+
+	return j, nil
+}
+
+// Scores holds the mean of each metric across a group of queries.
+type Scores struct {
+	Queries int                `json:"queries"`
+	Metrics map[string]float64 `json:"metrics"` // e.g. "ndcg@10", "p@10", "map" and "mrr"
+}
+
+type Evaluation struct {
+	K          []int              `json:"k"`
+	Judged     int                `json:"judged"`      // Queries in the results with relevant judgments, all of which are scored
+	NoResults  int                `json:"no_results"`  // Judged queries without results, scored as 0
+	Unjudged   int                `json:"unjudged"`    // Queries in the results without judgments
+	NoRelevant int                `json:"no_relevant"` // Queries with judgments, none of them relevant
+	Missing    int                `json:"missing"`     // Queries with relevant judgments not found in the results, e.g. failed queries
+	Groups     map[string]*Scores `json:"groups"`      // Keyed by `GroupAll`, `GroupBestmatch` and `GroupSortByDate`
+}
+
+// Evaluate scores results against the given judgments with nDCG@k, P@k, MAP
+// and MRR, for all queries as well as bestmatch and sort-by-date queries
+// separately. Every query in the results with relevant judgments is scored,
+// as 0 if it has no results, so that an engine that returns nothing doesn't
+// score better than one that returns poor results. Queries without relevant
+// judgments are left out of the scores.
+func Evaluate(j Judgments, results []*Result, k []int) *Evaluation {
+	ev := &Evaluation{
+		K:      k,
+		Groups: make(map[string]*Scores),
+	}
+
+	byQuery := make(map[int]*Result, len(results))
+	for _, r := range results {
+		byQuery[r.QueryNumber] = r
+		if _, found := j[r.QueryNumber]; !found {
+			ev.Unjudged++
+		}
+	}
+
+	for qn, grades := range j {
+		if relevant(grades) == 0 {
+			ev.NoRelevant++
+			continue
+		}
+		r, found := byQuery[qn]
+		if !found {
+			ev.Missing++
+			continue
+		}
+		ev.Judged++
+		if len(r.IDs) == 0 {
+			ev.NoResults++
+		}
+
+		m := score(grades, r.IDs, k)
+
+		group := GroupSortByDate
+		if r.Bestmatch {
+			group = GroupBestmatch
+		}
+		for _, g := range []string{GroupAll, group} {
+			s := ev.Groups[g]
+			if s == nil {
+				s = &Scores{Metrics: make(map[string]float64)}
+				ev.Groups[g] = s
+			}
+			s.Queries++
+			for name, v := range m {
+				s.Metrics[name] += v
+			}
+		}
+	}
+
+	for _, s := range ev.Groups {
+		for name := range s.Metrics {
+			s.Metrics[name] /= float64(s.Queries)
+		}
+	}
+
+	return ev
+}
+
+func relevant(grades map[string]int) (n int) {
+	for _, g := range grades {
+		if g > 0 {
+			n++
+		}
+	}
+	return
+}
+
+// score computes all metrics for a single ranked list of item IDs.
+func score(grades map[string]int, ids []string, k []int) map[string]float64 {
+	m := make(map[string]float64)
+
+	// Average precision and reciprocal rank over the full list
+	m["mrr"] = 0
+	var hits int
+	var sumPrecision float64
+	for i, id := range ids {
+		if grades[id] > 0 {
+			hits++
+			sumPrecision += float64(hits) / float64(i+1)
+			if hits == 1 {
+				m["mrr"] = 1 / float64(i+1)
+			}
+		}
+	}
+	m["map"] = sumPrecision / float64(relevant(grades))
+
+	// Ideal ranking, i.e. all judged items sorted by grade
+	var ideal []int
+	for _, g := range grades {
+		if g > 0 {
+			ideal = append(ideal, g)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(ideal)))
+
+	for _, n := range k {
+		var hitsAtK int
+		var dcg, idcg float64
+		for i := 0; i < n; i++ {
+			if i < len(ids) {
+				g := grades[ids[i]]
+				if g > 0 {
+					hitsAtK++
+				}
+				dcg += gain(g, i)
+			}
+			if i < len(ideal) {
+				idcg += gain(ideal[i], i)
+			}
+		}
+		m[fmt.Sprintf("p@%d", n)] = float64(hitsAtK) / float64(n)
+		m[fmt.Sprintf("ndcg@%d", n)] = dcg / idcg
+	}
+
+	return m
+}
+
+// gain returns the discounted gain of an item with the given grade at the
+// given (zero based) rank.
+func gain(grade, rank int) float64 {
+	return (math.Pow(2, float64(grade)) - 1) / math.Log2(float64(rank+2))
+}
+
+// Print prints a table of scores per group.
+func (ev *Evaluation) Print() {
+	fmt.Printf(
+		"Evaluated %d judged queries, %d of them without results (%d without judgments, %d without relevant judgments, %d judged queries not found in the results)\n",
+		ev.Judged, ev.NoResults, ev.Unjudged, ev.NoRelevant, ev.Missing,
+	)
+
+	names := ev.MetricNames()
+
+	header := fmt.Sprintf("%-14s %8s", "group", "queries")
+	for _, name := range names {
+		header += fmt.Sprintf(" %9s", name)
+	}
+	fmt.Println(header)
+	fmt.Println(strings.Repeat("-", len(header)))
+
+	for _, g := range []string{GroupBestmatch, GroupSortByDate, GroupAll} {
+		s, found := ev.Groups[g]
+		if !found {
+			continue
+		}
+		row := fmt.Sprintf("%-14s %8d", g, s.Queries)
+		for _, name := range names {
+			row += fmt.Sprintf(" %9.4f", s.Metrics[name])
+		}
+		fmt.Println(row)
+	}
+	fmt.Println()
+}
+
+// MetricNames returns the names of all metrics in a stable order.
+func (ev *Evaluation) MetricNames() (names []string) {
+	for _, n := range ev.K {
+		names = append(names, fmt.Sprintf("ndcg@%d", n))
+	}
+	for _, n := range ev.K {
+		names = append(names, fmt.Sprintf("p@%d", n))
+	}
+	return append(names, "map", "mrr")
+}
@@ -0,0 +1,138 @@
+package eval
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func approx(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestScore(t *testing.T) {
+	log3 := math.Log2(3)
+
+	tests := []struct {
+		name   string
+		grades map[string]int
+		ids    []string
+		want   map[string]float64
+	}{
+		{
+			name:   "ideal ranking",
+			grades: map[string]int{"a": 2, "b": 1},
+			ids:    []string{"a", "b"},
+			want:   map[string]float64{"ndcg@1": 1, "ndcg@3": 1, "p@1": 1, "p@3": 2.0 / 3, "map": 1, "mrr": 1},
+		},
+		{
+			name:   "grades swapped",
+			grades: map[string]int{"a": 1, "b": 2},
+			ids:    []string{"a", "b"},
+			want:   map[string]float64{"ndcg@1": 1.0 / 3, "ndcg@3": (1 + 3/log3) / (3 + 1/log3), "p@1": 1, "p@3": 2.0 / 3, "map": 1, "mrr": 1},
+		},
+		{
+			name:   "relevant at rank 2",
+			grades: map[string]int{"a": 0, "b": 1},
+			ids:    []string{"a", "b", "c"},
+			want:   map[string]float64{"ndcg@1": 0, "ndcg@3": 1 / log3, "p@1": 0, "p@3": 1.0 / 3, "map": 0.5, "mrr": 0.5},
+		},
+		{
+			name:   "relevant item not found",
+			grades: map[string]int{"a": 1, "b": 1},
+			ids:    []string{"a", "c"},
+			want:   map[string]float64{"ndcg@1": 1, "ndcg@3": 1 / (1 + 1/log3), "p@1": 1, "p@3": 1.0 / 3, "map": 0.5, "mrr": 1},
+		},
+		{
+			name:   "no results",
+			grades: map[string]int{"a": 1},
+			ids:    nil,
+			want:   map[string]float64{"ndcg@1": 0, "ndcg@3": 0, "p@1": 0, "p@3": 0, "map": 0, "mrr": 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := score(tt.grades, tt.ids, []int{1, 3})
+			if len(got) != len(tt.want) {
+				t.Fatalf("got metrics %v, want %v", got, tt.want)
+			}
+			for name, want := range tt.want {
+				if !approx(got[name], want) {
+					t.Errorf("%s = %v, want %v", name, got[name], want)
+				}
+			}
+		})
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	j := Judgments{
+		1: {"a": 1},         // Perfect result
+		2: {"x": 0},         // No relevant judgments
+		3: {"b": 2},         // No results
+		4: {"c": 1},         // Not in the results
+		6: {"d": 1, "e": 0}, // Relevant item at rank 2
+	}
+	results := []*Result{
+		{QueryNumber: 1, Bestmatch: true, IDs: []string{"a"}},
+		{QueryNumber: 2, Bestmatch: true, IDs: []string{"x"}},
+		{QueryNumber: 3},
+		{QueryNumber: 5, IDs: []string{"z"}},
+		{QueryNumber: 6, Bestmatch: true, IDs: []string{"e", "d"}},
+	}
+
+	ev := Evaluate(j, results, []int{1})
+
+	counts := []int{ev.Judged, ev.NoResults, ev.Unjudged, ev.NoRelevant, ev.Missing}
+	if want := []int{3, 1, 1, 1, 1}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("got judged, no results, unjudged, no relevant and missing %v, want %v", counts, want)
+	}
+
+	tests := []struct {
+		group   string
+		queries int
+		mrr     float64
+	}{
+		{GroupAll, 3, (1 + 0 + 0.5) / 3},
+		{GroupBestmatch, 2, (1 + 0.5) / 2},
+		{GroupSortByDate, 1, 0},
+	}
+	for _, tt := range tests {
+		s := ev.Groups[tt.group]
+		if s == nil {
+			t.Errorf("no %s scores", tt.group)
+			continue
+		}
+		if s.Queries != tt.queries || !approx(s.Metrics["mrr"], tt.mrr) {
+			t.Errorf("%s: got %d queries with MRR %v, want %d with %v", tt.group, s.Queries, s.Metrics["mrr"], tt.queries, tt.mrr)
+		}
+	}
+}
+
+func TestLoadJudgments(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "judgments")
+	content := "# query item grade\n1 a 2\n1 b 0\n\n2 0 c 1\n"
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := LoadJudgments(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Judgments{1: {"a": 2, "b": 0}, 2: {"c": 1}}
+	if !reflect.DeepEqual(j, want) {
+		t.Errorf("got %v, want %v", j, want)
+	}
+
+	for _, bad := range []string{"1 a\n", "x a 1\n", "1 a high\n"} {
+		if err := os.WriteFile(file, []byte(bad), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadJudgments(file); err == nil {
+			t.Errorf("no error loading %q", bad)
+		}
+	}
+}
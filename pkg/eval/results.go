@@ -0,0 +1,66 @@
+package eval
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/anrid/search-bench/pkg/results"
+)
+
+// Result is the first page of item IDs returned for a query, in ranked order.
+type Result struct {
+	QueryNumber int
+	Bestmatch   bool // Sorted by score rather than by date
+	IDs         []string
+}
+
+// ReadResults reads the first page of results of every query in a results
+// file, in either the JSON lines or the legacy format, including queries
+// without results.
+func ReadResults(resultsFile string) ([]*Result, error) {
+	recs, err := results.ReadAll(resultsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	rs := make([]*Result, 0, len(recs))
+	for _, rec := range recs {
+		rs = append(rs, &Result{
+			QueryNumber: rec.QueryNumber,
+			Bestmatch:   rec.Bestmatch,
+			IDs:         rec.IDs(),
+		})
+	}
+
+	return rs, nil
+}
+
+// Results collects results in memory, e.g. while running the query benchmark.
+// It's safe for concurrent use.
+type Results struct {
+	mu      sync.Mutex
+	results map[int]*Result
+}
+
+func NewResults() *Results {
+	return &Results{results: make(map[int]*Result)}
+}
+
+func (r *Results) Add(res *Result) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.results[res.QueryNumber] = res
+}
+
+// List returns all results ordered by query number.
+func (r *Results) List() (rs []*Result) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, res := range r.results {
+		rs = append(rs, res)
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].QueryNumber < rs[j].QueryNumber })
+
+	return
+}
@@ -0,0 +1,183 @@
+package histogram
+
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+const (
+	// Values below `subBucketCount` are recorded exactly, larger values are
+	// recorded in log-linear buckets with a relative error of < 1/64 (~1.6%),
+	// similar to an HDR histogram with 2 significant digits.
+	subBucketBits  = 7
+	subBucketCount = 1 << subBucketBits
+	subBucketHalf  = subBucketCount / 2
+)
+
+// Histogram records latencies (in microseconds) and computes percentiles
+// using a fixed amount of memory regardless of the number of values recorded.
+// A Histogram is not safe for concurrent use.
+type Histogram struct {
+	counts []int64
+	count  int64
+	sum    int64
+	min    int64
+	max    int64
+}
+
+func New() *Histogram {
+	return &Histogram{min: math.MaxInt64}
+}
+
+func bucketIndex(v int64) int {
+	if v < subBucketCount {
+		return int(v)
+	}
+	exp := bits.Len64(uint64(v)) - subBucketBits
+	return exp*subBucketHalf + int(v>>exp)
+}
+
+// highestEquivalentValue returns the largest value that maps to the bucket.
+func highestEquivalentValue(index int) int64 {
+	if index < subBucketCount {
+		return int64(index)
+	}
+	exp := index/subBucketHalf - 1
+	sub := int64(index - exp*subBucketHalf)
+	return ((sub + 1) << exp) - 1
+}
+
+// Record records a duration with microsecond precision.
+func (h *Histogram) Record(d time.Duration) {
+	h.RecordValue(d.Microseconds())
+}
+
+func (h *Histogram) RecordValue(v int64) {
+	if v < 0 {
+		v = 0
+	}
+
+	i := bucketIndex(v)
+	if i >= len(h.counts) {
+		counts := make([]int64, i+1)
+		copy(counts, h.counts)
+		h.counts = counts
+	}
+
+	h.counts[i]++
+	h.count++
+	h.sum += v
+	if v < h.min {
+		h.min = v
+	}
+	if v > h.max {
+		h.max = v
+	}
+}
+
+// Merge adds all values recorded in `o` to this histogram.
+func (h *Histogram) Merge(o *Histogram) {
+	if o.count == 0 {
+		return
+	}
+	if len(o.counts) > len(h.counts) {
+		counts := make([]int64, len(o.counts))
+		copy(counts, h.counts)
+		h.counts = counts
+	}
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	h.count += o.count
+	h.sum += o.sum
+	if o.min < h.min {
+		h.min = o.min
+	}
+	if o.max > h.max {
+		h.max = o.max
+	}
+}
+
+func (h *Histogram) Count() int64 {
+	return h.count
+}
+
+func (h *Histogram) Min() int64 {
+	if h.count == 0 {
+		return 0
+	}
+	return h.min
+}
+
+func (h *Histogram) Max() int64 {
+	return h.max
+}
+
+func (h *Histogram) Mean() float64 {
+	if h.count == 0 {
+		return 0
+	}
+	return float64(h.sum) / float64(h.count)
+}
+
+// ValueAtPercentile returns the value at the given percentile (0-100), i.e.
+// the highest value that `p` percent of all recorded values are equal to or
+// less than, within the precision of the histogram.
+func (h *Histogram) ValueAtPercentile(p float64) int64 {
+	if h.count == 0 {
+		return 0
+	}
+	if p > 100 {
+		p = 100
+	}
+
+	target := int64(math.Ceil(p / 100 * float64(h.count)))
+	if target < 1 {
+		target = 1
+	}
+
+	var total int64
+	for i, c := range h.counts {
+		total += c
+		if total >= target {
+			v := highestEquivalentValue(i)
+			if v > h.max {
+				v = h.max
+			}
+			if v < h.min {
+				v = h.min
+			}
+			return v
+		}
+	}
+
+	return h.max
+}
+
+type Summary struct {
+	Count int64         `json:"count"`
+	Min   time.Duration `json:"min"`
+	Mean  time.Duration `json:"mean"`
+	P50   time.Duration `json:"p50"`
+	P90   time.Duration `json:"p90"`
+	P99   time.Duration `json:"p99"`
+	P999  time.Duration `json:"p99_9"`
+	Max   time.Duration `json:"max"`
+}
+
+// Summary returns the count, mean and common percentiles as durations.
+func (h *Histogram) Summary() *Summary {
+	us := func(v int64) time.Duration { return time.Duration(v) * time.Microsecond }
+
+	return &Summary{
+		Count: h.count,
+		Min:   us(h.Min()),
+		Mean:  time.Duration(h.Mean() * float64(time.Microsecond)),
+		P50:   us(h.ValueAtPercentile(50)),
+		P90:   us(h.ValueAtPercentile(90)),
+		P99:   us(h.ValueAtPercentile(99)),
+		P999:  us(h.ValueAtPercentile(99.9)),
+		Max:   us(h.Max()),
+	}
+}
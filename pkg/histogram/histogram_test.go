@@ -0,0 +1,127 @@
+package histogram
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBuckets(t *testing.T) {
+	prev := -1
+	for _, v := range []int64{0, 1, 63, 127, 128, 129, 130, 255, 256, 1000, 4095, 4096, 123_456, 60_000_000, 1 << 40} {
+		i := bucketIndex(v)
+		if i < prev {
+			t.Errorf("bucket %d of %d is below bucket %d of a smaller value", i, v, prev)
+		}
+		prev = i
+
+		hev := highestEquivalentValue(i)
+		if hev < v {
+			t.Errorf("highest equivalent value %d of %d is smaller than the value", hev, v)
+		}
+		if v < subBucketCount && hev != v {
+			t.Errorf("%d is recorded as %d rather than exactly", v, hev)
+		}
+		if v > 0 && float64(hev-v)/float64(v) >= 1.0/64 {
+			t.Errorf("%d is recorded as %d, a relative error of more than 1/64", v, hev)
+		}
+		if bucketIndex(hev) != i || bucketIndex(hev+1) != i+1 {
+			t.Errorf("%d isn't the highest value in bucket %d of %d", hev, i, v)
+		}
+	}
+}
+
+func TestValueAtPercentile(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []int64
+		p      float64
+		want   int64
+	}{
+		{"empty", nil, 50, 0},
+		{"median", seq(1, 100), 50, 50},
+		{"p99", seq(1, 100), 99, 99},
+		{"p100 is the max", seq(1, 100), 100, 100},
+		{"p0 is the min", seq(1, 100), 0, 1},
+		{"above 100", seq(1, 100), 150, 100},
+		{"single value", []int64{5000}, 50, 5000},
+		{"clamped to the max", []int64{10, 100_000}, 100, 100_000},
+		{"within the precision", []int64{100_001, 100_002}, 0, 100_002},
+		{"negative values are recorded as 0", []int64{-5, 3}, 50, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := New()
+			for _, v := range tt.values {
+				h.RecordValue(v)
+			}
+			if got := h.ValueAtPercentile(tt.p); got != tt.want {
+				t.Errorf("ValueAtPercentile(%v) = %d, want %d", tt.p, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValueAtPercentilePrecision(t *testing.T) {
+	h := New()
+	for _, v := range seq(1, 100_000) {
+		h.RecordValue(v)
+	}
+	for _, p := range []float64{50, 90, 99, 99.9} {
+		want := int64(p / 100 * 100_000)
+		got := h.ValueAtPercentile(p)
+		if got < want || float64(got-want)/float64(want) >= 1.0/64 {
+			t.Errorf("ValueAtPercentile(%v) = %d, want %d within 1/64", p, got, want)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a, b, all := New(), New(), New()
+	for _, v := range seq(1, 1000) {
+		if v%3 == 0 {
+			a.RecordValue(v * 7)
+		} else {
+			b.RecordValue(v * 7)
+		}
+		all.RecordValue(v * 7)
+	}
+	a.Merge(b)
+	a.Merge(New())
+
+	if *a.Summary() != *all.Summary() {
+		t.Errorf("merged %+v, want %+v", a.Summary(), all.Summary())
+	}
+}
+
+func TestSummary(t *testing.T) {
+	h := New()
+	h.Record(20 * time.Microsecond)
+	h.Record(40 * time.Microsecond)
+
+	want := Summary{
+		Count: 2,
+		Min:   20 * time.Microsecond,
+		Mean:  30 * time.Microsecond,
+		P50:   20 * time.Microsecond,
+		P90:   40 * time.Microsecond,
+		P99:   40 * time.Microsecond,
+		P999:  40 * time.Microsecond,
+		Max:   40 * time.Microsecond,
+	}
+	if got := *h.Summary(); got != want {
+		t.Errorf("Summary() = %+v, want %+v", got, want)
+	}
+
+	if got := *New().Summary(); got != (Summary{}) {
+		t.Errorf("Summary() of an empty histogram = %+v", got)
+	}
+}
+
+// seq returns the values from `from` to `to`, inclusive.
+func seq(from, to int64) []int64 {
+	var vs []int64
+	for v := from; v <= to; v++ {
+		vs = append(vs, v)
+	}
+	return vs
+}
@@ -4,15 +4,18 @@ import (
 	"compress/gzip"
 	"crypto/rand"
 	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"math/big"
 	mrand "math/rand"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/anrid/search-bench/pkg/data"
 )
@@ -28,6 +31,25 @@ const (
 	StatusOther
 )
 
+func (s Status) String() string {
+	switch s {
+	case StatusOnSale:
+		return "on_sale"
+	case StatusTrading:
+		return "trading"
+	case StatusSold:
+		return "sold_out"
+	case StatusStopped:
+		return "stop"
+	case StatusCancel:
+		return "cancel"
+	case StatusOther:
+		return "other"
+	default:
+		return fmt.Sprintf("status(%d)", int(s))
+	}
+}
+
 type ItemCondition int
 
 const (
@@ -37,6 +59,21 @@ const (
 	ItemConditionOther
 )
 
+func (c ItemCondition) String() string {
+	switch c {
+	case ItemConditionLikeNew:
+		return "like_new"
+	case ItemConditionGood:
+		return "good"
+	case ItemConditionPoor:
+		return "poor"
+	case ItemConditionOther:
+		return "other"
+	default:
+		return fmt.Sprintf("condition(%d)", int(c))
+	}
+}
+
 type Item struct {
 	ID         string `json:"id"`
 	Name       string `json:"name"`
@@ -57,6 +94,26 @@ type ItemNoDesc struct {
 	ItemCondition ItemCondition `json:"item_condition"`
 }
 
+// Overhead of an item in a bulk request, i.e. the bulk action line, JSON keys
+// and numeric fields
+const bulkOverheadBytes = 160
+
+// EstimatedSize returns an upper bound of the size of the item in a bulk
+// request, once its text has been tokenized.
+func (i *Item) EstimatedSize() int {
+	return bulkOverheadBytes + 2*len(i.ID) + tokenizedSize(i.Name) + tokenizedSize(i.Desc)
+}
+
+func (i *ItemNoDesc) EstimatedSize() int {
+	return bulkOverheadBytes + 2*len(i.ID) + tokenizedSize(i.Name)
+}
+
+// tokenizedSize returns the max size of the text once tokenized, which adds
+// at most one space per character.
+func tokenizedSize(s string) int {
+	return len(s) + utf8.RuneCountInString(s)
+}
+
 type CreateChangeLogArgs struct {
 	ChangeLogFile  string
 	DataDir        string
@@ -77,7 +134,12 @@ type ChangeLogEntry struct {
 	Insert *Item `json:"insert,omitempty"`
 }
 
-func CreateChangeLog(a CreateChangeLogArgs) (changeLog []*ChangeLogEntry) {
+// HasUpdate returns true if the entry updates at least one field.
+func (cl *ChangeLogEntry) HasUpdate() bool {
+	return cl.Update.Name != "" || cl.Update.Created != 0 || cl.Update.Status != 0
+}
+
+func CreateChangeLog(a CreateChangeLogArgs) (changeLog []*ChangeLogEntry, err error) {
 	changeLog = make([]*ChangeLogEntry, 0)
 	var updates, inserts int
 
@@ -100,7 +162,7 @@ func CreateChangeLog(a CreateChangeLogArgs) (changeLog []*ChangeLogEntry) {
 				// Create random update
 				rnd, err := rand.Int(rand.Reader, big.NewInt(10))
 				if err != nil {
-					log.Panic(err)
+					return err
 				}
 
 				cl := &ChangeLogEntry{
@@ -123,7 +185,8 @@ func CreateChangeLog(a CreateChangeLogArgs) (changeLog []*ChangeLogEntry) {
 			} else {
 				// Create insert event
 				if inserts >= maxInserts {
-					return fmt.Errorf("done after creating a change log with %d updates and %d inserts", updates, inserts)
+					// Done after creating a change log with max updates and inserts
+					return ErrStopImport
 				}
 
 				changeLog = append(changeLog, &ChangeLogEntry{
@@ -144,22 +207,29 @@ func CreateChangeLog(a CreateChangeLogArgs) (changeLog []*ChangeLogEntry) {
 
 	fmt.Printf("Creating a new change log with max %d updates and %d inserts\n", maxUpdates, maxInserts)
 
-	Import(ImportArgs{
+	_, err = Import(ImportArgs{
 		DataDir:          a.DataDir,
 		FilenameFilter:   a.FilenameFilter,
 		Batcher:          batcher,
 		MaxItemsToImport: itemsToImport,
+		MaxBadRecords:    -1,
 	})
+	if err != nil {
+		return nil, err
+	}
 
 	// Shuffle change log!
 	mrand.Shuffle(len(changeLog), func(i, j int) {
 		changeLog[i], changeLog[j] = changeLog[j], changeLog[i]
 	})
 
-	b := data.ToJSON(changeLog)
-	err := os.WriteFile(a.ChangeLogFile, b, 0777)
+	b, err := data.ToJSON(changeLog)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(a.ChangeLogFile, b, 0777)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 
 	fmt.Printf(
@@ -170,21 +240,96 @@ func CreateChangeLog(a CreateChangeLogArgs) (changeLog []*ChangeLogEntry) {
 	return
 }
 
+// ReadChangeLog streams entries from a change log file created by
+// `CreateChangeLog`, calling `forEachEntry` for each one. Reading stops at
+// the first error returned by `forEachEntry`, which is passed on to the caller.
+func ReadChangeLog(changeLogFile string, forEachEntry func(cl *ChangeLogEntry) error) error {
+	f, err := os.Open(changeLogFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := t.(json.Delim); !ok || d != '[' {
+		return fmt.Errorf("expected change log file %s to contain a JSON array", changeLogFile)
+	}
+
+	for dec.More() {
+		cl := new(ChangeLogEntry)
+		err = dec.Decode(cl)
+		if err != nil {
+			return err
+		}
+
+		err = forEachEntry(cl)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ErrStopImport can be returned by a batcher (e.g. from `ForEachBatch`) to
+// stop importing early without failing the import.
+var ErrStopImport = errors.New("stop import")
+
+// RecordError is returned by a batcher for a record that can't be parsed.
+// Such records are skipped and counted by `Import` rather than failing the
+// import, see `ImportArgs.MaxBadRecords`.
+type RecordError struct {
+	Reason string // Short reason used to group skipped records, e.g. "invalid created"
+	Err    error
+}
+
+func (e *RecordError) Error() string {
+	if e.Err == nil {
+		return e.Reason
+	}
+	return e.Reason + ": " + e.Err.Error()
+}
+
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
+
 type ImportArgs struct {
 	DataDir          string
 	FilenameFilter   string
 	MaxItemsToImport int
+	MaxBadRecords    int // Fail the import after skipping more than this many bad records (negative = no limit)
 	Batcher          Batcher
 }
 
-func Import(a ImportArgs) {
+type ImportStats struct {
+	Records     int            `json:"records"` // Records read, excluding headers
+	Imported    int            `json:"imported"`
+	Skipped     int            `json:"skipped"`
+	SkipReasons map[string]int `json:"skip_reasons,omitempty"`
+}
+
+func (s *ImportStats) skip(reason string, err error) {
+	s.Skipped++
+	s.SkipReasons[reason]++
+	if s.Skipped <= 10 {
+		fmt.Printf("WARNING: skipping bad record #%d: %s\n", s.Records, err)
+	}
+}
+
+func Import(a ImportArgs) (*ImportStats, error) {
+	stats := &ImportStats{SkipReasons: make(map[string]int)}
+
 	dir, err := os.ReadDir(a.DataDir)
 	if err != nil {
-		log.Panic(err)
+		return stats, err
 	}
 
-	var total int
-
 	for _, fi := range dir {
 		if !strings.Contains(fi.Name(), a.FilenameFilter) {
 			continue
@@ -193,80 +338,127 @@ func Import(a ImportArgs) {
 		fmt.Printf("Importing items from file: %s\n", fi.Name())
 
 		filename := filepath.Join(a.DataDir, fi.Name())
-		f, err := os.Open(filename)
+		exitEarly, err := importFile(filename, a, stats)
 		if err != nil {
-			log.Panic(err)
+			if errors.Is(err, ErrStopImport) {
+				break
+			}
+			return stats, fmt.Errorf("failed to import items from file %s: %w", filename, err)
 		}
 
-		gr, err := gzip.NewReader(f)
-		if err != nil {
-			log.Panic(err)
+		if exitEarly {
+			break
 		}
+	}
 
-		cr := csv.NewReader(gr)
-		var lines int
-		var exitEarly bool
-		var headers []string
+	fmt.Printf("Imported %d items total (skipped %d bad records)\n", stats.Imported, stats.Skipped)
 
-		for {
-			rec, err := cr.Read()
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				log.Panic(err)
+	return stats, nil
+}
+
+func importFile(filename string, a ImportArgs, stats *ImportStats) (exitEarly bool, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return false, err
+	}
+
+	cr := csv.NewReader(gr)
+	cr.FieldsPerRecord = -1 // The number of fields is checked by the batcher
+	var lines int
+	var headers []string
+
+	for {
+		rec, err := cr.Read()
+		if err != nil {
+			if err == io.EOF {
+				break
 			}
 
+			var pe *csv.ParseError
+			if !errors.As(err, &pe) || lines == 0 {
+				return false, err
+			}
+
+			// Skip malformed CSV lines, the reader picks up at the next line
 			lines++
-			if lines == 1 {
-				fmt.Printf("Headers: %+v\n", rec)
-				headers = rec
-				continue
+			stats.Records++
+			stats.skip("malformed csv", err)
+			if a.MaxBadRecords >= 0 && stats.Skipped > a.MaxBadRecords {
+				return false, fmt.Errorf("skipped more than %d bad records: %w", a.MaxBadRecords, err)
 			}
+			continue
+		}
 
-			total++
+		lines++
+		if lines == 1 {
+			fmt.Printf("Headers: %+v\n", rec)
+			headers = rec
+			continue
+		}
 
-			err = a.Batcher.Add(rec, headers)
-			if err != nil {
-				log.Panic(err)
-			}
+		stats.Records++
 
-			if total%10_000 == 0 {
-				fmt.Printf("Processed %d records ..\n", total)
+		err = a.Batcher.Add(rec, headers)
+		if err != nil {
+			var re *RecordError
+			if !errors.As(err, &re) {
+				return false, err
 			}
 
-			if a.MaxItemsToImport > 0 && total >= a.MaxItemsToImport {
-				exitEarly = true
-				break
+			stats.skip(re.Reason, err)
+			if a.MaxBadRecords >= 0 && stats.Skipped > a.MaxBadRecords {
+				return false, fmt.Errorf("skipped more than %d bad records: %w", a.MaxBadRecords, err)
 			}
+			continue
 		}
 
-		err = a.Batcher.Flush()
-		if err != nil {
-			log.Panic(err)
+		stats.Imported++
+
+		if stats.Imported%10_000 == 0 {
+			fmt.Printf("Processed %d records ..\n", stats.Imported)
 		}
 
-		f.Close()
-		if exitEarly {
+		if a.MaxItemsToImport > 0 && stats.Imported >= a.MaxItemsToImport {
+			exitEarly = true
 			break
 		}
 	}
 
-	fmt.Printf("Imported %d items total\n", total)
+	err = a.Batcher.Flush()
+	if err != nil {
+		return false, err
+	}
+
+	return exitEarly, nil
 }
 
+// ItemsBatch collects items and passes them to `ForEachBatch` once the batch
+// holds `Size` items, reaches `MaxBytes` or is `MaxWait` old, whichever comes
+// first.
 type ItemsBatch struct {
 	Size         int
+	MaxBytes     int           // Max estimated size of the batch in a bulk request (0 = no limit)
+	MaxWait      time.Duration // Max time since the first item was added, flushed on a timer (0 = no limit)
 	Total        int
 	Items        []*Item
 	ForEachBatch func(totalItems int, items []*Item) error
+	batchState
 }
 
 func (b *ItemsBatch) Add(rec, headers []string) error {
-	isItem := len(rec) == 6 && headers[2] == "description"
+	isItem := len(headers) == 6 && headers[2] == "description"
 	if !isItem {
 		return fmt.Errorf("does not look like an Item record: %+v", headers)
 	}
+	if len(rec) != len(headers) {
+		return &RecordError{Reason: "unexpected number of fields", Err: fmt.Errorf("got %d fields", len(rec))}
+	}
 
 	i := new(Item)
 
@@ -285,8 +477,23 @@ func (b *ItemsBatch) Add(rec, headers []string) error {
 	default:
 		i.Status = StatusOther
 	}
-	i.Created = data.ToUnixTimestamp(rec[4])
-	i.CategoryID = int(data.ToInt64(rec[5]))
+
+	var err error
+	i.Created, err = data.ToUnixTimestamp(rec[4])
+	if err != nil {
+		return &RecordError{Reason: "invalid created", Err: err}
+	}
+	categoryID, err := data.ToInt64(rec[5])
+	if err != nil {
+		return &RecordError{Reason: "invalid category_id", Err: err}
+	}
+	i.CategoryID = int(categoryID)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return b.err
+	}
 
 	b.Total++
 
@@ -294,41 +501,64 @@ func (b *ItemsBatch) Add(rec, headers []string) error {
 		fmt.Printf("Preview item: %v\n", rec)
 	}
 
-	b.Items = append(b.Items, i)
-
-	if len(b.Items) >= b.Size {
-		err := b.ForEachBatch(b.Total, b.Items)
+	size := i.EstimatedSize()
+	if reason := b.full(len(b.Items), size, b.Size, b.MaxBytes); reason != "" {
+		err := b.flush(reason)
 		if err != nil {
 			return err
 		}
-		b.Items = nil
+	}
+
+	b.Items = append(b.Items, i)
+	b.added(size, b.MaxWait, b.flush)
+
+	if reason := b.full(len(b.Items), 0, b.Size, b.MaxBytes); reason != "" {
+		return b.flush(reason)
 	}
 	return nil
 }
 
 func (b *ItemsBatch) Flush() error {
-	if len(b.Items) > 0 {
-		err := b.ForEachBatch(b.Total, b.Items)
-		if err != nil {
-			return err
-		}
-		b.Items = nil
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return b.err
+	}
+	return b.flush(FlushEnd)
+}
+
+func (b *ItemsBatch) flush(reason string) error {
+	if len(b.Items) == 0 {
+		return nil
 	}
+	err := b.ForEachBatch(b.Total, b.Items)
+	if err != nil {
+		return err
+	}
+	b.Items = nil
+	b.flushed(reason)
 	return nil
 }
 
+// ItemsNoDescBatch works like `ItemsBatch`, for items without a description.
 type ItemsNoDescBatch struct {
 	Size         int
+	MaxBytes     int
+	MaxWait      time.Duration
 	Total        int
 	Items        []*ItemNoDesc
 	ForEachBatch func(totalItems int, items []*ItemNoDesc) error
+	batchState
 }
 
 func (b *ItemsNoDescBatch) Add(rec, headers []string) error {
-	isItem := len(rec) == 8 && headers[2] == "status"
+	isItem := len(headers) == 8 && headers[2] == "status"
 	if !isItem {
 		return fmt.Errorf("does not look like an ItemNoDesc record: %+v", headers)
 	}
+	if len(rec) != len(headers) {
+		return &RecordError{Reason: "unexpected number of fields", Err: fmt.Errorf("got %d fields", len(rec))}
+	}
 
 	i := new(ItemNoDesc)
 
@@ -348,10 +578,26 @@ func (b *ItemsNoDescBatch) Add(rec, headers []string) error {
 	default:
 		i.Status = StatusOther
 	}
-	i.Created = data.ToInt64(rec[3])
-	i.Updated = data.ToInt64(rec[4])
-	i.CategoryID = int(data.ToInt64(rec[5]))
-	i.Price = int(data.ToInt64(rec[6]))
+
+	var err error
+	i.Created, err = data.ToInt64(rec[3])
+	if err != nil {
+		return &RecordError{Reason: "invalid created", Err: err}
+	}
+	i.Updated, err = data.ToInt64(rec[4])
+	if err != nil {
+		return &RecordError{Reason: "invalid updated", Err: err}
+	}
+	categoryID, err := data.ToInt64(rec[5])
+	if err != nil {
+		return &RecordError{Reason: "invalid category_id", Err: err}
+	}
+	i.CategoryID = int(categoryID)
+	price, err := data.ToInt64(rec[6])
+	if err != nil {
+		return &RecordError{Reason: "invalid price", Err: err}
+	}
+	i.Price = int(price)
 	switch rec[7] {
 	case "1":
 		i.ItemCondition = ItemConditionLikeNew
@@ -363,36 +609,127 @@ func (b *ItemsNoDescBatch) Add(rec, headers []string) error {
 		i.ItemCondition = ItemConditionOther
 	}
 
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return b.err
+	}
+
 	b.Total++
 
 	if b.Total <= 10 {
 		fmt.Printf("Preview item: %v\n", rec)
 	}
 
-	b.Items = append(b.Items, i)
-
-	if len(b.Items) >= b.Size {
-		err := b.ForEachBatch(b.Total, b.Items)
+	size := i.EstimatedSize()
+	if reason := b.full(len(b.Items), size, b.Size, b.MaxBytes); reason != "" {
+		err := b.flush(reason)
 		if err != nil {
 			return err
 		}
-		b.Items = nil
+	}
+
+	b.Items = append(b.Items, i)
+	b.added(size, b.MaxWait, b.flush)
+
+	if reason := b.full(len(b.Items), 0, b.Size, b.MaxBytes); reason != "" {
+		return b.flush(reason)
 	}
 	return nil
 }
 
 func (b *ItemsNoDescBatch) Flush() error {
-	if len(b.Items) > 0 {
-		err := b.ForEachBatch(b.Total, b.Items)
-		if err != nil {
-			return err
-		}
-		b.Items = nil
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return b.err
 	}
+	return b.flush(FlushEnd)
+}
+
+func (b *ItemsNoDescBatch) flush(reason string) error {
+	if len(b.Items) == 0 {
+		return nil
+	}
+	err := b.ForEachBatch(b.Total, b.Items)
+	if err != nil {
+		return err
+	}
+	b.Items = nil
+	b.flushed(reason)
 	return nil
 }
 
 type Batcher interface {
 	Add(rec, headers []string) error
 	Flush() error
+	// Flushes returns the number of batches flushed, by reason (see `FlushSize` etc).
+	Flushes() map[string]int
+}
+
+// Reasons for flushing a batch
+const (
+	FlushSize  = "size"
+	FlushBytes = "bytes"
+	FlushWait  = "wait"
+	FlushEnd   = "end" // End of a data file
+)
+
+// batchState tracks the estimated size of the current batch, and flushes it
+// on a timer once it's `MaxWait` old. Batches are only changed while holding
+// `mu`, since the timer flushes from another goroutine.
+type batchState struct {
+	mu      sync.Mutex
+	bytes   int
+	timer   *time.Timer // Started when the first item of a batch is added
+	batches int         // Batches flushed so far, so that a late timer doesn't flush the next batch
+	err     error       // Error flushing on the timer, returned when adding the next item
+	flushes map[string]int
+}
+
+// added counts an item of estimated `size` bytes, starting the timer that
+// calls `flush` after `maxWait` for the first item of a batch.
+func (s *batchState) added(size int, maxWait time.Duration, flush func(reason string) error) {
+	if s.timer == nil && maxWait > 0 {
+		batch := s.batches
+		s.timer = time.AfterFunc(maxWait, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.batches == batch && s.err == nil {
+				s.err = flush(FlushWait)
+			}
+		})
+	}
+	s.bytes += size
+}
+
+// full returns the reason to flush a batch of `items` items before adding an
+// item of estimated `size` bytes (0 after adding it), if any.
+func (s *batchState) full(items, size, maxItems, maxBytes int) string {
+	switch {
+	case items >= maxItems:
+		return FlushSize
+	case items > 0 && maxBytes > 0 && s.bytes+size > maxBytes:
+		return FlushBytes
+	}
+	return ""
+}
+
+func (s *batchState) flushed(reason string) {
+	s.bytes = 0
+	s.batches++
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if s.flushes == nil {
+		s.flushes = make(map[string]int)
+	}
+	s.flushes[reason]++
+}
+
+func (s *batchState) Flushes() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flushes
 }
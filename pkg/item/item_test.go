@@ -0,0 +1,130 @@
+package item
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBatchStateFull(t *testing.T) {
+	tests := []struct {
+		name     string
+		bytes    int // Estimated size of the batch so far
+		items    int
+		size     int // Of the item to add, 0 after adding it
+		maxItems int
+		maxBytes int
+		want     string
+	}{
+		{name: "empty", maxItems: 3, maxBytes: 100},
+		{name: "below limits", bytes: 50, items: 2, size: 40, maxItems: 3, maxBytes: 100},
+		{name: "count reached", bytes: 50, items: 3, maxItems: 3, maxBytes: 100, want: FlushSize},
+		{name: "count and bytes reached", bytes: 150, items: 3, maxItems: 3, maxBytes: 100, want: FlushSize},
+		{name: "bytes at limit", bytes: 60, items: 2, size: 40, maxItems: 3, maxBytes: 100},
+		{name: "bytes over limit with the next item", bytes: 60, items: 2, size: 41, maxItems: 3, maxBytes: 100, want: FlushBytes},
+		{name: "single item over limit", bytes: 150, items: 1, maxItems: 3, maxBytes: 100, want: FlushBytes},
+		{name: "oversized first item", size: 150, maxItems: 3, maxBytes: 100},
+		{name: "no bytes limit", bytes: 1 << 30, items: 2, size: 1 << 30, maxItems: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &batchState{bytes: tt.bytes}
+			if got := s.full(tt.items, tt.size, tt.maxItems, tt.maxBytes); got != tt.want {
+				t.Errorf("full() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+var noDescHeaders = []string{"id", "name", "status", "created", "updated", "category_id", "price", "item_condition"}
+
+func noDescRecord(id string) []string {
+	return []string{id, "name", "on_sale", "1700000000", "1700000000", "1", "1000", "1"}
+}
+
+func TestItemsNoDescBatchFlushes(t *testing.T) {
+	var batches [][]string
+	b := &ItemsNoDescBatch{
+		Size:     2,
+		MaxBytes: 1 << 20,
+		ForEachBatch: func(totalItems int, items []*ItemNoDesc) error {
+			var ids []string
+			for _, i := range items {
+				ids = append(ids, i.ID)
+			}
+			batches = append(batches, ids)
+			return nil
+		},
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		if err := b.Add(noDescRecord(id), noDescHeaders); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(batches) != 2 || len(batches[0]) != 2 || len(batches[1]) != 1 {
+		t.Errorf("got batches %v, want [[a b] [c]]", batches)
+	}
+	if f := b.Flushes(); f[FlushSize] != 1 || f[FlushEnd] != 1 {
+		t.Errorf("got flushes %v", f)
+	}
+}
+
+func TestItemsNoDescBatchMaxWait(t *testing.T) {
+	flushed := make(chan int, 1)
+	b := &ItemsNoDescBatch{
+		Size:    100,
+		MaxWait: 10 * time.Millisecond,
+		ForEachBatch: func(totalItems int, items []*ItemNoDesc) error {
+			flushed <- len(items)
+			return nil
+		},
+	}
+	if err := b.Add(noDescRecord("a"), noDescHeaders); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flushed without adding more items
+	select {
+	case n := <-flushed:
+		if n != 1 {
+			t.Errorf("flushed %d items, want 1", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("batch wasn't flushed after MaxWait")
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if f := b.Flushes(); f[FlushWait] != 1 || f[FlushEnd] != 0 {
+		t.Errorf("got flushes %v", f)
+	}
+}
+
+func TestItemsNoDescBatchMaxWaitError(t *testing.T) {
+	errFull := errors.New("pipeline failed")
+	flushed := make(chan struct{})
+	b := &ItemsNoDescBatch{
+		Size:    100,
+		MaxWait: 10 * time.Millisecond,
+		ForEachBatch: func(totalItems int, items []*ItemNoDesc) error {
+			close(flushed)
+			return errFull
+		},
+	}
+	if err := b.Add(noDescRecord("a"), noDescHeaders); err != nil {
+		t.Fatal(err)
+	}
+	<-flushed
+
+	// Waits for the timer's flush to return
+	if err := b.Add(noDescRecord("b"), noDescHeaders); !errors.Is(err, errFull) {
+		t.Errorf("got error %v, want %v", err, errFull)
+	}
+	if err := b.Flush(); !errors.Is(err, errFull) {
+		t.Errorf("got error %v from Flush, want %v", err, errFull)
+	}
+}
@@ -0,0 +1,136 @@
+package manticore
+
+import (
+	"fmt"
+
+	"github.com/anrid/search-bench/pkg/engine"
+	"github.com/anrid/search-bench/pkg/item"
+)
+
+func init() {
+	engine.Register("manticore", func(cfg *engine.Config) (engine.Engine, error) {
+		c, err := NewClient(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return &Engine{c: c}, nil
+	})
+}
+
+// Engine implements `engine.Engine` for Manticore Search.
+type Engine struct {
+	c *Client
+}
+
+func (e *Engine) Name() string {
+	return "manticore"
+}
+
+func (e *Engine) Version() (string, error) {
+	return e.c.Version()
+}
+
+func (e *Engine) SanityTest() error {
+	return e.c.SanityTest()
+}
+
+// CreateIndex creates the index with a fixed schema, index variables aren't
+// supported for Manticore.
+func (e *Engine) CreateIndex(index string, vars engine.IndexVars) error {
+	if len(vars) > 0 {
+		fmt.Printf("WARNING: ignoring index variables for manticore: %s\n", vars)
+	}
+
+	switch index {
+	case ItemsIndexName:
+		return e.c.CreateItemsIndex()
+	case ItemsNoDescIndexName:
+		return e.c.CreateItemsNoDescIndex()
+	default:
+		return fmt.Errorf("unsupported index '%s'", index)
+	}
+}
+
+// BulkIndex indexes a batch as a whole: per document results and retries of
+// rejected documents aren't supported for Manticore.
+func (e *Engine) BulkIndex(b *engine.Batch) (*engine.BulkResult, error) {
+	var err error
+	switch {
+	case len(b.Items) > 0:
+		err = e.c.BulkIndexItems(b.Items)
+	case len(b.ItemsNoDesc) > 0:
+		err = e.c.BulkIndexItemsNoDesc(b.ItemsNoDesc)
+	case len(b.Changes) > 0:
+		err = e.c.BulkApplyChanges(b.Index, b.Changes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &engine.BulkResult{Indexed: b.Len()}, nil
+}
+
+func (e *Engine) Search(r *engine.SearchRequest) (*engine.SearchResult, error) {
+	se, err := e.c.Search(r.Index, r.SearchQuery(), r.From, r.Size, r.FetchSource)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &engine.SearchResult{
+		Took:          se.Took,
+		Total:         se.Hits.Total,
+		TotalRelation: se.Hits.TotalRelation,
+	}
+	for _, h := range se.Hits.Hits {
+		hit := &engine.Hit{
+			ID:    h.Source.ItemID,
+			Score: h.Score,
+		}
+		switch {
+		case !r.FetchSource:
+		case r.Index == ItemsNoDescIndexName:
+			hit.SourceNoDesc = &item.ItemNoDesc{
+				ID:            h.Source.ItemID,
+				Name:          h.Source.Name,
+				Status:        h.Source.Status,
+				Created:       h.Source.Created,
+				Updated:       h.Source.Updated,
+				CategoryID:    h.Source.CategoryID,
+				Price:         h.Source.Price,
+				ItemCondition: h.Source.ItemCondition,
+			}
+		default:
+			hit.Source = &item.Item{
+				ID:         h.Source.ItemID,
+				Name:       h.Source.Name,
+				Desc:       h.Source.Desc,
+				Status:     h.Source.Status,
+				Created:    h.Source.Created,
+				CategoryID: h.Source.CategoryID,
+			}
+		}
+		res.Hits = append(res.Hits, hit)
+	}
+
+	return res, nil
+}
+
+func (e *Engine) Refresh(index string) error {
+	return e.c.Refresh(index)
+}
+
+func (e *Engine) Stats(index string) (*engine.IndexStats, error) {
+	stats, err := e.c.IndexStats(index)
+	if err != nil {
+		return nil, err
+	}
+
+	return &engine.IndexStats{
+		DocsCount:   stats.IndexedDocuments,
+		SizeInBytes: stats.DiskBytes + stats.RAMBytes,
+		Native:      stats,
+	}, nil
+}
+
+func (e *Engine) Settings(index string) (interface{}, error) {
+	return e.c.IndexSettings(index)
+}
@@ -0,0 +1,614 @@
+package manticore
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/anrid/search-bench/pkg/data"
+	"github.com/anrid/search-bench/pkg/engine"
+	"github.com/anrid/search-bench/pkg/item"
+	"github.com/anrid/search-bench/pkg/query"
+	"github.com/bytedance/sonic"
+)
+
+const (
+	DefaultURL           = "http://127.0.0.1:9308"
+	SanityTestIndexName  = "test"
+	ItemsIndexName       = "items"
+	ItemsNoDescIndexName = "items_no_desc"
+	DebugPrint           = false
+)
+
+type Map = map[string]interface{}
+
+// Client is a Manticore Search HTTP JSON API client.
+type Client struct {
+	URL  string
+	HTTP *http.Client
+}
+
+func NewClient(cfg *engine.Config) (*Client, error) {
+	httpClient, err := cfg.HTTPClient()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		URL:  strings.TrimSuffix(cfg.URL, "/"),
+		HTTP: httpClient,
+	}
+	if c.URL == "" {
+		c.URL = DefaultURL
+	}
+
+	return c, nil
+}
+
+// TextFields returns the fields keywords are matched on in the given index.
+func TextFields(index string) []string {
+	if index == ItemsNoDescIndexName {
+		return []string{"name"}
+	}
+	return []string{"name", "desc"}
+}
+
+// BuildQuery translates a search query into a Manticore JSON query, matching
+// the keyword on any of the given fields, and the sort order to use (nil if
+// none).
+func BuildQuery(q *query.SearchQuery, fields []string) (mcQuery Map, sort []Map) {
+	// Manticore has no `filter` clause, so filters go into `must` next
+	// to the full-text match (filters don't affect the score anyway)
+	must := []Map{}
+
+	if len(q.CategoryIDs) > 0 {
+		must = append(must, Map{"in": Map{"category_id": q.CategoryIDs}})
+	}
+	if len(q.Statuses) > 0 {
+		must = append(must, Map{"in": Map{"status": q.Statuses}})
+	}
+	if q.PriceMin > 0 || q.PriceMax > 0 {
+		price := Map{}
+		if q.PriceMin > 0 {
+			price["gte"] = q.PriceMin
+		}
+		if q.PriceMax > 0 {
+			price["lte"] = q.PriceMax
+		}
+		must = append(must, Map{"range": Map{"price": price}})
+	}
+	if len(q.Conditions) > 0 {
+		must = append(must, Map{"in": Map{"item_condition": q.Conditions}})
+	}
+	if len(must) > 0 {
+		sort = []Map{{"created": "desc"}}
+	}
+
+	if q.Keyword != "" {
+		// Matching any term in either field is the equivalent of the two
+		// `should` match clauses with `minimum_should_match: 1` used in ES
+		must = append(must, Map{"match": Map{strings.Join(fields, ","): q.Keyword}})
+		sort = []Map{{"_score": "desc"}}
+	}
+
+	var mustNot []Map
+	for _, kw := range q.ExcludeKeywords {
+		mustNot = append(mustNot, Map{"match": Map{strings.Join(fields, ","): Map{"query": kw, "operator": "and"}}})
+		if sort == nil {
+			sort = []Map{{"created": "desc"}}
+		}
+	}
+
+	if field, order := q.SortField(); field != "" {
+		sort = []Map{{field: order}}
+	}
+
+	if len(must) == 0 && len(mustNot) == 0 {
+		return Map{"match_all": Map{}}, sort
+	}
+	boolQuery := Map{}
+	if len(must) > 0 {
+		boolQuery["must"] = must
+	}
+	if len(mustNot) > 0 {
+		boolQuery["must_not"] = mustNot
+	}
+	return Map{"bool": boolQuery}, sort
+}
+
+func (c *Client) Search(index string, q *query.SearchQuery, offset, limit int, fetchSource bool) (*SearchResult, error) {
+	matchQuery, sort := BuildQuery(q, TextFields(index))
+
+	mcQuery := Map{
+		"index":  index,
+		"query":  matchQuery,
+		"limit":  limit,
+		"offset": offset,
+	}
+	if !fetchSource {
+		mcQuery["_source"] = []string{"item_id"}
+	}
+	if sort != nil {
+		mcQuery["sort"] = sort
+	}
+
+	if DebugPrint {
+		fmt.Printf("Query:\n%s\n", data.ToPrettyJSON(mcQuery))
+	}
+
+	b, err := data.ToJSON(mcQuery)
+	if err != nil {
+		return nil, err
+	}
+	res, code, err := c.Call(http.MethodPost, c.URL+"/search", b)
+	if err != nil {
+		return nil, err
+	}
+	if code >= 300 {
+		fmt.Printf("Query dump:\n=====================\n%s\n", data.ToPrettyJSON(mcQuery))
+		return nil, fmt.Errorf("got unexpected status code %d : %s", code, res)
+	}
+
+	se := new(SearchResult)
+	err = sonic.Unmarshal(res, se)
+	if err != nil {
+		return nil, err
+	}
+
+	return se, nil
+}
+
+type SearchResult struct {
+	Took     int64 `json:"took"` // 2
+	TimedOut bool  `json:"timed_out"`
+
+	Hits struct {
+		Total         int64  `json:"total"`
+		TotalRelation string `json:"total_relation"`
+		Hits          []struct {
+			Score  float64    `json:"_score"` // 1680
+			Source *HitSource `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+// Doc is an item as stored in Manticore. Manticore document IDs must be
+// integers, so the original item ID is kept in the `item_id` attribute.
+type Doc struct {
+	ItemID     string      `json:"item_id"`
+	Name       string      `json:"name"`
+	Desc       string      `json:"desc"`
+	Status     item.Status `json:"status"`
+	Created    int64       `json:"created"`
+	CategoryID int         `json:"category_id"`
+}
+
+type DocNoDesc struct {
+	ItemID        string             `json:"item_id"`
+	Name          string             `json:"name"`
+	Status        item.Status        `json:"status"`
+	Created       int64              `json:"created"`
+	Updated       int64              `json:"updated"`
+	CategoryID    int                `json:"category_id"`
+	Price         int                `json:"price"`
+	ItemCondition item.ItemCondition `json:"item_condition"`
+}
+
+// HitSource is a document in a search result, from either index.
+type HitSource struct {
+	DocNoDesc
+	Desc string `json:"desc"`
+}
+
+// DocID maps an item ID onto a positive 63-bit Manticore document ID.
+func DocID(itemID string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(itemID))
+	return int64(h.Sum64() >> 1)
+}
+
+func (c *Client) BulkIndexItems(items []*item.Item) error {
+	var docs []interface{}
+	for _, i := range items {
+		docs = append(docs, Map{"replace": Map{
+			"index": ItemsIndexName,
+			"id":    DocID(i.ID),
+			"doc": &Doc{
+				ItemID:     i.ID,
+				Name:       i.Name,
+				Desc:       i.Desc,
+				Status:     i.Status,
+				Created:    i.Created,
+				CategoryID: i.CategoryID,
+			},
+		}})
+	}
+
+	bulk, err := BuildBulkBody(docs...)
+	if err != nil {
+		return err
+	}
+	if len(bulk) > 10_000_000 {
+		fmt.Printf("WARNING: bulk index body is %d bytes large!\n", len(bulk))
+	}
+
+	fmt.Printf("Bulk indexing %d items (JSON payload: %d bytes)\n", len(items), len(bulk))
+	res, code, err := c.CallNDJSON(http.MethodPost, c.URL+"/bulk", bulk)
+	return EnsureNoError(res, code, err)
+}
+
+func (c *Client) BulkIndexItemsNoDesc(items []*item.ItemNoDesc) error {
+	var docs []interface{}
+	for _, i := range items {
+		docs = append(docs, Map{"replace": Map{
+			"index": ItemsNoDescIndexName,
+			"id":    DocID(i.ID),
+			"doc": &DocNoDesc{
+				ItemID:        i.ID,
+				Name:          i.Name,
+				Status:        i.Status,
+				Created:       i.Created,
+				Updated:       i.Updated,
+				CategoryID:    i.CategoryID,
+				Price:         i.Price,
+				ItemCondition: i.ItemCondition,
+			},
+		}})
+	}
+
+	bulk, err := BuildBulkBody(docs...)
+	if err != nil {
+		return err
+	}
+	if len(bulk) > 10_000_000 {
+		fmt.Printf("WARNING: bulk index body is %d bytes large!\n", len(bulk))
+	}
+
+	fmt.Printf("Bulk indexing %d items (JSON payload: %d bytes)\n", len(items), len(bulk))
+	res, code, err := c.CallNDJSON(http.MethodPost, c.URL+"/bulk", bulk)
+	return EnsureNoError(res, code, err)
+}
+
+// BulkApplyChanges applies change log updates and inserts to the given table.
+// Only attributes (`created` and `status`) can be updated in place in
+// Manticore, updating a full-text field like `name` results in an error.
+func (c *Client) BulkApplyChanges(index string, changes []*item.ChangeLogEntry) error {
+	var docs []interface{}
+	for _, cl := range changes {
+		if cl.Insert != nil {
+			i := cl.Insert
+			docs = append(docs, Map{"replace": Map{
+				"index": index,
+				"id":    DocID(i.ID),
+				"doc": &Doc{
+					ItemID:     i.ID,
+					Name:       i.Name,
+					Desc:       i.Desc,
+					Status:     i.Status,
+					Created:    i.Created,
+					CategoryID: i.CategoryID,
+				},
+			}})
+		} else {
+			docs = append(docs, Map{"update": Map{
+				"index": index,
+				"id":    DocID(cl.ItemID),
+				"doc":   cl.Update,
+			}})
+		}
+	}
+
+	bulk, err := BuildBulkBody(docs...)
+	if err != nil {
+		return err
+	}
+
+	res, code, err := c.CallNDJSON(http.MethodPost, c.URL+"/bulk", bulk)
+	return EnsureNoError(res, code, err)
+}
+
+// EnsureNoError returns an error if a bulk request failed or if any of the
+// documents in it were rejected.
+func EnsureNoError(res []byte, statusCode int, err error) error {
+	if err != nil {
+		return err
+	}
+	if statusCode != 200 {
+		return fmt.Errorf("got bad HTTP status code %d : %.500s", statusCode, res)
+	}
+	if !strings.Contains(string(res), `"errors":false`) {
+		return fmt.Errorf("got Manticore error: %.500s", res)
+	}
+	return nil
+}
+
+// charsetTable is the charset of all tables. Japanese text is tokenized by
+// Kagome before indexing, so all we need is for CJK glyphs to be treated as
+// word characters: the default `non_cont` only covers non-continuous scripts
+// (Latin, Cyrillic etc.), CJK glyphs are added by `cjk`.
+const charsetTable = "non_cont,cjk"
+
+func (c *Client) CreateItemsIndex() error {
+	// NOTE: `desc` is a reserved word in SQL and must be quoted
+	return c.createTable(ItemsIndexName, "item_id string, "+
+		"name text, "+
+		"`desc` text, "+
+		"status integer, "+
+		"created bigint, "+
+		"category_id integer")
+}
+
+func (c *Client) CreateItemsNoDescIndex() error {
+	return c.createTable(ItemsNoDescIndexName, "item_id string, "+
+		"name text, "+
+		"status integer, "+
+		"created bigint, "+
+		"updated bigint, "+
+		"category_id integer, "+
+		"price integer, "+
+		"item_condition integer")
+}
+
+// createTable (re)creates a table with the given columns and `charsetTable`.
+func (c *Client) createTable(table, columns string) error {
+	if _, err := c.SQL("DROP TABLE IF EXISTS " + table); err != nil {
+		return err
+	}
+	_, err := c.SQL("CREATE TABLE " + table + " (" + columns + ") charset_table='" + charsetTable + "'")
+	return err
+}
+
+// SanityTest creates a test table, inserts a few documents and checks that
+// queries find them, including a Japanese keyword query.
+func (c *Client) SanityTest() error {
+	if err := c.createTable(SanityTestIndexName, "age integer, email string, name text"); err != nil {
+		return fmt.Errorf("sanity test failed: %w", err)
+	}
+
+	bulk, err := BuildBulkBody(
+		Map{"replace": Map{"index": SanityTestIndexName, "id": 101, "doc": Map{"age": 30, "name": "Mr Magoo", "email": "mr@magoo.se"}}},
+		Map{"replace": Map{"index": SanityTestIndexName, "id": 102, "doc": Map{"age": 25, "name": "Ms Molly", "email": "ms@molly.se"}}},
+		Map{"replace": Map{"index": SanityTestIndexName, "id": 102, "doc": Map{"age": 21, "name": "Mrs Daisy Malone", "email": "dmalone@molly.se"}}},
+		// Tokenized by Kagome, as item names and descriptions are
+		Map{"replace": Map{"index": SanityTestIndexName, "id": 103, "doc": Map{"age": 40, "name": "ナイキ スニーカー 新品", "email": "nike@molly.se"}}},
+	)
+	if err != nil {
+		return err
+	}
+
+	res, code, err := c.CallNDJSON(http.MethodPost, c.URL+"/bulk", bulk)
+	if err := EnsureNoError(res, code, err); err != nil {
+		return fmt.Errorf("sanity test bulk insert failed: %w", err)
+	}
+
+	if DebugPrint {
+		fmt.Printf("res: %s (code: %d)\n", res, code)
+	}
+
+	if err := c.Refresh(SanityTestIndexName); err != nil {
+		return fmt.Errorf("sanity test failed: %w", err)
+	}
+
+	res, err = c.search(Map{
+		"index": SanityTestIndexName,
+		"query": Map{
+			"bool": Map{
+				"must": []Map{
+					{"match_phrase": Map{"name": "daisy malone"}},
+					{"range": Map{"age": Map{"gte": 10}}},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("sanity test failed: %w", err)
+	}
+
+	if !strings.Contains(string(res), "Mrs Daisy Malone") {
+		return fmt.Errorf("sanity test failed: expected result to contain the string \"Mrs Daisy Malone\" (got: %.500s)", res)
+	}
+
+	// Japanese keywords only match if CJK glyphs are indexed (see `charsetTable`)
+	res, err = c.search(Map{
+		"index": SanityTestIndexName,
+		"query": Map{"match": Map{"name": "スニーカー"}},
+	})
+	if err != nil {
+		return fmt.Errorf("sanity test failed: %w", err)
+	}
+
+	if !strings.Contains(string(res), "nike@molly.se") {
+		return fmt.Errorf("sanity test failed: expected a Japanese keyword query to match \"ナイキ スニーカー 新品\", check the charset_table of the tables (got: %.500s)", res)
+	}
+
+	fmt.Println("Connected to Manticore at " + c.URL + ", created test table and executed a few queries - sanity test passed!")
+	return nil
+}
+
+// search sends a raw search request, returning the response body.
+func (c *Client) search(q Map) ([]byte, error) {
+	b, err := data.ToJSON(q)
+	if err != nil {
+		return nil, err
+	}
+	res, code, err := c.Call(http.MethodPost, c.URL+"/search", b)
+	if err != nil {
+		return nil, err
+	}
+
+	if DebugPrint {
+		fmt.Printf("res: %s (code: %d)\n", res, code)
+	}
+
+	if code >= 300 {
+		return nil, fmt.Errorf("got unexpected status code %d : %.500s", code, res)
+	}
+	return res, nil
+}
+
+type MCIndexStats struct {
+	IndexedDocuments int64  `json:"indexed_documents"`
+	IndexedBytes     int64  `json:"indexed_bytes"`
+	DiskBytes        int64  `json:"disk_bytes"`
+	RAMBytes         int64  `json:"ram_bytes"`
+	DiskChunks       int64  `json:"disk_chunks"`
+	RAMChunk         int64  `json:"ram_chunk"`
+	QueryTimeTotal   string `json:"query_time_total"`
+}
+
+func (c *Client) IndexStats(index string) (*MCIndexStats, error) {
+	rows, err := c.SQL("SHOW TABLE " + index + " STATUS")
+	if err != nil {
+		return nil, err
+	}
+
+	vars := make(map[string]string)
+	for _, r := range rows {
+		vars[fmt.Sprint(r["Variable_name"])] = fmt.Sprint(r["Value"])
+	}
+
+	if DebugPrint {
+		fmt.Printf("All Stats:\n%s\n\n", data.ToPrettyJSON(vars))
+	}
+
+	toInt64 := func(name string) int64 {
+		n, _ := data.ToInt64(vars[name]) // Missing or non-numeric values count as 0
+		return n
+	}
+
+	return &MCIndexStats{
+		IndexedDocuments: toInt64("indexed_documents"),
+		IndexedBytes:     toInt64("indexed_bytes"),
+		DiskBytes:        toInt64("disk_bytes"),
+		RAMBytes:         toInt64("ram_bytes"),
+		DiskChunks:       toInt64("disk_chunks"),
+		RAMChunk:         toInt64("ram_chunk"),
+		QueryTimeTotal:   vars["query_time_total"],
+	}, nil
+}
+
+func (c *Client) Version() (string, error) {
+	rows, err := c.SQL("SHOW STATUS LIKE 'version'")
+	if err != nil || len(rows) == 0 {
+		return "", err
+	}
+	return fmt.Sprint(rows[0]["Value"]), nil
+}
+
+func (c *Client) IndexSettings(index string) (map[string]string, error) {
+	rows, err := c.SQL("SHOW TABLE " + index + " SETTINGS")
+	if err != nil {
+		return nil, err
+	}
+
+	settings := make(map[string]string)
+	for _, r := range rows {
+		settings[fmt.Sprint(r["Variable_name"])] = fmt.Sprint(r["Value"])
+	}
+	return settings, nil
+}
+
+// Refresh flushes the RAM chunk of a real-time table to disk. Manticore makes
+// documents searchable as soon as they're inserted, so this mainly ensures
+// queries hit disk chunks like they would on an ES index that was refreshed.
+func (c *Client) Refresh(index string) error {
+	_, err := c.SQL("FLUSH RAMCHUNK " + index)
+	return err
+}
+
+type SQLResult struct {
+	Data    []Map  `json:"data"`
+	Total   int64  `json:"total"`
+	Error   string `json:"error"`
+	Warning string `json:"warning"`
+}
+
+// SQL executes a statement via the `/sql?mode=raw` endpoint and returns the
+// resulting rows, if any.
+func (c *Client) SQL(statement string) ([]Map, error) {
+	res, code, err := c.call(
+		http.MethodPost, c.URL+"/sql?mode=raw",
+		"application/x-www-form-urlencoded",
+		[]byte("query="+url.QueryEscape(statement)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not execute statement '%s': %w", statement, err)
+	}
+
+	if DebugPrint {
+		fmt.Printf("sql: %s\nres: %s (code: %d)\n", statement, res, code)
+	}
+
+	if code >= 300 {
+		return nil, fmt.Errorf("got unexpected status code %d for statement '%s' : %s", code, statement, res)
+	}
+
+	var results []*SQLResult
+	err = sonic.Unmarshal(res, &results)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse result of statement '%s': %w", statement, err)
+	}
+
+	var rows []Map
+	for _, r := range results {
+		if r.Error != "" {
+			return nil, fmt.Errorf("got Manticore error for statement '%s' : %s", statement, r.Error)
+		}
+		rows = append(rows, r.Data...)
+	}
+
+	return rows, nil
+}
+
+func BuildBulkBody(obs ...interface{}) (bulk []byte, err error) {
+	for _, o := range obs {
+		b, err := data.ToJSON(o)
+		if err != nil {
+			return nil, err
+		}
+		bulk = append(bulk, b...)
+		bulk = append(bulk, []byte("\n")...)
+	}
+	return
+}
+
+func (c *Client) Call(method, url string, body []byte) (respBody []byte, statusCode int, err error) {
+	return c.call(method, url, "application/json", body)
+}
+
+func (c *Client) CallNDJSON(method, url string, body []byte) (respBody []byte, statusCode int, err error) {
+	return c.call(method, url, "application/x-ndjson", body)
+}
+
+func (c *Client) call(method, url, contentType string, body []byte) (respBody []byte, statusCode int, err error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequest(method, url, r)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req.Header.Add("content-type", contentType)
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	statusCode = resp.StatusCode
+
+	respBody, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return
+}
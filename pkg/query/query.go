@@ -1,20 +1,154 @@
 package query
 
 import (
+	"errors"
 	"fmt"
-	"log"
-	"os"
 	"strings"
 
 	"github.com/anrid/search-bench/pkg/data"
 	"github.com/anrid/search-bench/pkg/item"
 	"github.com/bytedance/sonic"
+	"github.com/ikawaha/kagome/v2/tokenizer"
 )
 
 type SearchQuery struct {
-	Keyword     string
-	CategoryIDs []int64
-	Statuses    []item.Status
+	RawKeyword  string        `json:"raw_keyword,omitempty"` // As found in the queries file
+	Keyword     string        `json:"keyword,omitempty"`     // Tokenized, space separated
+	CategoryIDs []int64       `json:"category_ids,omitempty"`
+	Statuses    []item.Status `json:"statuses,omitempty"`
+
+	// Items matching any of these keywords are excluded
+	RawExcludeKeywords []string `json:"raw_exclude_keywords,omitempty"` // As found in the queries file
+	ExcludeKeywords    []string `json:"exclude_keywords,omitempty"`     // Tokenized, space separated
+
+	// Only supported by the items_no_desc index
+	PriceMin   int                  `json:"price_min,omitempty"` // 0 = no lower bound
+	PriceMax   int                  `json:"price_max,omitempty"` // 0 = no upper bound
+	Conditions []item.ItemCondition `json:"conditions,omitempty"`
+	Sort       string               `json:"sort,omitempty"` // One of the `Sort*` orders, empty for the default order
+
+	Count int `json:"count,omitempty"` // Number of times the query was searched, used to weigh queries when replaying (see `Replay`)
+
+	// Position of the query in the queries file, counting skipped queries, so
+	// that query numbers in results and judgments don't shift when a query
+	// can't be parsed
+	Number int `json:"-"`
+}
+
+// Sort orders other than the default, which is by score for keyword queries
+// and newest first for filter queries.
+const (
+	SortNewest    = "created_desc" // Most recently listed first, also for keyword queries
+	SortUpdated   = "updated_desc" // Most recently updated first
+	SortPriceAsc  = "price_asc"    // Cheapest first
+	SortPriceDesc = "price_desc"   // Most expensive first
+)
+
+// Sorts are all supported sort orders.
+var Sorts = []string{SortNewest, SortUpdated, SortPriceAsc, SortPriceDesc}
+
+// ValidSort returns an error if the given sort order isn't supported.
+func ValidSort(sort string) error {
+	if sort == "" {
+		return nil
+	}
+	for _, s := range Sorts {
+		if s == sort {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported sort order '%s' (supported: %s)", sort, strings.Join(Sorts, ", "))
+}
+
+// SortField returns the field and direction ("asc" or "desc") of the
+// explicit sort order of the query, or empty strings for the default order.
+func (q *SearchQuery) SortField() (field, order string) {
+	switch q.Sort {
+	case SortNewest:
+		return "created", "desc"
+	case SortUpdated:
+		return "updated", "desc"
+	case SortPriceAsc:
+		return "price", "asc"
+	case SortPriceDesc:
+		return "price", "desc"
+	}
+	return "", ""
+}
+
+// Bestmatch returns true if the query is sorted by score, i.e. it has a
+// keyword and no explicit sort order.
+func (q *SearchQuery) Bestmatch() bool {
+	return q.Keyword != "" && q.Sort == ""
+}
+
+// NeedsItemsNoDesc returns true if the query filters or sorts on fields only
+// found in the items_no_desc index.
+func (q *SearchQuery) NeedsItemsNoDesc() bool {
+	if q.PriceMin > 0 || q.PriceMax > 0 || len(q.Conditions) > 0 {
+		return true
+	}
+	field, _ := q.SortField()
+	return field == "updated" || field == "price"
+}
+
+// Filters are added to every query in a benchmark, e.g. to benchmark a price
+// range on top of the queries in a queries file.
+type Filters struct {
+	PriceMin   int
+	PriceMax   int
+	Conditions []item.ItemCondition
+	Sort       string
+}
+
+// Apply sets the filters (those that are set) on the given query.
+func (f *Filters) Apply(q *SearchQuery) {
+	if f.PriceMin > 0 {
+		q.PriceMin = f.PriceMin
+	}
+	if f.PriceMax > 0 {
+		q.PriceMax = f.PriceMax
+	}
+	if len(f.Conditions) > 0 {
+		q.Conditions = f.Conditions
+	}
+	if f.Sort != "" {
+		q.Sort = f.Sort
+	}
+}
+
+// ErrNeedsItemsNoDesc is returned for filters only supported by the
+// items_no_desc index, see `NeedsItemsNoDesc`.
+var ErrNeedsItemsNoDesc = errors.New("price and item condition filters, and sorting by price or updated date, are only supported by the items_no_desc index")
+
+// NeedsItemsNoDesc returns true if any of the filters is only supported by
+// the items_no_desc index.
+func (f *Filters) NeedsItemsNoDesc() bool {
+	q := new(SearchQuery)
+	f.Apply(q)
+	return q.NeedsItemsNoDesc()
+}
+
+const (
+	ShapeKeyword       = "keyword"
+	ShapeFilter        = "filter"
+	ShapeKeywordFilter = "keyword+filter"
+	ShapeMatchAll      = "match_all"
+)
+
+// Shape returns the kind of query, i.e. keyword only, filters only or both.
+func (q *SearchQuery) Shape() string {
+	hasFilter := len(q.CategoryIDs) > 0 || len(q.Statuses) > 0 || q.PriceMin > 0 || q.PriceMax > 0 || len(q.Conditions) > 0 || len(q.ExcludeKeywords) > 0
+	switch {
+	case q.Keyword != "" && hasFilter:
+		return ShapeKeywordFilter
+	case q.Keyword != "":
+		return ShapeKeyword
+	case hasFilter:
+		return ShapeFilter
+	default:
+		return ShapeMatchAll
+	}
 }
 
 type RawSearchQuery struct {
@@ -22,68 +156,213 @@ type RawSearchQuery struct {
 	Count string `json:"c"`
 }
 
-func Load(queriesFile string) (qs []*SearchQuery) {
+// LineError is returned for a query in a queries file that can't be parsed.
+// Such queries are skipped and counted rather than failing the whole file,
+// see `LoadStats`.
+type LineError struct {
+	Reason string // Short reason used to group skipped queries, e.g. "invalid price"
+	Err    error
+}
+
+func (e *LineError) Error() string {
+	if e.Err == nil {
+		return e.Reason
+	}
+	return e.Reason + ": " + e.Err.Error()
+}
+
+func (e *LineError) Unwrap() error {
+	return e.Err
+}
+
+// LoadStats counts the queries read from a queries file.
+type LoadStats struct {
+	Lines       int            `json:"lines"` // Queries read (JSON objects or CSV records), excluding headers and empty lines
+	Loaded      int            `json:"loaded"`
+	Skipped     int            `json:"skipped"`
+	SkipReasons map[string]int `json:"skip_reasons,omitempty"`
+}
+
+func (s *LoadStats) skip(err *LineError) {
+	s.Skipped++
+	s.SkipReasons[err.Reason]++
+	if s.Skipped <= 10 {
+		fmt.Printf("WARNING: skipping query #%d: %s\n", s.Lines, err)
+	}
+}
+
+// Load loads and tokenizes all queries in the given file, in any of the
+// formats supported by `Open`. Malformed queries are skipped with a warning
+// and counted in the returned stats. Use a `Reader` instead where queries
+// don't need to be held in memory.
+func Load(queriesFile string) ([]*SearchQuery, *LoadStats, error) {
 	fmt.Printf("Loading queries from %s ..\n", queriesFile)
 
-	b, err := os.ReadFile(queriesFile)
+	r, err := Open(queriesFile)
 	if err != nil {
-		log.Panic(err)
+		return nil, nil, err
 	}
+	defer r.Close()
 
-	qs = make([]*SearchQuery, 0)
-	raws := make([]*RawSearchQuery, 0)
-
-	err = sonic.Unmarshal(b, &raws)
+	qs, err := r.ReadAll()
 	if err != nil {
-		log.Panic(err)
+		return nil, r.Stats, err
 	}
 
-	tok := data.KagomeV2Tokenizer()
+	r.PrintStats()
+
+	return qs, r.Stats, nil
+}
+
+// parse parses a raw query in the format
+//
+//	keyword<|>[categories]<|>[statuses]<|>price_min<|>price_max<|>[conditions]<|>sort<|>[excluded keywords]
+//
+// where the first 3 parts are required and the others optional, e.g.
+// `ナイキ<|>[]<|>["ITEM_STATUS_ON_SALE"]<|>1000<|><|>["ITEM_CONDITION_LIKE_NEW"]<|>price_asc<|>["ジャンク"]`.
+// Empty parts (or `[]`) aren't used. Invalid queries return a `*LineError`.
+func parse(tok *tokenizer.Tokenizer, r *RawSearchQuery) (*SearchQuery, error) {
+	q := new(SearchQuery)
+	parts := strings.SplitN(r.Query, "<|>", 8)
+	if len(parts) < 3 {
+		return nil, invalid("missing parts", "expected at least 3 parts in raw query '%.100s'", r.Query)
+	}
+	for len(parts) < 8 {
+		parts = append(parts, "")
+	}
 
-	for _, r := range raws {
-		q := new(SearchQuery)
-		parts := strings.SplitN(r.Query, "<|>", 3)
-		if len(parts) != 3 {
-			log.Panicf("expected 3 parts in raw query: '%s'", r.Query)
+	q.Count = 1
+	if r.Count != "" {
+		c, err := data.ToInt64(r.Count)
+		if err != nil || c < 1 {
+			return nil, invalid("invalid count", "invalid count '%s' for raw query '%.100s'", r.Count, r.Query)
 		}
+		q.Count = int(c)
+	}
+
+	if parts[0] != "" {
+		// Handle keywords
+		q.RawKeyword = parts[0]
+		keywordParts := tok.Wakati(parts[0])
+		q.Keyword = strings.Join(keywordParts, " ")
+	}
 
-		if parts[0] != "" {
-			// Handle keywords
-			keywordParts := tok.Wakati(parts[0])
-			q.Keyword = strings.Join(keywordParts, " ")
+	// Handle category IDs array in JSON string format
+	cats, ok := list(parts[1])
+	if !ok {
+		return nil, invalid("invalid categories", "invalid categories in raw query '%.100s'", r.Query)
+	}
+	for _, cat := range cats {
+		id, err := data.ToInt64(cat)
+		if err != nil {
+			return nil, invalid("invalid categories", "invalid category ID in raw query '%.100s': %s", r.Query, err)
 		}
+		q.CategoryIDs = append(q.CategoryIDs, id)
+	}
 
-		if len(parts[1]) > 2 {
-			// Handle category IDs array in JSON string format
-			trimmed := parts[1][1 : len(parts[1])-1]
-			cats := strings.SplitN(trimmed, ",", -1)
-			for _, cat := range cats {
-				q.CategoryIDs = append(q.CategoryIDs, data.ToInt64(cat))
-			}
+	// Handle statuses array in JSON string format
+	statuses, ok := list(parts[2])
+	if !ok {
+		return nil, invalid("invalid statuses", "invalid statuses in raw query '%.100s'", r.Query)
+	}
+	for _, status := range statuses {
+		switch status {
+		case `"ITEM_STATUS_ON_SALE"`:
+			q.Statuses = append(q.Statuses, item.StatusOnSale)
+		case `"ITEM_STATUS_TRADING"`:
+			q.Statuses = append(q.Statuses, item.StatusTrading)
+		case `"ITEM_STATUS_SOLD_OUT"`:
+			q.Statuses = append(q.Statuses, item.StatusSold)
+		default:
+			fmt.Printf("WARNING: unhandled status %s\n", status)
 		}
+	}
 
-		if len(parts[2]) > 2 {
-			// Handle statuses array in JSON string format
-			trimmed := parts[2][1 : len(parts[2])-1]
-			statuses := strings.SplitN(trimmed, ",", -1)
-			for _, status := range statuses {
-				switch status {
-				case `"ITEM_STATUS_ON_SALE"`:
-					q.Statuses = append(q.Statuses, item.StatusOnSale)
-				case `"ITEM_STATUS_TRADING"`:
-					q.Statuses = append(q.Statuses, item.StatusTrading)
-				case `"ITEM_STATUS_SOLD_OUT"`:
-					q.Statuses = append(q.Statuses, item.StatusSold)
-				default:
-					fmt.Printf("WARNING: unhandled status %s\n", status)
-				}
-			}
+	if parts[3] != "" {
+		price, err := data.ToInt64(parts[3])
+		if err != nil || price < 0 {
+			return nil, invalid("invalid price", "invalid min price in raw query '%.100s'", r.Query)
+		}
+		q.PriceMin = int(price)
+	}
+
+	if parts[4] != "" {
+		price, err := data.ToInt64(parts[4])
+		if err != nil || price < 0 {
+			return nil, invalid("invalid price", "invalid max price in raw query '%.100s'", r.Query)
 		}
+		q.PriceMax = int(price)
+	}
 
-		qs = append(qs, q)
+	if q.PriceMax > 0 && q.PriceMax < q.PriceMin {
+		return nil, invalid("invalid price", "max price is less than min price in raw query '%.100s'", r.Query)
 	}
 
-	fmt.Printf("Loaded and prepared %d queries\n", len(qs))
+	// Handle item conditions array in JSON string format
+	conditions, ok := list(parts[5])
+	if !ok {
+		return nil, invalid("invalid conditions", "invalid item conditions in raw query '%.100s'", r.Query)
+	}
+	for _, condition := range conditions {
+		switch condition {
+		case `"ITEM_CONDITION_LIKE_NEW"`:
+			q.Conditions = append(q.Conditions, item.ItemConditionLikeNew)
+		case `"ITEM_CONDITION_GOOD"`:
+			q.Conditions = append(q.Conditions, item.ItemConditionGood)
+		case `"ITEM_CONDITION_POOR"`:
+			q.Conditions = append(q.Conditions, item.ItemConditionPoor)
+		case `"ITEM_CONDITION_OTHER"`:
+			q.Conditions = append(q.Conditions, item.ItemConditionOther)
+		default:
+			fmt.Printf("WARNING: unhandled item condition %s\n", condition)
+		}
+	}
 
-	return
+	if err := ValidSort(parts[6]); err != nil {
+		return nil, invalid("invalid sort", "%s in raw query '%.100s'", err, r.Query)
+	}
+	q.Sort = parts[6]
+
+	if parts[7] != "" {
+		// Handle excluded keywords array in JSON string format, each
+		// tokenized like the keyword
+		var excluded []string
+		if err := sonic.UnmarshalString(parts[7], &excluded); err != nil {
+			return nil, invalid("invalid excluded keywords", "invalid excluded keywords in raw query '%.100s': %s", r.Query, err)
+		}
+		for _, kw := range excluded {
+			if kw = strings.TrimSpace(kw); kw == "" {
+				continue
+			}
+			q.RawExcludeKeywords = append(q.RawExcludeKeywords, kw)
+			q.ExcludeKeywords = append(q.ExcludeKeywords, strings.Join(tok.Wakati(kw), " "))
+		}
+	}
+
+	return q, nil
+}
+
+func invalid(reason, format string, args ...interface{}) *LineError {
+	return &LineError{Reason: reason, Err: fmt.Errorf(format, args...)}
+}
+
+// list returns the elements of an array in JSON string format, e.g. `[1,2]`,
+// without parsing them. An empty part is an empty array.
+func list(part string) ([]string, bool) {
+	part = strings.TrimSpace(part)
+	if part == "" {
+		return nil, true
+	}
+	if len(part) < 2 || part[0] != '[' || part[len(part)-1] != ']' {
+		return nil, false
+	}
+	trimmed := strings.TrimSpace(part[1 : len(part)-1])
+	if trimmed == "" {
+		return nil, true
+	}
+	elems := strings.Split(trimmed, ",")
+	for i := range elems {
+		elems[i] = strings.TrimSpace(elems[i])
+	}
+	return elems, true
 }
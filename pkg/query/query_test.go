@@ -0,0 +1,135 @@
+package query
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/anrid/search-bench/pkg/data"
+	"github.com/anrid/search-bench/pkg/item"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		raw   RawSearchQuery
+		want  *SearchQuery
+		shape string
+	}{
+		{
+			name:  "keyword",
+			raw:   RawSearchQuery{Query: "nike<|>[]<|>[]", Count: "12"},
+			want:  &SearchQuery{RawKeyword: "nike", Keyword: "nike", Count: 12},
+			shape: ShapeKeyword,
+		},
+		{
+			name:  "filters only",
+			raw:   RawSearchQuery{Query: `<|>[1,23]<|>["ITEM_STATUS_ON_SALE","ITEM_STATUS_SOLD_OUT"]`},
+			want:  &SearchQuery{CategoryIDs: []int64{1, 23}, Statuses: []item.Status{item.StatusOnSale, item.StatusSold}, Count: 1},
+			shape: ShapeFilter,
+		},
+		{
+			name: "all parts",
+			raw:  RawSearchQuery{Query: `nike<|>[]<|>[]<|>1000<|>5000<|>["ITEM_CONDITION_LIKE_NEW","ITEM_CONDITION_GOOD"]<|>price_asc<|>["red", " ", "blue"]`},
+			want: &SearchQuery{
+				RawKeyword: "nike", Keyword: "nike",
+				RawExcludeKeywords: []string{"red", "blue"}, ExcludeKeywords: []string{"red", "blue"},
+				PriceMin: 1000, PriceMax: 5000,
+				Conditions: []item.ItemCondition{item.ItemConditionLikeNew, item.ItemConditionGood},
+				Sort:       SortPriceAsc,
+				Count:      1,
+			},
+			shape: ShapeKeywordFilter,
+		},
+		{
+			name:  "empty optional parts",
+			raw:   RawSearchQuery{Query: "<|>[]<|>[]<|><|>2000<|>[]<|><|>[]"},
+			want:  &SearchQuery{PriceMax: 2000, Count: 1},
+			shape: ShapeFilter,
+		},
+		{
+			name:  "match all",
+			raw:   RawSearchQuery{Query: "<|><|>"},
+			want:  &SearchQuery{Count: 1},
+			shape: ShapeMatchAll,
+		},
+	}
+
+	tok, err := data.KagomeV2Tokenizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := parse(tok, &tt.raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(q, tt.want) {
+				t.Errorf("parse(%q) = %+v, want %+v", tt.raw.Query, q, tt.want)
+			}
+			if shape := q.Shape(); shape != tt.shape {
+				t.Errorf("got shape %s, want %s", shape, tt.shape)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		raw    RawSearchQuery
+		reason string
+	}{
+		{RawSearchQuery{Query: "nike<|>[]"}, "missing parts"},
+		{RawSearchQuery{Query: "nike<|>[]<|>[]", Count: "0"}, "invalid count"},
+		{RawSearchQuery{Query: "nike<|>[]<|>[]", Count: "many"}, "invalid count"},
+		{RawSearchQuery{Query: "nike<|>[a]<|>[]"}, "invalid categories"},
+		{RawSearchQuery{Query: "nike<|>1,2<|>[]"}, "invalid categories"},
+		{RawSearchQuery{Query: "nike<|>[]<|>ON_SALE"}, "invalid statuses"},
+		{RawSearchQuery{Query: "nike<|>[]<|>[]<|>-1"}, "invalid price"},
+		{RawSearchQuery{Query: "nike<|>[]<|>[]<|><|>cheap"}, "invalid price"},
+		{RawSearchQuery{Query: "nike<|>[]<|>[]<|>5000<|>1000"}, "invalid price"},
+		{RawSearchQuery{Query: "nike<|>[]<|>[]<|><|><|>LIKE_NEW"}, "invalid conditions"},
+		{RawSearchQuery{Query: "nike<|>[]<|>[]<|><|><|>[]<|>oldest"}, "invalid sort"},
+		{RawSearchQuery{Query: "nike<|>[]<|>[]<|><|><|>[]<|><|>red"}, "invalid excluded keywords"},
+	}
+
+	tok, err := data.KagomeV2Tokenizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw.Query, func(t *testing.T) {
+			_, err := parse(tok, &tt.raw)
+			var le *LineError
+			if !errors.As(err, &le) {
+				t.Fatalf("got error %v, want a *LineError", err)
+			}
+			if le.Reason != tt.reason {
+				t.Errorf("got reason %s, want %s", le.Reason, tt.reason)
+			}
+		})
+	}
+}
+
+func TestNeedsItemsNoDesc(t *testing.T) {
+	tests := []struct {
+		name string
+		q    *SearchQuery
+		want bool
+	}{
+		{"keyword", &SearchQuery{Keyword: "nike"}, false},
+		{"sorted by newest", &SearchQuery{Sort: SortNewest}, false},
+		{"sorted by updated date", &SearchQuery{Sort: SortUpdated}, true},
+		{"sorted by price", &SearchQuery{Sort: SortPriceDesc}, true},
+		{"price range", &SearchQuery{PriceMax: 100}, true},
+		{"conditions", &SearchQuery{Conditions: []item.ItemCondition{item.ItemConditionPoor}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.q.NeedsItemsNoDesc(); got != tt.want {
+				t.Errorf("NeedsItemsNoDesc() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
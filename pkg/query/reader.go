@@ -0,0 +1,317 @@
+package query
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/anrid/search-bench/pkg/data"
+	"github.com/bytedance/sonic"
+	"github.com/ikawaha/kagome/v2/tokenizer"
+)
+
+// Queries file formats, detected from the content of the file.
+const (
+	FormatJSON  = "json"  // A JSON array of `RawSearchQuery` objects, as exported from BigQuery
+	FormatJSONL = "jsonl" // One `RawSearchQuery` object per line
+	FormatCSV   = "csv"   // A header line naming the `query` and `c` (or `count`) columns, then one query per line
+)
+
+// Source yields queries one at a time, returning `io.EOF` after the last one.
+type Source interface {
+	Next() (*SearchQuery, error)
+}
+
+type sliceSource struct {
+	qs   []*SearchQuery
+	next int
+}
+
+// SliceSource returns a `Source` yielding the given queries, e.g. a replayed
+// stream.
+func SliceSource(qs []*SearchQuery) Source {
+	return &sliceSource{qs: qs}
+}
+
+func (s *sliceSource) Next() (*SearchQuery, error) {
+	if s.next >= len(s.qs) {
+		return nil, io.EOF
+	}
+	s.next++
+	return s.qs[s.next-1], nil
+}
+
+// Reader reads the queries in a queries file one at a time, so that query logs
+// with millions of queries can be replayed without holding the file in
+// memory. Gzip compressed files are decompressed on the fly. Queries that
+// can't be parsed are skipped and counted in `Stats`.
+type Reader struct {
+	Name   string
+	Format string // One of the `Format*` formats
+	Stats  *LoadStats
+
+	// Skip queries with filters only supported by the items_no_desc index,
+	// e.g. when benchmarking the items index
+	SkipNeedsItemsNoDesc bool
+
+	f   *os.File
+	gz  *gzip.Reader
+	tok *tokenizer.Tokenizer
+
+	// Set depending on the format
+	json     *json.Decoder
+	lines    *bufio.Scanner
+	csv      *csv.Reader
+	queryCol int
+	countCol int
+}
+
+// Open opens a queries file, detecting its format from its first character:
+// `[` for a JSON array, `{` for JSON lines, and anything else for CSV.
+func Open(queriesFile string) (*Reader, error) {
+	tok, err := data.KagomeV2Tokenizer()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(queriesFile)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Reader{
+		Name:  queriesFile,
+		Stats: &LoadStats{SkipReasons: make(map[string]int)},
+		f:     f,
+		tok:   tok,
+	}
+
+	br := bufio.NewReader(f)
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		r.gz, err = gzip.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("could not read compressed queries file %s: %w", queriesFile, err)
+		}
+		br = bufio.NewReader(r.gz)
+	}
+
+	// Skip a byte order mark and leading whitespace
+	if bom, _ := br.Peek(3); string(bom) == "\xef\xbb\xbf" {
+		br.Discard(3)
+	}
+	var first byte
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			break // Empty file
+		}
+		if b[0] == ' ' || b[0] == '\t' || b[0] == '\r' || b[0] == '\n' {
+			br.Discard(1)
+			continue
+		}
+		first = b[0]
+		break
+	}
+
+	switch first {
+	case '[':
+		r.Format = FormatJSON
+		r.json = json.NewDecoder(br)
+		if _, err := r.json.Token(); err != nil {
+			r.Close()
+			return nil, fmt.Errorf("could not parse queries file %s: %w", queriesFile, err)
+		}
+
+	case '{', 0:
+		r.Format = FormatJSONL
+		r.lines = bufio.NewScanner(br)
+		r.lines.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	default:
+		r.Format = FormatCSV
+		r.csv = csv.NewReader(br)
+		r.csv.FieldsPerRecord = -1 // The number of fields is checked per line
+		r.csv.ReuseRecord = true
+
+		header, err := r.csv.Read()
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("could not read header of queries file %s: %w", queriesFile, err)
+		}
+		r.queryCol, r.countCol = -1, -1
+		for i, col := range header {
+			switch strings.ToLower(strings.TrimSpace(col)) {
+			case "query":
+				r.queryCol = i
+			case "c", "count":
+				r.countCol = i
+			}
+		}
+		if r.queryCol < 0 {
+			r.Close()
+			return nil, fmt.Errorf("no query column in header of CSV queries file %s: %v", queriesFile, header)
+		}
+	}
+
+	return r, nil
+}
+
+// Next returns the next query, or `io.EOF` at the end of the file. Queries
+// that can't be parsed are skipped with a warning, other errors (e.g. a
+// truncated file) are returned.
+func (r *Reader) Next() (*SearchQuery, error) {
+	for {
+		raw, err := r.read()
+		if err == nil {
+			var q *SearchQuery
+			q, err = parse(r.tok, raw)
+			if err == nil && r.SkipNeedsItemsNoDesc && q.NeedsItemsNoDesc() {
+				err = &LineError{Reason: "needs items_no_desc", Err: ErrNeedsItemsNoDesc}
+			}
+			if err == nil {
+				r.Stats.Loaded++
+				q.Number = r.Stats.Lines
+				return q, nil
+			}
+		}
+
+		var le *LineError
+		if !errors.As(err, &le) {
+			if err == io.EOF {
+				return nil, err
+			}
+			return nil, fmt.Errorf("could not read queries file %s after query #%d: %w", r.Name, r.Stats.Lines, err)
+		}
+		r.Stats.skip(le)
+	}
+}
+
+// ReadAll reads all remaining queries.
+func (r *Reader) ReadAll() ([]*SearchQuery, error) {
+	qs := make([]*SearchQuery, 0)
+	for {
+		q, err := r.Next()
+		if err == io.EOF {
+			return qs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		qs = append(qs, q)
+	}
+}
+
+// PrintStats prints the number of queries read so far, and how many were
+// skipped by reason.
+func (r *Reader) PrintStats() {
+	fmt.Printf("Loaded and prepared %d queries from %s (%s, skipped %d)\n", r.Stats.Loaded, r.Name, r.Format, r.Stats.Skipped)
+	if r.Stats.Skipped > 0 {
+		var reasons []string
+		for reason, n := range r.Stats.SkipReasons {
+			reasons = append(reasons, fmt.Sprintf("%s: %d", reason, n))
+		}
+		sort.Strings(reasons)
+		fmt.Printf("Skipped queries by reason: %s\n", strings.Join(reasons, ", "))
+	}
+}
+
+func (r *Reader) Close() error {
+	if r.gz != nil {
+		r.gz.Close()
+	}
+	return r.f.Close()
+}
+
+// read returns the next raw query, counting it in `Stats.Lines`.
+func (r *Reader) read() (*RawSearchQuery, error) {
+	switch r.Format {
+	case FormatJSON:
+		if !r.json.More() {
+			return nil, io.EOF
+		}
+		// Syntax errors can't be skipped, since the decoder can't tell
+		// where the next object starts
+		var obj json.RawMessage
+		if err := r.json.Decode(&obj); err != nil {
+			return nil, err
+		}
+		r.Stats.Lines++
+		return parseObject(obj)
+
+	case FormatJSONL:
+		for r.lines.Scan() {
+			line := bytes.TrimSpace(r.lines.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			r.Stats.Lines++
+			return parseObject(line)
+		}
+		if err := r.lines.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+
+	default:
+		rec, err := r.csv.Read()
+		if err == io.EOF {
+			return nil, err
+		}
+		var pe *csv.ParseError
+		if errors.As(err, &pe) {
+			// The reader picks up at the next line
+			r.Stats.Lines++
+			return nil, &LineError{Reason: "malformed csv", Err: err}
+		}
+		if err != nil {
+			return nil, err
+		}
+		r.Stats.Lines++
+
+		if r.queryCol >= len(rec) {
+			return nil, invalid("missing query", "expected %d columns, got %d", r.queryCol+1, len(rec))
+		}
+		raw := &RawSearchQuery{Query: rec[r.queryCol]}
+		if r.countCol >= 0 && r.countCol < len(rec) {
+			raw.Count = strings.TrimSpace(rec[r.countCol])
+		}
+		return raw, nil
+	}
+}
+
+// parseObject parses a query object, accepting the count as a string (as
+// exported from BigQuery) or as a number.
+func parseObject(b []byte) (*RawSearchQuery, error) {
+	var obj struct {
+		Query *string     `json:"query"`
+		Count interface{} `json:"c"`
+	}
+	if err := sonic.Unmarshal(b, &obj); err != nil {
+		return nil, invalid("malformed json", "could not parse '%.100s': %s", b, err)
+	}
+	if obj.Query == nil {
+		return nil, invalid("missing query", "no query in '%.100s'", b)
+	}
+
+	raw := &RawSearchQuery{Query: *obj.Query}
+	switch c := obj.Count.(type) {
+	case nil:
+	case string:
+		raw.Count = c
+	case float64:
+		raw.Count = strconv.FormatFloat(c, 'f', -1, 64)
+	default:
+		return nil, invalid("invalid count", "invalid count in '%.100s'", b)
+	}
+	return raw, nil
+}
@@ -0,0 +1,260 @@
+package query
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeQueriesFile writes a queries file to a temporary directory, gzip
+// compressed if `compress` is set.
+func writeQueriesFile(t *testing.T, content string, compress bool) string {
+	t.Helper()
+
+	b := []byte(content)
+	if compress {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(b)
+		gz.Close()
+		b = buf.Bytes()
+	}
+
+	file := filepath.Join(t.TempDir(), "queries")
+	if err := os.WriteFile(file, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// readAll reads all queries in the given file.
+func readAll(t *testing.T, file string) ([]*SearchQuery, *Reader, error) {
+	t.Helper()
+
+	r, err := Open(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+
+	var qs []*SearchQuery
+	for {
+		q, err := r.Next()
+		if err == io.EOF {
+			return qs, r, nil
+		}
+		if err != nil {
+			return qs, r, err
+		}
+		qs = append(qs, q)
+	}
+}
+
+func TestReader(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		compress    bool
+		format      string
+		numbers     []int // Of the queries read, i.e. their position in the file
+		counts      []int
+		lines       int
+		skipReasons map[string]int
+	}{
+		{
+			name: "json array",
+			content: `[{"query": "a<|>[]<|>[]", "c": "3"},
+				{"query": "bad"},
+				{"query": "b<|>[1]<|>[]", "c": 2}]`,
+			format:      FormatJSON,
+			numbers:     []int{1, 3},
+			counts:      []int{3, 2},
+			lines:       3,
+			skipReasons: map[string]int{"missing parts": 1},
+		},
+		{
+			name:        "json array with byte order mark",
+			content:     "\xef\xbb\xbf\n  [{\"query\": \"a<|>[]<|>[]\"}]",
+			format:      FormatJSON,
+			numbers:     []int{1},
+			counts:      []int{1},
+			lines:       1,
+			skipReasons: map[string]int{},
+		},
+		{
+			name: "json lines",
+			content: `{"query": "a<|>[]<|>[]"}
+
+not json
+{"c": "1"}
+{"query": "b<|>[]<|>[]", "c": "x"}
+{"query": "c<|>[]<|>[]", "c": true}
+{"query": "d<|>[]<|>[]", "c": 5}
+`,
+			format:      FormatJSONL,
+			numbers:     []int{1, 6},
+			counts:      []int{1, 5},
+			lines:       6,
+			skipReasons: map[string]int{"malformed json": 1, "missing query": 1, "invalid count": 2},
+		},
+		{
+			name:        "gzip compressed json lines",
+			content:     "{\"query\": \"a<|>[]<|>[]\", \"c\": \"2\"}\n{\"query\": \"b\"}\n{\"query\": \"c<|>[]<|>[]\"}\n",
+			compress:    true,
+			format:      FormatJSONL,
+			numbers:     []int{1, 3},
+			counts:      []int{2, 1},
+			lines:       3,
+			skipReasons: map[string]int{"missing parts": 1},
+		},
+		{
+			name:        "csv",
+			content:     "count,query\n3,a<|>[]<|>[]\n1,bad\n2\n,b<|>[]<|>[]\n",
+			format:      FormatCSV,
+			numbers:     []int{1, 4},
+			counts:      []int{3, 1},
+			lines:       4,
+			skipReasons: map[string]int{"missing parts": 1, "missing query": 1},
+		},
+		{
+			name:        "malformed csv",
+			content:     "query,c\na<|>[]<|>[],1\nb\"<|>[]<|>[],1\nc<|>[]<|>[],4\n",
+			format:      FormatCSV,
+			numbers:     []int{1, 3},
+			counts:      []int{1, 4},
+			lines:       3,
+			skipReasons: map[string]int{"malformed csv": 1},
+		},
+		{
+			name:        "gzip compressed csv",
+			content:     "query,c\n\"a<|>[]<|>[\"\"ITEM_STATUS_ON_SALE\"\"]\",7\n",
+			compress:    true,
+			format:      FormatCSV,
+			numbers:     []int{1},
+			counts:      []int{7},
+			lines:       1,
+			skipReasons: map[string]int{},
+		},
+		{
+			name:        "empty",
+			content:     "",
+			format:      FormatJSONL,
+			skipReasons: map[string]int{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qs, r, err := readAll(t, writeQueriesFile(t, tt.content, tt.compress))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if r.Format != tt.format {
+				t.Errorf("got format %s, want %s", r.Format, tt.format)
+			}
+			var numbers, counts []int
+			for _, q := range qs {
+				numbers = append(numbers, q.Number)
+				counts = append(counts, q.Count)
+			}
+			if !reflect.DeepEqual(numbers, tt.numbers) {
+				t.Errorf("got query numbers %v, want %v", numbers, tt.numbers)
+			}
+			if !reflect.DeepEqual(counts, tt.counts) {
+				t.Errorf("got counts %v, want %v", counts, tt.counts)
+			}
+
+			want := &LoadStats{Lines: tt.lines, Loaded: len(tt.numbers), SkipReasons: tt.skipReasons}
+			for _, n := range tt.skipReasons {
+				want.Skipped += n
+			}
+			if !reflect.DeepEqual(r.Stats, want) {
+				t.Errorf("got stats %+v, want %+v", r.Stats, want)
+			}
+		})
+	}
+}
+
+func TestReaderParsesQueries(t *testing.T) {
+	qs, _, err := readAll(t, writeQueriesFile(t, `[{"query": "<|>[12,34]<|>[\"ITEM_STATUS_ON_SALE\"]"}]`, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(qs) != 1 || !reflect.DeepEqual(qs[0].CategoryIDs, []int64{12, 34}) || len(qs[0].Statuses) != 1 {
+		t.Errorf("got %+v", qs)
+	}
+}
+
+func TestReaderSkipNeedsItemsNoDesc(t *testing.T) {
+	file := writeQueriesFile(t, "{\"query\": \"a<|>[]<|>[]<|>100\"}\n{\"query\": \"b<|>[]<|>[]\"}\n", false)
+
+	r, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	r.SkipNeedsItemsNoDesc = true
+
+	qs, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(qs) != 1 || qs[0].Number != 2 {
+		t.Errorf("got %+v, want query #2 only", qs)
+	}
+	if r.Stats.SkipReasons["needs items_no_desc"] != 1 {
+		t.Errorf("got skip reasons %v", r.Stats.SkipReasons)
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		openErr bool // Fails on open rather than while reading
+		read    int  // Queries read before the error
+	}{
+		{name: "csv without query column", content: "keyword,c\na,1\n", openErr: true},
+		{name: "truncated json array", content: `[{"query": "a<|>[]<|>[]"}, {"query": `, read: 1},
+		{name: "json array syntax error", content: `[{"query": "a<|>[]<|>[]"} {"query": "b<|>[]<|>[]"}]`, read: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := writeQueriesFile(t, tt.content, false)
+			qs, r, err := readAll(t, file)
+			if err == nil {
+				t.Fatal("no error")
+			}
+			if tt.openErr != (r == nil) {
+				t.Errorf("got error %v, want error on open: %v", err, tt.openErr)
+			}
+			if len(qs) != tt.read {
+				t.Errorf("read %d queries before the error, want %d", len(qs), tt.read)
+			}
+		})
+	}
+}
+
+func TestOpenMissingFile(t *testing.T) {
+	if _, err := Open(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("no error")
+	}
+}
+
+func TestSliceSource(t *testing.T) {
+	qs := queries("ab", 1, 1)
+	s := SliceSource(qs)
+	for i := range qs {
+		q, err := s.Next()
+		if err != nil || q != qs[i] {
+			t.Fatalf("got %v, %v, want query %d", q, err, i)
+		}
+	}
+	if _, err := s.Next(); err != io.EOF {
+		t.Errorf("got %v after the last query, want io.EOF", err)
+	}
+}
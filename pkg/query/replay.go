@@ -0,0 +1,161 @@
+package query
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// Replay modes, i.e. how the queries in a queries file are turned into the
+// stream of queries to benchmark.
+const (
+	ReplayFlat   = "flat"   // Every query once, in file order
+	ReplayExpand = "expand" // Every query `Count` times, spread evenly across the stream
+	ReplaySample = "sample" // Queries drawn at random (with replacement) in proportion to their `Count`
+)
+
+// ReplayModes are all supported replay modes.
+var ReplayModes = []string{ReplayFlat, ReplayExpand, ReplaySample}
+
+// MaxReplayLength is the maximum number of queries in a replayed stream.
+const MaxReplayLength = 10_000_000
+
+type ReplayArgs struct {
+	Mode   string // One of the `Replay*` modes (default: `ReplayFlat`)
+	Length int    // Number of queries to replay (default: the sum of all counts for `ReplayExpand`, the number of queries for `ReplaySample`)
+	Seed   int64  // Random seed for `ReplaySample`, the same seed gives the same stream
+}
+
+// Validate returns an error if the replay mode isn't supported, or if the
+// length is set for a mode that doesn't use it.
+func (a *ReplayArgs) Validate() error {
+	switch a.Mode {
+	case "", ReplayFlat:
+		if a.Length != 0 {
+			return fmt.Errorf("a replay length requires replay mode %s or %s", ReplayExpand, ReplaySample)
+		}
+	case ReplayExpand, ReplaySample:
+		if a.Length < 0 || a.Length > MaxReplayLength {
+			return fmt.Errorf("invalid replay length %d (max %d)", a.Length, MaxReplayLength)
+		}
+	default:
+		return fmt.Errorf("unsupported replay mode '%s' (supported: %s)", a.Mode, strings.Join(ReplayModes, ", "))
+	}
+	return nil
+}
+
+// ByCount returns true if queries are replayed by count rather than each once,
+// which needs all queries in memory.
+func (a *ReplayArgs) ByCount() bool {
+	return a.Mode == ReplayExpand || a.Mode == ReplaySample
+}
+
+// Replay returns the stream of queries to benchmark, sampling queries in
+// proportion to how often they were searched (`Count`). The same queries and
+// args always give the same stream.
+func Replay(qs []*SearchQuery, a ReplayArgs) ([]*SearchQuery, error) {
+	if err := a.Validate(); err != nil {
+		return nil, err
+	}
+	if len(qs) == 0 || a.Mode == "" || a.Mode == ReplayFlat {
+		return qs, nil
+	}
+
+	var total int64
+	for _, q := range qs {
+		total += q.weight()
+	}
+
+	if a.Mode == ReplaySample {
+		return sample(qs, total, a.Length, a.Seed), nil
+	}
+
+	counts := make([]int64, len(qs))
+	for i, q := range qs {
+		counts[i] = q.weight()
+	}
+	if a.Length > 0 {
+		counts = apportion(counts, total, a.Length)
+	} else if total > MaxReplayLength {
+		return nil, fmt.Errorf("expanding %d queries by count gives %d queries (max %d), set a replay length to scale them down", len(qs), total, MaxReplayLength)
+	}
+	return expand(qs, counts), nil
+}
+
+// weight returns the number of times the query was searched, at least 1.
+func (q *SearchQuery) weight() int64 {
+	return int64(max(q.Count, 1))
+}
+
+// sample draws `length` queries (default: as many as there are queries) at
+// random, in proportion to their weight.
+func sample(qs []*SearchQuery, total int64, length int, seed int64) []*SearchQuery {
+	if length == 0 {
+		length = len(qs)
+	}
+
+	cumulative := make([]int64, len(qs))
+	var sum int64
+	for i, q := range qs {
+		sum += q.weight()
+		cumulative[i] = sum
+	}
+
+	r := rand.New(rand.NewSource(seed))
+	stream := make([]*SearchQuery, 0, length)
+	for len(stream) < length {
+		x := r.Int63n(total)
+		i := sort.Search(len(cumulative), func(i int) bool { return cumulative[i] > x })
+		stream = append(stream, qs[i])
+	}
+	return stream
+}
+
+// apportion scales the counts down (or up) to add up to `length`, using the
+// largest remainder method. Queries may end up with a count of 0.
+func apportion(counts []int64, total int64, length int) []int64 {
+	scaled := make([]int64, len(counts))
+	remainders := make([]float64, len(counts))
+	var assigned int64
+	for i, c := range counts {
+		exact := float64(c) * float64(length) / float64(total)
+		scaled[i] = int64(exact)
+		remainders[i] = exact - float64(scaled[i])
+		assigned += scaled[i]
+	}
+
+	order := make([]int, len(counts))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return remainders[order[i]] > remainders[order[j]] })
+	for i := 0; assigned < int64(length) && i < len(order); i++ {
+		scaled[order[i]]++
+		assigned++
+	}
+	return scaled
+}
+
+// expand repeats every query by its count, spreading the repeats of each
+// query evenly across the stream (the k-th of n repeats is placed at
+// (k + 0.5) / n), rather than running them back to back.
+func expand(qs []*SearchQuery, counts []int64) []*SearchQuery {
+	type slot struct {
+		at float64
+		i  int
+	}
+	var slots []slot
+	for i, c := range counts {
+		for k := int64(0); k < c; k++ {
+			slots = append(slots, slot{at: (float64(k) + 0.5) / float64(c), i: i})
+		}
+	}
+	sort.SliceStable(slots, func(i, j int) bool { return slots[i].at < slots[j].at })
+
+	stream := make([]*SearchQuery, len(slots))
+	for n, s := range slots {
+		stream[n] = qs[s.i]
+	}
+	return stream
+}
@@ -0,0 +1,154 @@
+package query
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// queries returns one query per letter, searched the given number of times.
+func queries(letters string, counts ...int) []*SearchQuery {
+	qs := make([]*SearchQuery, len(letters))
+	for i, l := range letters {
+		qs[i] = &SearchQuery{RawKeyword: string(l), Count: counts[i]}
+	}
+	return qs
+}
+
+// keywords joins the keywords of the given queries, e.g. "aabca".
+func keywords(qs []*SearchQuery) string {
+	var b strings.Builder
+	for _, q := range qs {
+		b.WriteString(q.RawKeyword)
+	}
+	return b.String()
+}
+
+func TestApportion(t *testing.T) {
+	tests := []struct {
+		name   string
+		counts []int64
+		length int
+		want   []int64
+	}{
+		{"largest remainders first", []int64{6, 3, 1, 1}, 5, []int64{3, 1, 1, 0}},
+		{"scaled up", []int64{1, 1}, 4, []int64{2, 2}},
+		{"unchanged", []int64{3, 2}, 5, []int64{3, 2}},
+		{"rarest dropped", []int64{100, 1, 1}, 2, []int64{2, 0, 0}},
+		{"ties keep file order", []int64{1, 1, 1}, 2, []int64{1, 1, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var total int64
+			for _, c := range tt.counts {
+				total += c
+			}
+			if got := apportion(tt.counts, total, tt.length); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("apportion(%v, %d, %d) = %v, want %v", tt.counts, total, tt.length, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpand(t *testing.T) {
+	tests := []struct {
+		name   string
+		counts []int64
+		want   string
+	}{
+		{"repeats spread evenly", []int64{2, 1}, "aba"},
+		{"ties keep file order", []int64{3, 1, 1, 0}, "aabca"},
+		{"zero counts dropped", []int64{0, 2}, "bb"},
+		{"once each", []int64{1, 1, 1}, "abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qs := queries("abcd"[:len(tt.counts)], make([]int, len(tt.counts))...)
+			if got := keywords(expand(qs, tt.counts)); got != tt.want {
+				t.Errorf("expand(%v) = %s, want %s", tt.counts, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplay(t *testing.T) {
+	tests := []struct {
+		name string
+		qs   []*SearchQuery
+		args ReplayArgs
+		want string
+	}{
+		{"flat by default", queries("ab", 5, 1), ReplayArgs{}, "ab"},
+		{"flat", queries("ab", 5, 1), ReplayArgs{Mode: ReplayFlat}, "ab"},
+		{"expand by count", queries("ab", 2, 1), ReplayArgs{Mode: ReplayExpand}, "aba"},
+		{"expand counts queries without a count once", queries("ab", 0, 2), ReplayArgs{Mode: ReplayExpand}, "bab"},
+		{"expand to length", queries("abcd", 6, 3, 1, 1), ReplayArgs{Mode: ReplayExpand, Length: 5}, "aabca"},
+		{"no queries", nil, ReplayArgs{Mode: ReplaySample}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream, err := Replay(tt.qs, tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := keywords(stream); got != tt.want {
+				t.Errorf("Replay(%+v) = %s, want %s", tt.args, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplaySample(t *testing.T) {
+	qs := queries("ab", 99, 1)
+
+	stream, err := Replay(qs, ReplayArgs{Mode: ReplaySample, Length: 1000, Seed: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stream) != 1000 {
+		t.Fatalf("got %d queries, want 1000", len(stream))
+	}
+	if a := strings.Count(keywords(stream), "a"); a < 950 {
+		t.Errorf("got %d of 1000 queries searched 99%% of the time", a)
+	}
+
+	again, _ := Replay(qs, ReplayArgs{Mode: ReplaySample, Length: 1000, Seed: 7})
+	if keywords(again) != keywords(stream) {
+		t.Error("the same seed gave a different stream")
+	}
+
+	byDefault, _ := Replay(qs, ReplayArgs{Mode: ReplaySample})
+	if len(byDefault) != len(qs) {
+		t.Errorf("got %d queries by default, want %d", len(byDefault), len(qs))
+	}
+}
+
+func TestReplayArgsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    ReplayArgs
+		wantErr bool
+	}{
+		{"default", ReplayArgs{}, false},
+		{"flat", ReplayArgs{Mode: ReplayFlat}, false},
+		{"flat with length", ReplayArgs{Mode: ReplayFlat, Length: 10}, true},
+		{"expand with length", ReplayArgs{Mode: ReplayExpand, Length: 10}, false},
+		{"sample with max length", ReplayArgs{Mode: ReplaySample, Length: MaxReplayLength}, false},
+		{"length too long", ReplayArgs{Mode: ReplaySample, Length: MaxReplayLength + 1}, true},
+		{"negative length", ReplayArgs{Mode: ReplayExpand, Length: -1}, true},
+		{"unknown mode", ReplayArgs{Mode: "shuffle"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.args.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReplayExpandTooLong(t *testing.T) {
+	if _, err := Replay(queries("a", MaxReplayLength+1), ReplayArgs{Mode: ReplayExpand}); err == nil {
+		t.Error("expanding beyond the max replay length without a length didn't fail")
+	}
+}
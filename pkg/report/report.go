@@ -0,0 +1,242 @@
+package report
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/anrid/search-bench/pkg/engine"
+)
+
+const (
+	ModeIndex     = "index"
+	ModeBenchmark = "benchmark"
+)
+
+// Report is a machine readable summary of an indexing or query benchmark run,
+// written to a JSON or CSV file so that runs can be archived and diffed.
+type Report struct {
+	Mode          string                 `json:"mode"`
+	Engine        string                 `json:"engine"`
+	EngineVersion string                 `json:"engine_version"`
+	Index         string                 `json:"index"`
+	IndexSettings interface{}            `json:"index_settings"`
+	StartedAt     time.Time              `json:"started_at"`
+	Params        map[string]interface{} `json:"params"` // Batch size, number of runs, concurrency etc.
+	ItemCount     int64                  `json:"item_count"`
+	Phases        []*Phase               `json:"phases"`
+	StatsBefore   *engine.IndexStats     `json:"stats_before,omitempty"`
+	StatsAfter    *engine.IndexStats     `json:"stats_after,omitempty"`
+	Errors        *Errors                `json:"errors,omitempty"`
+}
+
+// Errors summarizes everything that was skipped or failed during a run
+// without failing the run as a whole.
+type Errors struct {
+	SkippedRows         int            `json:"skipped_rows"`
+	SkipReasons         map[string]int `json:"skip_reasons,omitempty"`
+	FailedBatches       int            `json:"failed_batches"`
+	FailedItems         int            `json:"failed_items"` // Items in failed batches
+	FailedDocs          int            `json:"failed_docs"`  // Documents that failed in otherwise successful batches
+	SkippedQueries      int            `json:"skipped_queries"`
+	SkippedQueryReasons map[string]int `json:"skipped_query_reasons,omitempty"`
+	FailedQueries       int64          `json:"failed_queries"`
+	FailedRequests      int64          `json:"failed_requests"`
+	Retries             int64          `json:"retries"`
+	EngineErrors        []string       `json:"engine_errors,omitempty"` // Failed engine calls after the run, e.g. refreshing the index or getting its stats
+}
+
+// Phase is a single part of a run, e.g. indexing or executing all queries
+// with or without write load.
+type Phase struct {
+	Name       string                 `json:"name"`
+	RunsMs     []float64              `json:"runs_ms"`
+	AverageMs  float64                `json:"average_ms"`
+	Count      int64                  `json:"count"` // Items indexed or queries executed per run
+	Requests   int64                  `json:"requests"`
+	Errors     int64                  `json:"errors"`
+	Throughput float64                `json:"throughput"` // Items or queries per second
+	Latencies  []*Latency             `json:"latencies,omitempty"`
+	Extra      map[string]interface{} `json:"extra,omitempty"`
+}
+
+type Latency struct {
+	Shape   string  `json:"shape"`
+	Page    string  `json:"page"`
+	Measure string  `json:"measure"` // "client", "took" or "query"
+	Count   int64   `json:"count"`
+	MeanMs  float64 `json:"mean_ms"`
+	P50Ms   float64 `json:"p50_ms"`
+	P90Ms   float64 `json:"p90_ms"`
+	P99Ms   float64 `json:"p99_ms"`
+	P999Ms  float64 `json:"p99_9_ms"`
+	MaxMs   float64 `json:"max_ms"`
+}
+
+// Ms converts a duration to (fractional) milliseconds.
+func Ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// ValidFilename returns an error if reports can't be written to the given
+// file, so that a bad filename is caught before a run rather than after.
+func ValidFilename(filename string) error {
+	switch filepath.Ext(filename) {
+	case ".json", ".csv":
+		return nil
+	}
+	return fmt.Errorf("unsupported report file format '%s' (use .json or .csv)", filename)
+}
+
+// Write writes the report to a JSON or CSV file, depending on the extension
+// of the filename.
+func (r *Report) Write(filename string) error {
+	if err := ValidFilename(filename); err != nil {
+		return err
+	}
+
+	var err error
+	if filepath.Ext(filename) == ".json" {
+		err = r.writeJSON(filename)
+	} else {
+		err = r.writeCSV(filename)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Wrote %s report to file: %s\n", r.Mode, filename)
+	return nil
+}
+
+func (r *Report) writeJSON(filename string) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, b, 0777)
+}
+
+// writeCSV writes the report in long format, i.e. one metric per row, which
+// makes it easy to diff and to concatenate reports from several runs.
+func (r *Report) writeCSV(filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+
+	err = w.Write([]string{"started_at", "mode", "engine", "engine_version", "index", "phase", "metric", "value"})
+	if err != nil {
+		return err
+	}
+
+	row := func(phase, metric string, value interface{}) {
+		if err != nil {
+			return
+		}
+		var v string
+		switch t := value.(type) {
+		case float64:
+			v = strconv.FormatFloat(t, 'f', 3, 64)
+		default:
+			v = fmt.Sprint(t)
+		}
+		err = w.Write([]string{
+			r.StartedAt.Format(time.RFC3339), r.Mode, r.Engine, r.EngineVersion, r.Index,
+			phase, metric, v,
+		})
+	}
+
+	var params []string
+	for k := range r.Params {
+		params = append(params, k)
+	}
+	sort.Strings(params)
+	for _, k := range params {
+		row("", "param."+k, r.Params[k])
+	}
+
+	row("", "item_count", r.ItemCount)
+	if r.StatsBefore != nil {
+		row("", "docs_before", r.StatsBefore.DocsCount)
+		row("", "size_in_bytes_before", r.StatsBefore.SizeInBytes)
+	}
+	if r.StatsAfter != nil {
+		row("", "docs_after", r.StatsAfter.DocsCount)
+		row("", "size_in_bytes_after", r.StatsAfter.SizeInBytes)
+	}
+	if e := r.Errors; e != nil {
+		row("", "errors.skipped_rows", e.SkippedRows)
+		var reasons []string
+		for k := range e.SkipReasons {
+			reasons = append(reasons, k)
+		}
+		sort.Strings(reasons)
+		for _, k := range reasons {
+			row("", "errors.skip_reason."+k, e.SkipReasons[k])
+		}
+		row("", "errors.failed_batches", e.FailedBatches)
+		row("", "errors.failed_items", e.FailedItems)
+		row("", "errors.failed_docs", e.FailedDocs)
+		row("", "errors.skipped_queries", e.SkippedQueries)
+		reasons = reasons[:0]
+		for k := range e.SkippedQueryReasons {
+			reasons = append(reasons, k)
+		}
+		sort.Strings(reasons)
+		for _, k := range reasons {
+			row("", "errors.skipped_query_reason."+k, e.SkippedQueryReasons[k])
+		}
+		row("", "errors.failed_queries", e.FailedQueries)
+		row("", "errors.failed_requests", e.FailedRequests)
+		row("", "errors.retries", e.Retries)
+		for i, msg := range e.EngineErrors {
+			row("", fmt.Sprintf("errors.engine_error_%d", i+1), msg)
+		}
+	}
+
+	for _, p := range r.Phases {
+		for i, ms := range p.RunsMs {
+			row(p.Name, fmt.Sprintf("run_%d_ms", i+1), ms)
+		}
+		row(p.Name, "average_ms", p.AverageMs)
+		row(p.Name, "count", p.Count)
+		row(p.Name, "requests", p.Requests)
+		row(p.Name, "errors", p.Errors)
+		row(p.Name, "throughput", p.Throughput)
+
+		for _, l := range p.Latencies {
+			prefix := fmt.Sprintf("latency.%s.%s.%s.", l.Shape, l.Page, l.Measure)
+			row(p.Name, prefix+"count", l.Count)
+			row(p.Name, prefix+"mean_ms", l.MeanMs)
+			row(p.Name, prefix+"p50_ms", l.P50Ms)
+			row(p.Name, prefix+"p90_ms", l.P90Ms)
+			row(p.Name, prefix+"p99_ms", l.P99Ms)
+			row(p.Name, prefix+"p99_9_ms", l.P999Ms)
+			row(p.Name, prefix+"max_ms", l.MaxMs)
+		}
+
+		var extra []string
+		for k := range p.Extra {
+			extra = append(extra, k)
+		}
+		sort.Strings(extra)
+		for _, k := range extra {
+			row(p.Name, k, p.Extra[k])
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,242 @@
+package results
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/anrid/search-bench/pkg/item"
+	"github.com/anrid/search-bench/pkg/query"
+	"github.com/bytedance/sonic"
+)
+
+// Version is the version of the JSON lines results format written by this
+// package. Version 0 is the legacy format, i.e.
+// `<query number>|bm=<0 or 1>|<comma separated item IDs>`, which only holds
+// the IDs on the first page of results.
+const Version = 1
+
+// Record holds the results of a single query, i.e. a line in a results file.
+type Record struct {
+	Version       int                `json:"v"`
+	QueryNumber   int                `json:"qn"`
+	Bestmatch     bool               `json:"bm"` // Sorted by score rather than by date
+	Query         *query.SearchQuery `json:"query,omitempty"`
+	Total         int64              `json:"total"`
+	TotalRelation string             `json:"total_relation"` // "eq" or "gte"
+	LatencyMs     float64            `json:"latency_ms"`     // Time to fetch all pages, including retries
+	Pages         []*Page            `json:"pages"`
+}
+
+// Page is a single page of results.
+type Page struct {
+	From      int     `json:"from"`
+	TookMs    int64   `json:"took_ms"`    // As reported by the engine
+	LatencyMs float64 `json:"latency_ms"` // As measured by the client
+	Hits      []*Hit  `json:"hits"`
+}
+
+type Hit struct {
+	ID           string           `json:"id"`
+	Score        float64          `json:"score"`
+	Source       *item.Item       `json:"source,omitempty"`         // Only set when fetching sources from the items index
+	SourceNoDesc *item.ItemNoDesc `json:"source_no_desc,omitempty"` // Only set when fetching sources from the items_no_desc index
+}
+
+// HasTotal returns true if the total number of hits is known, i.e. the record
+// isn't in the legacy format.
+func (r *Record) HasTotal() bool {
+	return r.Version >= 1
+}
+
+// HasScores returns true if hits carry scores, i.e. the record isn't in the
+// legacy format and the query is sorted by score.
+func (r *Record) HasScores() bool {
+	return r.Version >= 1 && r.Bestmatch
+}
+
+// FirstPage returns the hits on the first page of results, if any.
+func (r *Record) FirstPage() []*Hit {
+	if len(r.Pages) == 0 {
+		return nil
+	}
+	return r.Pages[0].Hits
+}
+
+// IDs returns the IDs on the first page of results, in ranked order. Only the
+// first page is compared between results files, since that's all the legacy
+// format holds.
+func (r *Record) IDs() []string {
+	hits := r.FirstPage()
+	ids := make([]string, 0, len(hits))
+	for _, h := range hits {
+		ids = append(ids, h.ID)
+	}
+	return ids
+}
+
+// ParseLine parses a line in a results file in either format.
+func ParseLine(line string) (*Record, error) {
+	if strings.HasPrefix(line, "{") {
+		r := new(Record)
+		if err := sonic.UnmarshalString(line, r); err != nil {
+			return nil, fmt.Errorf("could not parse results line '%.100s': %w", line, err)
+		}
+		if r.Version > Version {
+			return nil, fmt.Errorf("unsupported results format version %d (supported: up to %d)", r.Version, Version)
+		}
+		return r, nil
+	}
+
+	p := strings.SplitN(line, "|", 3)
+	if len(p) != 3 {
+		return nil, fmt.Errorf("expected 3 parts in results line: '%.100s'", line)
+	}
+
+	qn, err := strconv.Atoi(p[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid query number in results line: '%.100s'", line)
+	}
+
+	page := new(Page)
+	for _, id := range strings.Split(p[2], ",") {
+		if id != "" {
+			page.Hits = append(page.Hits, &Hit{ID: id})
+		}
+	}
+
+	return &Record{
+		QueryNumber: qn,
+		Bestmatch:   p[1] == "bm=1",
+		Pages:       []*Page{page},
+	}, nil
+}
+
+// Reader reads records from a results file in either format, one at a time.
+// Gzip compressed files are decompressed on the fly.
+type Reader struct {
+	Name string
+	f    *os.File
+	gz   *gzip.Reader
+	s    *bufio.Scanner
+	line int
+}
+
+func Open(resultsFile string) (*Reader, error) {
+	f, err := os.Open(resultsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Reader{Name: resultsFile, f: f}
+
+	br := bufio.NewReader(f)
+	var in io.Reader = br
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		r.gz, err = gzip.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("could not read compressed results file %s: %w", resultsFile, err)
+		}
+		in = r.gz
+	}
+
+	r.s = bufio.NewScanner(in)
+	r.s.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+
+	return r, nil
+}
+
+// Next returns the next record, or `io.EOF` at the end of the file.
+func (r *Reader) Next() (*Record, error) {
+	for r.s.Scan() {
+		r.line++
+		line := strings.TrimSpace(r.s.Text())
+		if line == "" {
+			continue
+		}
+		rec, err := ParseLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", r.Name, r.line, err)
+		}
+		return rec, nil
+	}
+	if err := r.s.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+func (r *Reader) Close() error {
+	if r.gz != nil {
+		r.gz.Close()
+	}
+	return r.f.Close()
+}
+
+// Writer writes a results file, gzip compressed when its name ends in .gz.
+type Writer struct {
+	f  *os.File
+	gz *gzip.Writer
+	w  *bufio.Writer
+}
+
+func Create(resultsFile string) (*Writer, error) {
+	f, err := os.OpenFile(resultsFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Writer{f: f}
+	if strings.HasSuffix(resultsFile, ".gz") {
+		w.gz = gzip.NewWriter(f)
+		w.w = bufio.NewWriterSize(w.gz, 1024*1024)
+	} else {
+		w.w = bufio.NewWriterSize(f, 1024*1024)
+	}
+
+	return w, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	return w.w.Write(p)
+}
+
+// Close flushes all buffered records and closes the file.
+func (w *Writer) Close() error {
+	err := w.w.Flush()
+	if w.gz != nil {
+		if gzErr := w.gz.Close(); err == nil {
+			err = gzErr
+		}
+	}
+	if closeErr := w.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// ReadAll reads all records in a results file.
+func ReadAll(resultsFile string) ([]*Record, error) {
+	r, err := Open(resultsFile)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var recs []*Record
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return recs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+}
@@ -0,0 +1,92 @@
+package results
+
+import (
+	"io"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name      string
+		line      string
+		version   int
+		qn        int
+		bestmatch bool
+		ids       []string
+		wantErr   bool
+	}{
+		{name: "legacy bestmatch", line: "12|bm=1|a,b,c", qn: 12, bestmatch: true, ids: []string{"a", "b", "c"}},
+		{name: "legacy sort by date", line: "3|bm=0|a", qn: 3, ids: []string{"a"}},
+		{name: "legacy without results", line: "4|bm=1|", qn: 4, bestmatch: true, ids: []string{}},
+		{
+			name:      "json",
+			line:      `{"v":1,"qn":7,"bm":true,"total":2,"total_relation":"eq","pages":[{"from":0,"hits":[{"id":"a","score":1.5},{"id":"b","score":1}]}]}`,
+			version:   1,
+			qn:        7,
+			bestmatch: true,
+			ids:       []string{"a", "b"},
+		},
+		{name: "json without pages", line: `{"v":1,"qn":8,"bm":false,"pages":[]}`, version: 1, qn: 8, ids: []string{}},
+		{name: "legacy missing parts", line: "12|a,b", wantErr: true},
+		{name: "legacy invalid query number", line: "x|bm=1|a", wantErr: true},
+		{name: "malformed json", line: `{"v":1,"qn":`, wantErr: true},
+		{name: "unsupported version", line: `{"v":2,"qn":1}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := ParseLine(tt.line)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseLine(%q) = %+v, want error", tt.line, r)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Version != tt.version || r.QueryNumber != tt.qn || r.Bestmatch != tt.bestmatch || !reflect.DeepEqual(r.IDs(), tt.ids) {
+				t.Errorf("ParseLine(%q) = v%d qn %d bm %v %v, want v%d qn %d bm %v %v",
+					tt.line, r.Version, r.QueryNumber, r.Bestmatch, r.IDs(), tt.version, tt.qn, tt.bestmatch, tt.ids)
+			}
+			if r.HasTotal() != (tt.version >= 1) {
+				t.Errorf("HasTotal() = %v for version %d", r.HasTotal(), tt.version)
+			}
+		})
+	}
+}
+
+func TestWriteAndRead(t *testing.T) {
+	lines := "{\"v\":1,\"qn\":1,\"bm\":true,\"pages\":[{\"from\":0,\"hits\":[{\"id\":\"a\",\"score\":2}]}]}\n\n2|bm=0|b,c\n"
+
+	for _, name := range []string{"results.jsonl", "results.jsonl.gz"} {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), name)
+			w, err := Create(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.WriteString(w, lines); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			recs, err := ReadAll(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(recs) != 2 {
+				t.Fatalf("read %d records, want 2", len(recs))
+			}
+			if recs[0].QueryNumber != 1 || !recs[0].HasScores() || recs[0].FirstPage()[0].Score != 2 {
+				t.Errorf("got first record %+v", recs[0])
+			}
+			if recs[1].QueryNumber != 2 || recs[1].HasScores() || !reflect.DeepEqual(recs[1].IDs(), []string{"b", "c"}) {
+				t.Errorf("got second record %+v", recs[1])
+			}
+		})
+	}
+}